@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// updateConfig applies a change to the config file and persists it
+func updateConfig(w http.ResponseWriter, change func(*Config) error) (*Config, bool) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config, err := loadConfig("config.json")
+	if err != nil {
+		log.Printf("ERROR: Failed to load config: %v\n", err)
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return nil, false
+	}
+	if err := change(config); err != nil {
+		writeScriptError(w, err)
+		return nil, false
+	}
+	if err := saveConfig("config.json", config); err != nil {
+		log.Printf("ERROR: Failed to save config: %v\n", err)
+		http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+		return nil, false
+	}
+	return config, true
+}
+
+// adminAPIKeyHandler sets or rotates the Pixie API key
+func adminAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Only PUT allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		APIKey string `json:"api_key"`
+		// Verify checks the new key against the default cluster before saving it
+		Verify bool `json:"verify"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.APIKey == "" {
+		http.Error(w, "Missing 'api_key' field in request body", http.StatusBadRequest)
+		return
+	}
+
+	_, ok := updateConfig(w, func(c *Config) error {
+		if req.Verify {
+			candidate := *c
+			candidate.PXAPIKey = req.APIKey
+			ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+			defer cancel()
+			// The candidate may be rejected, so its client isn't pooled
+			if _, err := checkCredentials(ctx, &candidate, c.PXClusterID); err != nil {
+				return &scriptError{http.StatusUnprocessableEntity, "API key verification failed", err}
+			}
+		}
+		c.PXAPIKey = req.APIKey
+		return nil
+	})
+	if !ok {
+		return
+	}
+	// Clients authenticated with the old key are no longer needed
+	pool.invalidate("")
+	log.Println("Pixie API key rotated via admin API")
+	writeJSON(w, map[string]interface{}{"status": "ok"})
+}
+
+// adminClustersHandler lists registered clusters
+func adminClustersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	config, err := requestConfig(r)
+	if err != nil {
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+	type cluster struct {
+		Name      string `json:"name"`
+		ClusterID string `json:"cluster_id"`
+		Default   bool   `json:"default"`
+	}
+	clusters := []cluster{{Name: "", ClusterID: config.PXClusterID, Default: true}}
+	for name, c := range config.Clusters {
+		clusters = append(clusters, cluster{Name: name, ClusterID: c.ClusterID})
+	}
+	sort.Slice(clusters[1:], func(i, j int) bool { return clusters[i+1].Name < clusters[j+1].Name })
+	writeJSON(w, map[string]interface{}{"clusters": clusters})
+}
+
+// adminClusterHandler registers (PUT) or deregisters (DELETE) a named cluster
+func adminClusterHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodPut:
+		var req ClusterConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.ClusterID == "" {
+			http.Error(w, "Missing 'cluster_id' field in request body", http.StatusBadRequest)
+			return
+		}
+		var previous string
+		_, ok := updateConfig(w, func(c *Config) error {
+			if c.Clusters == nil {
+				c.Clusters = make(map[string]ClusterConfig)
+			}
+			previous = c.Clusters[name].ClusterID
+			c.Clusters[name] = req
+			return nil
+		})
+		if !ok {
+			return
+		}
+		if previous != "" {
+			pool.invalidate(previous)
+		}
+		log.Printf("Cluster %q registered as %s via admin API\n", name, req.ClusterID)
+		writeJSON(w, map[string]interface{}{"name": name, "cluster_id": req.ClusterID})
+
+	case http.MethodDelete:
+		var removed string
+		_, ok := updateConfig(w, func(c *Config) error {
+			cluster, found := c.Clusters[name]
+			if !found {
+				return &scriptError{http.StatusNotFound, "Unknown cluster", errUnknownCluster(name)}
+			}
+			removed = cluster.ClusterID
+			delete(c.Clusters, name)
+			return nil
+		})
+		if !ok {
+			return
+		}
+		pool.invalidate(removed)
+		log.Printf("Cluster %q deregistered via admin API\n", name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Only PUT and DELETE allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminInvalidateHandler drops cached Vizier clients, for one cluster or all of them
+func adminInvalidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	clusterID := ""
+	if name := r.URL.Query().Get("cluster"); name != "" {
+		config, err := requestConfig(r)
+		if err != nil {
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+		if clusterID, err = config.clusterID(name); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+	}
+	n := pool.invalidate(clusterID)
+	writeJSON(w, map[string]interface{}{"invalidated": n})
+}
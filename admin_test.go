@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	defaultClusterID = "00000000-0000-0000-0000-000000000000"
+	prodClusterID    = "00000000-0000-0000-0000-000000000001"
+	stagingClusterID = "00000000-0000-0000-0000-000000000002"
+	movedClusterID   = "00000000-0000-0000-0000-000000000003"
+)
+
+// adminRequest serves r with the config in the working directory, as withConfig does
+func adminRequest(t *testing.T, handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	config, err := loadConfig("config.json")
+	r = r.WithContext(context.WithValue(r.Context(), configKey{}, &loadedConfig{config: config, err: err}))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestAdminClusters(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("config.json", []byte(`{"px_api_key": "px-api-test", "cloud_addr": "127.0.0.1:1", "px_cluster_id": "`+defaultClusterID+`"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	saved := pool
+	defer func() { pool = saved }()
+	pool = newTestPool()
+
+	register := func(name, id string) int {
+		r := httptest.NewRequest(http.MethodPut, "/admin/clusters/"+name, strings.NewReader(`{"cluster_id": "`+id+`"}`))
+		r.SetPathValue("name", name)
+		return adminRequest(t, adminClusterHandler, r).Code
+	}
+	for _, c := range []struct{ name, id string }{{"staging", stagingClusterID}, {"prod", prodClusterID}} {
+		if code := register(c.name, c.id); code != http.StatusOK {
+			t.Fatalf("registering %s: status %d", c.name, code)
+		}
+	}
+	if code := register("prod", ""); code != http.StatusBadRequest {
+		t.Errorf("registering without a cluster_id: status %d, want 400", code)
+	}
+
+	// Registered clusters are listed after the default one, by name
+	w := adminRequest(t, adminClustersHandler, httptest.NewRequest(http.MethodGet, "/admin/clusters", nil))
+	var list struct {
+		Clusters []struct {
+			Name      string `json:"name"`
+			ClusterID string `json:"cluster_id"`
+		} `json:"clusters"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range list.Clusters {
+		got = append(got, c.Name+"="+c.ClusterID)
+	}
+	if want := []string{"=" + defaultClusterID, "prod=" + prodClusterID, "staging=" + stagingClusterID}; !reflect.DeepEqual(got, want) {
+		t.Errorf("clusters = %v, want %v", got, want)
+	}
+
+	// Moving a name to another cluster drops the clients of the old one
+	if _, err := pool.get(context.Background(), &Config{PXAPIKey: "px-api-test", CloudAddr: "127.0.0.1:1"}, prodClusterID); err != nil {
+		t.Fatal(err)
+	}
+	if code := register("prod", movedClusterID); code != http.StatusOK {
+		t.Fatalf("re-registering prod: status %d", code)
+	}
+	if _, pooled := pool.clusterState(prodClusterID); pooled {
+		t.Error("client of the replaced cluster still pooled")
+	}
+
+	deregister := func(name string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/admin/clusters/"+name, nil)
+		r.SetPathValue("name", name)
+		return adminRequest(t, adminClusterHandler, r).Code
+	}
+	if code := deregister("staging"); code != http.StatusNoContent {
+		t.Errorf("deregistering staging: status %d", code)
+	}
+	if code := deregister("staging"); code != http.StatusNotFound {
+		t.Errorf("deregistering staging again: status %d, want 404", code)
+	}
+
+	// Changes are persisted to the config file
+	config, err := loadConfig("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]ClusterConfig{"prod": {ClusterID: movedClusterID}}; !reflect.DeepEqual(config.Clusters, want) || config.PXAPIKey != "px-api-test" {
+		t.Errorf("saved config has clusters %v and key %q", config.Clusters, config.PXAPIKey)
+	}
+}
+
+func TestAdminInvalidate(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("config.json", []byte(`{"px_api_key": "px-api-test", "cloud_addr": "127.0.0.1:1", "px_cluster_id": "`+defaultClusterID+`", "clusters": {"prod": {"cluster_id": "`+prodClusterID+`"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	saved := pool
+	defer func() { pool = saved }()
+	pool = newTestPool()
+	config, err := loadConfig("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{defaultClusterID, prodClusterID} {
+		if _, err := pool.get(context.Background(), config, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantBody   string
+		wantLeft   int
+	}{
+		{"?cluster=staging", http.StatusNotFound, "", 2},
+		{"?cluster=prod", http.StatusOK, `{"invalidated":1}`, 1},
+		{"", http.StatusOK, `{"invalidated":1}`, 0},
+	}
+	for _, tt := range tests {
+		w := adminRequest(t, adminInvalidateHandler, httptest.NewRequest(http.MethodPost, "/admin/invalidate"+tt.query, nil))
+		if w.Code != tt.wantStatus || (tt.wantBody != "" && strings.TrimSpace(w.Body.String()) != tt.wantBody) {
+			t.Errorf("invalidate%s: %d %s, want %d %s", tt.query, w.Code, w.Body, tt.wantStatus, tt.wantBody)
+		}
+		if _, left := pool.size(); left != tt.wantLeft {
+			t.Errorf("invalidate%s left %d Vizier clients, want %d", tt.query, left, tt.wantLeft)
+		}
+	}
+}
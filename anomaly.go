@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AnomalyConfig flags values of an export job's numeric columns that deviate from their
+// rolling baselines
+type AnomalyConfig struct {
+	// Columns to watch (default: every int64 and float64 column)
+	Columns []string `json:"columns,omitempty"`
+	// GroupBy keeps a baseline per value of these columns, e.g. ["pod"]
+	GroupBy []string `json:"group_by,omitempty"`
+	// Threshold is the deviation from the mean, in standard deviations, that is flagged (default 3)
+	Threshold float64 `json:"threshold,omitempty"`
+	// Alpha is the weight of each new value in the exponentially weighted baselines (default 0.1)
+	Alpha float64 `json:"alpha,omitempty"`
+	// MinSamples is the number of values a baseline needs before it flags anything (default 10)
+	MinSamples int `json:"min_samples,omitempty"`
+	// Annotate adds an "anomalies" column listing the flagged columns of each row to the
+	// rows shipped to the destination and to the archived result
+	Annotate bool `json:"annotate,omitempty"`
+}
+
+const (
+	defaultAnomalyThreshold = 3
+	defaultAnomalyAlpha     = 0.1
+	defaultAnomalySamples   = 10
+	// maxBaselines bounds the baselines kept per job, e.g. for groups with many values
+	maxBaselines = 10000
+	// maxAlerts is the number of recent alerts kept for /alerts
+	maxAlerts = 1000
+	// anomalyColumn is the column Annotate adds to the result
+	anomalyColumn = "anomalies"
+)
+
+// baseline is an exponentially weighted mean and variance
+type baseline struct {
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+	Samples  int     `json:"samples"`
+}
+
+// score is the deviation of v from the mean in standard deviations. The deviation is
+// floored at 1% of the mean so constant series don't flag the slightest change.
+func (b *baseline) score(v float64) float64 {
+	std := max(math.Sqrt(b.Variance), math.Abs(b.Mean)*0.01, 1e-9)
+	return math.Abs(v-b.Mean) / std
+}
+
+func (b *baseline) add(v, alpha float64) {
+	if b.Samples == 0 {
+		b.Mean = v
+	} else {
+		diff := v - b.Mean
+		incr := alpha * diff
+		b.Mean += incr
+		b.Variance = (1 - alpha) * (b.Variance + diff*incr)
+	}
+	b.Samples++
+}
+
+// anomalyAlert is a value flagged as anomalous
+type anomalyAlert struct {
+	Job    string `json:"job"`
+	Column string `json:"column"`
+	// Group holds the group_by values of the row, if any
+	Group  map[string]string `json:"group,omitempty"`
+	Value  float64           `json:"value"`
+	Mean   float64           `json:"mean"`
+	StdDev float64           `json:"stddev"`
+	Score  float64           `json:"score"`
+	// Time is the row's timestamp, or when it was checked if it has none
+	Time time.Time `json:"time"`
+}
+
+// anomalyDetector keeps the baselines of all jobs, persisted to the history database when
+// it is enabled, and their recent alerts
+type anomalyDetector struct {
+	mu        sync.Mutex
+	baselines map[string]map[string]*baseline
+	alerts    []anomalyAlert
+	db        *sql.DB
+}
+
+var anomalies = &anomalyDetector{baselines: make(map[string]map[string]*baseline)}
+
+const anomalySchema = `
+CREATE TABLE IF NOT EXISTS anomaly_baselines (
+	job       TEXT PRIMARY KEY,
+	baselines TEXT NOT NULL
+);
+`
+
+// persistTo loads the baselines saved in the history database and saves them there from now on
+func (d *anomalyDetector) persistTo(h *historyStore) error {
+	if _, err := h.db.Exec(anomalySchema); err != nil {
+		return fmt.Errorf("could not initialize anomaly baselines table: %w", err)
+	}
+	rows, err := h.db.Query(`SELECT job, baselines FROM anomaly_baselines`)
+	if err != nil {
+		return fmt.Errorf("could not load anomaly baselines: %w", err)
+	}
+	defer rows.Close()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for rows.Next() {
+		var job, saved string
+		if err := rows.Scan(&job, &saved); err != nil {
+			return fmt.Errorf("could not load anomaly baselines: %w", err)
+		}
+		bs := make(map[string]*baseline)
+		if err := json.Unmarshal([]byte(saved), &bs); err != nil {
+			return fmt.Errorf("could not load anomaly baselines of job %q: %w", job, err)
+		}
+		d.baselines[job] = bs
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not load anomaly baselines: %w", err)
+	}
+	d.db = h.db
+	return nil
+}
+
+// save persists the baselines of a job; d.mu must be held
+func (d *anomalyDetector) save(job string) {
+	if d.db == nil {
+		return
+	}
+	saved, _ := json.Marshal(d.baselines[job])
+	if _, err := d.db.Exec(`INSERT INTO anomaly_baselines (job, baselines) VALUES (?, ?)
+		ON CONFLICT(job) DO UPDATE SET baselines = excluded.baselines`, job, string(saved)); err != nil {
+		log.Printf("ERROR: Failed to save anomaly baselines of job %q: %v\n", job, err)
+	}
+}
+
+// anomalyCheck is the outcome of scoring a result, applied by commit once the result has
+// been delivered
+type anomalyCheck struct {
+	job string
+	// flags holds the flagged columns per row
+	flags  [][]string
+	raised []anomalyAlert
+	// updated holds the baselines with the result's values folded in
+	updated map[string]baseline
+}
+
+// check scores the watched cells of res against their baselines, each cell against the
+// baseline as updated by the rows before it. Nothing is recorded until the check is
+// committed, so a run that fails to deliver and is retried doesn't count twice.
+func (d *anomalyDetector) check(job string, cfg *AnomalyConfig, res *queryResult, now time.Time) *anomalyCheck {
+	threshold := cfg.Threshold
+	if threshold <= 0 {
+		threshold = defaultAnomalyThreshold
+	}
+	alpha := cfg.Alpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = defaultAnomalyAlpha
+	}
+	minSamples := cfg.MinSamples
+	if minSamples <= 0 {
+		minSamples = defaultAnomalySamples
+	}
+	var watched, groups []int
+	for i, col := range res.Schema {
+		numeric := col.Type == "int64" || col.Type == "float64"
+		if numeric && (len(cfg.Columns) == 0 || slices.Contains(cfg.Columns, col.Name)) && !slices.Contains(cfg.GroupBy, col.Name) {
+			watched = append(watched, i)
+		}
+		if slices.Contains(cfg.GroupBy, col.Name) {
+			groups = append(groups, i)
+		}
+	}
+	timeCol := firstTimeColumn(res.Schema)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bs := d.baselines[job]
+	c := &anomalyCheck{job: job, flags: make([][]string, len(res.Rows)), updated: make(map[string]baseline)}
+	for r, row := range res.Rows {
+		var group []string
+		for _, g := range groups {
+			group = append(group, row[g])
+		}
+		for _, col := range watched {
+			v, err := strconv.ParseFloat(row[col], 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			key := res.Schema[col].Name + "\x00" + strings.Join(group, "\x00")
+			b, ok := c.updated[key]
+			if !ok {
+				if old, ok := bs[key]; ok {
+					b = *old
+				} else if len(bs)+len(c.updated) >= maxBaselines {
+					continue
+				}
+			}
+			if b.Samples >= minSamples {
+				if score := b.score(v); score > threshold {
+					c.flags[r] = append(c.flags[r], res.Schema[col].Name)
+					a := anomalyAlert{Job: job, Column: res.Schema[col].Name, Value: v, Mean: b.Mean, StdDev: math.Sqrt(b.Variance), Score: score, Time: now}
+					if timeCol >= 0 {
+						if t, ok := typedCell("time64ns", row[timeCol]).(time.Time); ok {
+							a.Time = t
+						}
+					}
+					if len(groups) > 0 {
+						a.Group = make(map[string]string, len(groups))
+						for i, g := range groups {
+							a.Group[res.Schema[g].Name] = group[i]
+						}
+					}
+					c.raised = append(c.raised, a)
+				}
+			}
+			b.add(v, alpha)
+			c.updated[key] = b
+		}
+	}
+	return c
+}
+
+// commit folds the checked values into the baselines and records the alerts raised
+func (d *anomalyDetector) commit(c *anomalyCheck) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(c.updated) > 0 {
+		bs, ok := d.baselines[c.job]
+		if !ok {
+			bs = make(map[string]*baseline)
+			d.baselines[c.job] = bs
+		}
+		for key, b := range c.updated {
+			if _, ok := bs[key]; ok || len(bs) < maxBaselines {
+				bs[key] = &b
+			}
+		}
+		d.save(c.job)
+	}
+	d.alerts = append(d.alerts, c.raised...)
+	if over := len(d.alerts) - maxAlerts; over > 0 {
+		d.alerts = slices.Delete(d.alerts, 0, over)
+	}
+}
+
+// annotate adds the anomalies column to res
+func annotate(res *queryResult, flags [][]string) {
+	res.Columns = append(res.Columns, anomalyColumn)
+	res.Schema = append(res.Schema, columnSchema{Name: anomalyColumn, Type: "string"})
+	for i, row := range res.Rows {
+		res.Rows[i] = append(row, strings.Join(flags[i], ","))
+	}
+}
+
+// reportAnomalies logs the alerts of an export run and sends them as a DataDog event
+func reportAnomalies(config *Config, job string, raised []anomalyAlert) {
+	if len(raised) == 0 {
+		return
+	}
+	cols := make([]string, 0, len(raised))
+	for _, a := range raised {
+		if !slices.Contains(cols, a.Column) {
+			cols = append(cols, a.Column)
+		}
+	}
+	first := raised[0]
+	text := fmt.Sprintf("%d anomalous values in %s, e.g. %s=%g against a baseline of %g±%g", len(raised), strings.Join(cols, ", "), first.Column, first.Value, first.Mean, first.StdDev)
+	log.Printf("Export %s: %s\n", job, text)
+	if config.Datadog.Events {
+		datadog.event(&config.Datadog, "Pixie export anomaly: "+job, text, "warning", "export", job)
+	}
+}
+
+// alertsHandler lists recent anomaly alerts, newest first
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid 'limit' parameter", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxAlerts)
+	}
+	job := r.URL.Query().Get("job")
+
+	alerts := []anomalyAlert{}
+	anomalies.mu.Lock()
+	for i := len(anomalies.alerts) - 1; i >= 0 && len(alerts) < limit; i-- {
+		if a := anomalies.alerts[i]; job == "" || a.Job == job {
+			alerts = append(alerts, a)
+		}
+	}
+	anomalies.mu.Unlock()
+	writeJSON(w, map[string]interface{}{"alerts": alerts})
+}
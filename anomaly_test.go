@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// latencyResult returns a result with one latency value per row for pod
+func latencyResult(pod string, values ...int) *queryResult {
+	res := &queryResult{
+		Columns: []string{"pod", "latency"},
+		Schema:  []columnSchema{{Name: "pod", Type: "string"}, {Name: "latency", Type: "int64"}},
+	}
+	for _, v := range values {
+		res.Rows = append(res.Rows, []string{pod, strconv.Itoa(v)})
+	}
+	return res
+}
+
+func TestAnomalyCheck(t *testing.T) {
+	cfg := &AnomalyConfig{GroupBy: []string{"pod"}, MinSamples: 3}
+	tests := []struct {
+		name      string
+		history   []*queryResult
+		res       *queryResult
+		wantFlags [][]string
+	}{
+		{
+			name:      "too few samples",
+			res:       latencyResult("a", 10, 10, 500),
+			wantFlags: [][]string{nil, nil, nil},
+		},
+		{
+			name:      "outlier after enough samples",
+			res:       latencyResult("a", 10, 10, 10, 500),
+			wantFlags: [][]string{nil, nil, nil, {"latency"}},
+		},
+		{
+			name:      "outlier against committed runs",
+			history:   []*queryResult{latencyResult("a", 10, 11, 10, 9)},
+			res:       latencyResult("a", 10, 500),
+			wantFlags: [][]string{nil, {"latency"}},
+		},
+		{
+			name:      "groups keep their own baselines",
+			history:   []*queryResult{latencyResult("a", 10, 11, 10, 9)},
+			res:       latencyResult("b", 500),
+			wantFlags: [][]string{nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &anomalyDetector{baselines: make(map[string]map[string]*baseline)}
+			for _, res := range tt.history {
+				d.commit(d.check("job", cfg, res, time.Now()))
+			}
+			c := d.check("job", cfg, tt.res, time.Now())
+			if !reflect.DeepEqual(c.flags, tt.wantFlags) {
+				t.Errorf("flags = %v, want %v", c.flags, tt.wantFlags)
+			}
+			flagged := 0
+			for _, f := range tt.wantFlags {
+				flagged += len(f)
+			}
+			if len(c.raised) != flagged {
+				t.Errorf("raised %d alerts, want %d", len(c.raised), flagged)
+			}
+		})
+	}
+}
+
+func TestAnomalyCheckWithoutCommit(t *testing.T) {
+	d := &anomalyDetector{baselines: make(map[string]map[string]*baseline)}
+	cfg := &AnomalyConfig{MinSamples: 3}
+	d.commit(d.check("job", cfg, latencyResult("a", 10, 10, 10), time.Now()))
+	before := *d.baselines["job"]["latency\x00"]
+
+	// A run whose write failed is checked again when it is retried
+	for range 2 {
+		if c := d.check("job", cfg, latencyResult("a", 500), time.Now()); len(c.raised) != 1 {
+			t.Fatalf("raised %d alerts, want 1", len(c.raised))
+		}
+	}
+	if got := *d.baselines["job"]["latency\x00"]; got != before || len(d.alerts) != 0 {
+		t.Errorf("uncommitted checks changed the baseline to %+v (was %+v) and recorded %d alerts", got, before, len(d.alerts))
+	}
+	d.commit(d.check("job", cfg, latencyResult("a", 500), time.Now()))
+	if got := d.baselines["job"]["latency\x00"]; got.Samples != before.Samples+1 || len(d.alerts) != 1 {
+		t.Errorf("committed check left %d samples and %d alerts, want %d and 1", got.Samples, len(d.alerts), before.Samples+1)
+	}
+}
+
+func TestAnomalyBaselinesPersist(t *testing.T) {
+	h, err := openHistory(HistoryConfig{Path: filepath.Join(t.TempDir(), "history.db")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.db.Close()
+
+	d := &anomalyDetector{baselines: make(map[string]map[string]*baseline)}
+	if err := d.persistTo(h); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &AnomalyConfig{GroupBy: []string{"pod"}}
+	d.commit(d.check("job", cfg, latencyResult("a", 10, 12, 11), time.Now()))
+
+	restarted := &anomalyDetector{baselines: make(map[string]map[string]*baseline)}
+	if err := restarted.persistTo(h); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restarted.baselines, d.baselines) {
+		t.Errorf("restored baselines %v, want %v", restarted.baselines["job"], d.baselines["job"])
+	}
+}
+
+func TestHistoryAmend(t *testing.T) {
+	h, err := openHistory(HistoryConfig{Path: filepath.Join(t.TempDir(), "history.db"), StoreResults: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.db.Close()
+
+	// A sharded run archives each chunk in its own entry
+	first, second := latencyResult("a", 10, 11), latencyResult("a", 500)
+	for _, p := range []*queryResult{first, second} {
+		payload, _ := encodeJSON(p)
+		p.archived = []archivedPart{{id: h.save(&historyEntry{StartedAt: time.Now()}, payload)}}
+	}
+	res, err := stitch([]*queryResult{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotate(res, [][]string{nil, nil, {"latency"}})
+	h.amend(res)
+
+	tests := []struct {
+		id   int64
+		want [][]string
+	}{
+		{1, [][]string{{"a", "10", ""}, {"a", "11", ""}}},
+		{2, [][]string{{"a", "500", "latency"}}},
+	}
+	for _, tt := range tests {
+		payload, err := h.result(tt.id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got queryResult
+		if err := json.Unmarshal(payload, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Rows, tt.want) || got.Columns[len(got.Columns)-1] != anomalyColumn {
+			t.Errorf("entry %d holds %v %v, want %v with the anomalies column", tt.id, got.Columns, got.Rows, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// APIToken grants access to the API as a tenant with a set of roles
+type APIToken struct {
+	// Tenant usage is metered against; only admin and service tokens may choose another one
+	// with X-Tenant-ID
+	Tenant string `json:"tenant"`
+	// Roles the caller holds, e.g. for scripts that require one
+	Roles []string `json:"roles,omitempty"`
+}
+
+// identity is the authenticated caller of a request
+type identity struct {
+	Tenant string
+	Roles  []string
+}
+
+// hasRole reports whether the caller holds role
+func (id *identity) hasRole(role string) bool {
+	return id != nil && slices.Contains(id.Roles, role)
+}
+
+type identityKey struct{}
+
+// identityFrom returns the caller authenticated by withAuth, or nil when API tokens are disabled
+func identityFrom(ctx context.Context) *identity {
+	id, _ := ctx.Value(identityKey{}).(*identity)
+	return id
+}
+
+// bearerToken extracts the token of an Authorization: Bearer header
+func bearerToken(r *http.Request) (string, bool) {
+	return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// withAuth requires one of the configured API tokens when there are any, and attaches the
+// caller's identity to the request context. Without api_tokens the API stays open.
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, err := requestConfig(r)
+		if err != nil {
+			log.Printf("ERROR: Failed to load config: %v\n", err)
+			writeErrorJSON(w, http.StatusInternalServerError, "Failed to load configuration")
+			return
+		}
+		if len(config.APITokens) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := bearerToken(r)
+		var id *identity
+		if ok {
+			for candidate, grant := range config.APITokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+					id = &identity{Tenant: grant.Tenant, Roles: grant.Roles}
+					if id.Tenant == "" {
+						id.Tenant = defaultTenant
+					}
+				}
+			}
+		}
+		if id == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeErrorJSON(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// requireAdmin rejects requests that don't carry the configured admin token
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, err := requestConfig(r)
+		if err != nil {
+			log.Printf("ERROR: Failed to load config: %v\n", err)
+			writeErrorJSON(w, http.StatusInternalServerError, "Failed to load configuration")
+			return
+		}
+		if config.AdminToken == "" {
+			writeErrorJSON(w, http.StatusNotFound, "Admin API is disabled")
+			return
+		}
+		token, ok := bearerToken(r)
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeErrorJSON(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	defaultBatchConcurrency = 4
+	// maxBatchSize bounds the number of scripts in one batch request
+	maxBatchSize = 100
+)
+
+// batchQuery is one script of a batch request
+type batchQuery struct {
+	Script  string        `json:"script"`
+	Params  requestParams `json:"params"`
+	Cluster string        `json:"cluster"`
+}
+
+// batchItem is the outcome of one batch query: the result on success, the HTTP status
+// and error message otherwise
+type batchItem struct {
+	Status int             `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// batchBudget bounds the encoded results embedded in one batch response. Once a result
+// doesn't fit, the budget is spent and the remaining queries aren't run.
+type batchBudget struct {
+	mu          sync.Mutex
+	used, limit int64
+	spent       bool
+}
+
+// take admits a result of n bytes, or fails it if it doesn't fit in what is left
+func (b *batchBudget) take(n int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := checkLimit(http.StatusRequestEntityTooLarge, "Batch response too large", "encoded batch results size in bytes",
+		b.used+n, b.limit); err != nil {
+		b.spent = true
+		return err
+	}
+	b.used += n
+	return nil
+}
+
+// exhausted reports whether a result has been failed for not fitting
+func (b *batchBudget) exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.spent
+}
+
+// batchHandler runs several scripts concurrently and returns their results in request order
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Queries []batchQuery `json:"queries"`
+	}
+	if err := decodeBody(r, &req, false); err != nil {
+		writeScriptError(w, err)
+		return
+	}
+	if len(req.Queries) == 0 {
+		http.Error(w, "Missing 'queries' field in request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Queries) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("At most %d queries allowed per batch", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	config, err := requestConfig(r)
+	if err != nil {
+		log.Printf("ERROR: Failed to load config: %v\n", err)
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+	if denyArbitraryScripts(w, config) {
+		return
+	}
+	opts, err := requestOptions(r, config)
+	if err != nil {
+		writeScriptError(w, err)
+		return
+	}
+	// Results are embedded in the JSON response
+	opts.Format, opts.Compression = defaultFormat, ""
+	workers := config.BatchConcurrency
+	if workers <= 0 {
+		workers = defaultBatchConcurrency
+	}
+	workers = min(workers, len(req.Queries))
+
+	budget := &batchBudget{limit: limitValue(config.Limits.MaxBatchBytes, defaultMaxBatchBytes)}
+	items := runBatch(req.Queries, workers, budget, func(q batchQuery) batchItem {
+		return runBatchQuery(r, config, q, opts)
+	})
+	writeJSON(w, map[string]interface{}{"results": items})
+}
+
+// runBatch runs the queries on workers goroutines, failing those left once the budget
+// is spent without running them
+func runBatch(queries []batchQuery, workers int, budget *batchBudget, run func(batchQuery) batchItem) []batchItem {
+	items := make([]batchItem, len(queries))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if budget.exhausted() {
+					items[i] = batchItem{Status: http.StatusRequestEntityTooLarge, Error: "Not run: the batch's response budget is used up"}
+					continue
+				}
+				item := run(queries[i])
+				if item.Status == http.StatusOK {
+					if err := budget.take(int64(len(item.Result))); err != nil {
+						item = batchError(err)
+					}
+				}
+				items[i] = item
+			}
+		}()
+	}
+	for i := range queries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return items
+}
+
+// runBatchQuery executes one batch query, turning failures into a per-item error
+func runBatchQuery(r *http.Request, config *Config, q batchQuery, opts execOptions) batchItem {
+	if q.Script == "" {
+		return batchItem{Status: http.StatusBadRequest, Error: "Missing 'script' field"}
+	}
+	opts.Params = q.Params
+	config.applyDefaults(q.Cluster, "", q.Script, nil, &opts)
+	err := cmp.Or(config.checkScript(q.Script), config.checkParams(q.Params))
+	var res *encodedResult
+	if err == nil {
+		res, err = executeCached(r, config, q.Cluster, q.Script, opts)
+	}
+	if err != nil {
+		return batchError(err)
+	}
+	return batchItem{Status: http.StatusOK, Result: res.payload}
+}
+
+// batchError turns a failure into a per-item error
+func batchError(err error) batchItem {
+	var se *scriptError
+	if errors.As(err, &se) {
+		return batchItem{Status: se.status, Error: se.Error()}
+	}
+	return batchItem{Status: http.StatusInternalServerError, Error: err.Error()}
+}
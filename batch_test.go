@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunBatchBudget(t *testing.T) {
+	tests := []struct {
+		name       string
+		sizes      []int
+		limit      int64
+		wantStatus []int
+		wantRuns   int
+	}{
+		{"within the budget", []int{10, 10, 10}, 30, []int{200, 200, 200}, 3},
+		{"unlimited", []int{10, 10, 10}, 0, []int{200, 200, 200}, 3},
+		{"remaining entries aren't run", []int{10, 15, 10, 1}, 20, []int{200, 413, 413, 413}, 2},
+		{"failed queries use no budget", []int{-1, 20}, 20, []int{500, 200}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := make([]batchQuery, len(tt.sizes))
+			for i, n := range tt.sizes {
+				queries[i] = batchQuery{Script: strings.Repeat("x", max(n, 0))}
+			}
+			var runs atomic.Int32
+			items := runBatch(queries, 1, &batchBudget{limit: tt.limit}, func(q batchQuery) batchItem {
+				runs.Add(1)
+				if q.Script == "" {
+					return batchItem{Status: http.StatusInternalServerError, Error: "failed"}
+				}
+				return batchItem{Status: http.StatusOK, Result: json.RawMessage(q.Script)}
+			})
+			for i, item := range items {
+				if item.Status != tt.wantStatus[i] {
+					t.Errorf("entry %d has status %d (%s), want %d", i, item.Status, item.Error, tt.wantStatus[i])
+				}
+				if item.Status != http.StatusOK && item.Result != nil {
+					t.Errorf("failed entry %d carries a result", i)
+				}
+			}
+			if int(runs.Load()) != tt.wantRuns {
+				t.Errorf("ran %d queries, want %d", runs.Load(), tt.wantRuns)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// requestParams are script parameters as sent by callers. Numbers and booleans are kept
+// in their textual form, so `n: 3` in YAML, n=3 in a form and "n": 3 in JSON all mean
+// the same.
+type requestParams map[string]string
+
+func (p *requestParams) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*p = nil
+		return nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return errors.New("params must be an object")
+	}
+	params := make(requestParams, len(raw))
+	for name, v := range raw {
+		var s string
+		switch {
+		case json.Unmarshal(v, &s) == nil:
+		case len(v) > 0 && (v[0] == '-' || (v[0] >= '0' && v[0] <= '9')), string(v) == "true", string(v) == "false":
+			s = string(v)
+		default:
+			return fmt.Errorf("parameter %q must be a string, number or boolean", name)
+		}
+		params[name] = s
+	}
+	*p = params
+	return nil
+}
+
+// Request body encodings, as named in error messages
+const (
+	encodingJSON = "JSON"
+	encodingYAML = "YAML"
+	encodingForm = "form"
+)
+
+// formParam matches the form fields carrying script parameters, e.g. params[namespace]
+var formParam = regexp.MustCompile(`^params\[(.+)\]$`)
+
+// decodeBody decodes a request body into v according to its Content-Type: JSON (the
+// default), YAML or, if form is set, URL-encoded form fields. Every encoding is decoded
+// through the JSON field names and types of v, so all are validated alike. An empty body
+// leaves v unchanged.
+func decodeBody(r *http.Request, v interface{}, form bool) error {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return &scriptError{http.StatusBadRequest, "Failed to read request body", err}
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var encoding string
+	switch mediaType {
+	case "", "application/json", "text/plain":
+		encoding = encodingJSON
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		encoding = encodingYAML
+	case "application/x-www-form-urlencoded":
+		// curl -d sends JSON with the form content type unless told otherwise
+		if data[0] == '{' {
+			encoding = encodingJSON
+		} else if form {
+			encoding = encodingForm
+		}
+	default:
+		if strings.HasSuffix(mediaType, "+json") {
+			encoding = encodingJSON
+		}
+	}
+	if encoding == "" {
+		supported := "application/json, application/yaml"
+		if form {
+			supported += ", application/x-www-form-urlencoded"
+		}
+		return &scriptError{http.StatusUnsupportedMediaType, "Unsupported request body",
+			fmt.Errorf("content type %q is not one of %s", mediaType, supported)}
+	}
+
+	switch encoding {
+	case encodingYAML:
+		data, err = yamlToJSON(data)
+	case encodingForm:
+		data, err = formToJSON(data)
+	}
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return &scriptError{http.StatusBadRequest, "Invalid " + encoding + " body", describeDecodeError(err)}
+	}
+	return nil
+}
+
+// yamlToJSON converts a YAML document to JSON
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, errors.New("mapping keys must be strings")
+	}
+	return out, nil
+}
+
+// formToJSON converts form fields to a JSON object, collecting params[name] fields into
+// its params object
+func formToJSON(data []byte) ([]byte, error) {
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	params := map[string]string{}
+	for key, vs := range values {
+		if len(vs) > 1 {
+			return nil, fmt.Errorf("field %q is given %d times", key, len(vs))
+		}
+		if m := formParam.FindStringSubmatch(key); m != nil {
+			params[m[1]] = vs[0]
+		} else {
+			doc[key] = vs[0]
+		}
+	}
+	if len(params) > 0 {
+		doc["params"] = params
+	}
+	return json.Marshal(doc)
+}
+
+// describeDecodeError phrases type mismatches in terms of the request's fields
+func describeDecodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field := typeErr.Field
+		if field == "" {
+			field = "body"
+		}
+		return fmt.Errorf("%s must be %s, not %s", field, jsonTypeName(typeErr.Type.Kind().String()), typeErr.Value)
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	type request struct {
+		Script string        `json:"script"`
+		Params requestParams `json:"params"`
+		Limit  int           `json:"limit"`
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		form        bool
+		want        request
+		wantStatus  int
+	}{
+		{
+			name: "JSON without a content type",
+			body: `{"script": "px.display(df)", "params": {"ns": "default"}, "limit": 5}`,
+			want: request{Script: "px.display(df)", Params: requestParams{"ns": "default"}, Limit: 5},
+		},
+		{
+			name:        "JSON suffix",
+			contentType: "application/vnd.api+json; charset=utf-8",
+			body:        `{"script": "a"}`,
+			want:        request{Script: "a"},
+		},
+		{
+			name:        "JSON params as numbers and booleans",
+			contentType: "application/json",
+			body:        `{"params": {"n": 3, "ratio": -0.5, "on": true, "ns": "x"}}`,
+			want:        request{Params: requestParams{"n": "3", "ratio": "-0.5", "on": "true", "ns": "x"}},
+		},
+		{
+			name:        "YAML",
+			contentType: "application/yaml",
+			body:        "script: a\nlimit: 2\nparams:\n  n: 3\n  on: false\n",
+			want:        request{Script: "a", Limit: 2, Params: requestParams{"n": "3", "on": "false"}},
+		},
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "script=a&params%5Bns%5D=default&params[n]=3",
+			form:        true,
+			want:        request{Script: "a", Params: requestParams{"ns": "default", "n": "3"}},
+		},
+		{
+			name:        "JSON sent with the form content type",
+			contentType: "application/x-www-form-urlencoded",
+			body:        `{"script": "a"}`,
+			want:        request{Script: "a"},
+		},
+		{
+			name:        "empty body",
+			contentType: "application/xml",
+			body:        "  \n",
+		},
+		{name: "malformed JSON", body: `{"script": `, wantStatus: http.StatusBadRequest},
+		{name: "wrong field type", body: `{"limit": "five"}`, wantStatus: http.StatusBadRequest},
+		{name: "params not an object", body: `{"params": ["a"]}`, wantStatus: http.StatusBadRequest},
+		{name: "nested param", body: `{"params": {"ns": {"a": 1}}}`, wantStatus: http.StatusBadRequest},
+		{name: "malformed YAML", contentType: "text/yaml", body: "script: [a", wantStatus: http.StatusBadRequest},
+		{name: "YAML with non-string keys", contentType: "application/yaml", body: "params:\n  {a: 1}: b\n", wantStatus: http.StatusBadRequest},
+		{
+			name:        "repeated form field",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "script=a&script=b",
+			form:        true,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "form where only JSON is accepted",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "script=a",
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+		{name: "unsupported content type", contentType: "application/xml", body: "<script/>", wantStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			var got request
+			err := decodeBody(r, &got, tt.form)
+			if tt.wantStatus != 0 {
+				var se *scriptError
+				if !errors.As(err, &se) || se.status != tt.wantStatus {
+					t.Fatalf("decodeBody() error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeBody() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
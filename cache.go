@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig controls the in-memory result cache
+type CacheConfig struct {
+	// TTL of cached results, e.g. "30s"; caching is disabled when empty
+	TTL string `json:"ttl,omitempty"`
+	// MaxEntries bounds the number of cached results (default 1000)
+	MaxEntries int `json:"max_entries,omitempty"`
+	// MaxBytes bounds the total size of cached payloads (default 256 MiB)
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+const (
+	defaultCacheEntries = 1000
+	defaultCacheBytes   = 256 << 20
+)
+
+// cachedResult is an encoded response payload along with its content hash
+type cachedResult struct {
+	payload []byte
+	etag    string
+	expires time.Time
+}
+
+// resultCache keeps encoded results keyed by cluster and script
+type resultCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedResult
+	bytes   int64
+
+	hits, misses int64
+}
+
+var results = &resultCache{entries: make(map[string]*cachedResult)}
+
+// cacheKey identifies a result by everything that determines its content
+func cacheKey(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// etagFor returns a strong ETag for a payload
+func etagFor(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// get returns a live cached result
+func (c *resultCache) get(key string) (*cachedResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		c.remove(key)
+		ok = false
+	}
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return e, ok
+}
+
+// put stores a result for ttl, evicting the entries closest to expiry when over capacity
+func (c *resultCache) put(key string, e *cachedResult, cfg CacheConfig) {
+	maxEntries, maxBytes := cfg.MaxEntries, cfg.MaxBytes
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheBytes
+	}
+	if int64(len(e.payload)) > maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+	now := time.Now()
+	for k, old := range c.entries {
+		if now.After(old.expires) {
+			c.remove(k)
+		}
+	}
+	for len(c.entries) >= maxEntries || c.bytes+int64(len(e.payload)) > maxBytes {
+		var oldest string
+		for k, old := range c.entries {
+			if oldest == "" || old.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		c.remove(oldest)
+	}
+	c.entries[key] = e
+	c.bytes += int64(len(e.payload))
+}
+
+func (c *resultCache) remove(key string) {
+	if e, ok := c.entries[key]; ok {
+		c.bytes -= int64(len(e.payload))
+		delete(c.entries, key)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header matches etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCachable writes an encoded payload with its ETag, answering 304 when the client
+// already holds the same content
+func writeCachable(w http.ResponseWriter, r *http.Request, payload []byte, etag, contentType string) {
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(payload)
+}
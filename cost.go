@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CostConfig estimates how many bytes a query will process before it runs and guards
+// against expensive ones. Estimates are calibrated on the bytes processed by previous
+// executions.
+type CostConfig struct {
+	// MaxBytes rejects queries projected to process more bytes (0 disables)
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// WarnBytes flags queries projected to process more bytes with a Warning header and a log line
+	WarnBytes int64 `json:"warn_bytes,omitempty"`
+	// MinSamples is the number of executions of a script needed before its own history is
+	// used (default 3); until then the average over all scripts is
+	MinSamples int `json:"min_samples,omitempty"`
+}
+
+const (
+	defaultCostSamples = 3
+	// defaultCostWindow is the span assumed for tables read without a start_time
+	defaultCostWindow = time.Hour
+	// costSmoothing is the weight of the newest execution in the calibrated rates
+	costSmoothing = 0.3
+)
+
+// dataFrameCall matches the table reads of a PXL script along with their arguments
+var dataFrameCall = regexp.MustCompile(`px\.DataFrame\(([^)]*)\)`)
+
+// pxlTime resolves a start_time/end_time argument: a relative offset such as '-5m' or
+// absolute nanoseconds
+func pxlTime(arg string, now time.Time) (time.Time, bool) {
+	arg = strings.Trim(arg, `'"`)
+	if ns, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return time.Unix(0, ns), true
+	}
+	if d, err := time.ParseDuration(strings.TrimPrefix(arg, "-")); err == nil && strings.HasPrefix(arg, "-") {
+		return now.Add(-d), true
+	}
+	return time.Time{}, false
+}
+
+// tableSeconds sums the time spans of all table reads of a script, the quantity the bytes
+// a query processes grow with: reading two tables for an hour costs about as much as one
+// for two hours.
+func tableSeconds(pxl string, now time.Time) float64 {
+	total := 0.0
+	for _, m := range dataFrameCall.FindAllStringSubmatch(pxl, -1) {
+		start, end := now.Add(-defaultCostWindow), now
+		if a := startTimeArg.FindStringSubmatch(m[1]); a != nil {
+			if t, ok := pxlTime(a[2], now); ok {
+				start = t
+			}
+		}
+		if a := endTimeArg.FindStringSubmatch(m[1]); a != nil {
+			if t, ok := pxlTime(a[2], now); ok {
+				end = t
+			}
+		}
+		if end.After(start) {
+			total += end.Sub(start).Seconds()
+		}
+	}
+	return total
+}
+
+// costRate is the smoothed number of bytes processed per table-second
+type costRate struct {
+	rate    float64
+	samples int
+}
+
+func (r *costRate) add(rate float64) {
+	if r.samples == 0 {
+		r.rate = rate
+	} else {
+		r.rate += costSmoothing * (rate - r.rate)
+	}
+	r.samples++
+}
+
+// costModel keeps the calibrated rates per script and over all scripts
+type costModel struct {
+	mu      sync.Mutex
+	scripts map[string]*costRate
+	all     costRate
+}
+
+var costs = &costModel{scripts: make(map[string]*costRate)}
+
+// observe calibrates the rates with the bytes an execution processed
+func (m *costModel) observe(id string, footprint float64, bytes int64) {
+	if footprint <= 0 {
+		return
+	}
+	rate := float64(bytes) / footprint
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.all.add(rate)
+	r, ok := m.scripts[id]
+	if !ok {
+		if len(m.scripts) >= maxTrackedScripts {
+			return
+		}
+		r = &costRate{}
+		m.scripts[id] = r
+	}
+	r.add(rate)
+}
+
+// costEstimate is the projected cost of an execution
+type costEstimate struct {
+	Bytes int64
+	// Basis is "script" when calibrated on the script's own executions, "global" otherwise
+	Basis string
+	// Warning is set when the estimate is above warn_bytes
+	Warning string
+}
+
+// estimate projects the bytes a script will process, or returns nil without enough history
+func (m *costModel) estimate(id string, footprint float64, minSamples int) *costEstimate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.scripts[id]; ok && r.samples >= minSamples {
+		return &costEstimate{Bytes: int64(r.rate * footprint), Basis: "script"}
+	}
+	if m.all.samples >= minSamples {
+		return &costEstimate{Bytes: int64(m.all.rate * footprint), Basis: "global"}
+	}
+	return nil
+}
+
+// check estimates the cost of a script when guardrails are configured, rejecting it above
+// max_bytes
+func (c *CostConfig) check(id string, footprint float64) (*costEstimate, error) {
+	if c.MaxBytes <= 0 && c.WarnBytes <= 0 {
+		return nil, nil
+	}
+	minSamples := c.MinSamples
+	if minSamples <= 0 {
+		minSamples = defaultCostSamples
+	}
+	est := costs.estimate(id, footprint, minSamples)
+	if est == nil {
+		return nil, nil
+	}
+	if err := checkLimit(http.StatusUnprocessableEntity, "Query projected to exceed the cost limit",
+		"estimated bytes processed", est.Bytes, c.MaxBytes); err != nil {
+		return nil, err
+	}
+	if c.WarnBytes > 0 && est.Bytes > c.WarnBytes {
+		est.Warning = fmt.Sprintf("query projected to process %s, above the warning threshold of %s", formatBytes(float64(est.Bytes)), formatBytes(float64(c.WarnBytes)))
+		log.Printf("WARNING: Script %s %s\n", id, est.Warning)
+	}
+	return est, nil
+}
+
+// setCostHeaders reports the estimate of an execution to the caller
+func setCostHeaders(w http.ResponseWriter, est *costEstimate) {
+	if est == nil {
+		return
+	}
+	w.Header().Set("X-Estimated-Bytes", strconv.FormatInt(est.Bytes, 10))
+	if est.Warning != "" {
+		w.Header().Set("Warning", `299 pixie-data-service "`+est.Warning+`"`)
+	}
+}
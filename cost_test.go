@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTableSeconds(t *testing.T) {
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		pxl  string
+		want float64
+	}{
+		{"relative start", "px.DataFrame(table='http_events', start_time='-5m')", 300},
+		{"no start_time reads the default window", "px.DataFrame(table='http_events')", defaultCostWindow.Seconds()},
+		{
+			"absolute range",
+			"px.DataFrame(table='conn_stats', start_time=" + strconv.FormatInt(now.Add(-2*time.Minute).UnixNano(), 10) +
+				", end_time=" + strconv.FormatInt(now.Add(-time.Minute).UnixNano(), 10) + ")",
+			60,
+		},
+		{"tables add up", "px.DataFrame(table='a', start_time='-1m')\npx.DataFrame(table='b', start_time='-2m')", 180},
+		{"end before start", "px.DataFrame(table='a', start_time='-1m', end_time='-5m')", 0},
+		{"no table read", "import px\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tableSeconds(tt.pxl, now); got != tt.want {
+				t.Errorf("tableSeconds() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCostEstimate(t *testing.T) {
+	m := &costModel{scripts: make(map[string]*costRate)}
+	if est := m.estimate("a", 100, 2); est != nil {
+		t.Fatalf("estimate without history = %+v, want none", est)
+	}
+	m.observe("a", 100, 1000)
+	m.observe("b", 100, 3000)
+	// Two executions overall, but only one of script a
+	if est := m.estimate("a", 10, 2); est == nil || est.Basis != "global" {
+		t.Fatalf("estimate = %+v, want a global one", est)
+	}
+	m.observe("a", 100, 1000)
+	est := m.estimate("a", 10, 2)
+	if est == nil || est.Basis != "script" || est.Bytes != 100 {
+		t.Errorf("estimate = %+v, want 100 bytes from the script's own rate", est)
+	}
+	// Recent executions weigh more than older ones
+	m.observe("a", 100, 2000)
+	if est := m.estimate("a", 100, 2); est.Bytes != 1300 {
+		t.Errorf("estimate after a costlier run = %d bytes, want 1300", est.Bytes)
+	}
+	m.observe("c", 0, 1000)
+	if _, ok := m.scripts["c"]; ok {
+		t.Error("execution without table reads calibrated a rate")
+	}
+}
+
+func TestCostCheck(t *testing.T) {
+	saved := costs
+	defer func() { costs = saved }()
+	costs = &costModel{scripts: make(map[string]*costRate)}
+	for range defaultCostSamples {
+		costs.observe("a", 100, 1000)
+	}
+
+	tests := []struct {
+		name        string
+		config      CostConfig
+		footprint   float64
+		wantStatus  int
+		wantWarning bool
+		wantHeader  string
+	}{
+		{"no guardrails", CostConfig{}, 100, 0, false, ""},
+		{"under the limit", CostConfig{MaxBytes: 2000}, 100, 0, false, "1000"},
+		{"over the limit", CostConfig{MaxBytes: 2000}, 300, http.StatusUnprocessableEntity, false, ""},
+		{"over the warning threshold", CostConfig{WarnBytes: 500}, 100, 0, true, "1000"},
+		{"not enough samples", CostConfig{MaxBytes: 1, MinSamples: 10}, 100, 0, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			est, err := tt.config.check("a", tt.footprint)
+			if tt.wantStatus != 0 {
+				var se *scriptError
+				if !errors.As(err, &se) || se.status != tt.wantStatus {
+					t.Fatalf("check() error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			setCostHeaders(w, est)
+			if got := w.Header().Get("X-Estimated-Bytes"); got != tt.wantHeader {
+				t.Errorf("X-Estimated-Bytes = %q, want %q", got, tt.wantHeader)
+			}
+			if got := w.Header().Get("Warning") != ""; got != tt.wantWarning {
+				t.Errorf("Warning header set: %v, want %v", got, tt.wantWarning)
+			}
+		})
+	}
+}
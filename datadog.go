@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DatadogConfig ships execution metrics and failure events to a DogStatsD agent
+type DatadogConfig struct {
+	// Addr of the agent's DogStatsD listener, e.g. "127.0.0.1:8125"; the exporter is off when empty
+	Addr string `json:"addr,omitempty"`
+	// Namespace prefixes metric names (default "pixie.")
+	Namespace string `json:"namespace,omitempty"`
+	// Tags are added to every metric and event, e.g. ["env:prod"]
+	Tags []string `json:"tags,omitempty"`
+	// Events sends an event when a scheduled export run fails or flags anomalies
+	Events bool `json:"events,omitempty"`
+}
+
+const defaultDatadogNamespace = "pixie."
+
+// dogStatsD sends metrics and events over UDP. Delivery is best effort: errors are dropped
+// so an unreachable agent never slows down or fails a query.
+type dogStatsD struct {
+	mu   sync.Mutex
+	addr string
+	conn net.Conn
+}
+
+var datadog = &dogStatsD{}
+
+// send writes lines as one datagram, (re)connecting when the configured address changed
+func (d *dogStatsD) send(addr string, lines []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == nil || d.addr != addr {
+		if d.conn != nil {
+			d.conn.Close()
+			d.conn = nil
+		}
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return
+		}
+		d.conn, d.addr = conn, addr
+	}
+	d.conn.Write([]byte(strings.Join(lines, "\n")))
+}
+
+// ddTag sanitizes a tag value for the DogStatsD wire format
+var ddTag = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", " ")
+
+// ddTags joins the configured tags with extra key:value pairs
+func ddTags(cfg *DatadogConfig, kv ...string) string {
+	tags := make([]string, 0, len(cfg.Tags)+len(kv)/2)
+	for _, t := range cfg.Tags {
+		tags = append(tags, ddTag.Replace(t))
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		tags = append(tags, kv[i]+":"+ddTag.Replace(kv[i+1]))
+	}
+	return strings.Join(tags, ",")
+}
+
+// observe ships the metrics of one script execution, labelled like the Prometheus metrics.
+// Failed interactive executions are only counted; the scheduler sends the failure events.
+func (d *dogStatsD) observe(cfg *DatadogConfig, opts execOptions, script string, elapsed time.Duration, res *queryResult, err error) {
+	if cfg.Addr == "" {
+		return
+	}
+	ns := cfg.Namespace
+	if ns == "" {
+		ns = defaultDatadogNamespace
+	}
+	id := opts.Name
+	if id == "" {
+		id = scriptID(script)
+	}
+	outcome := outcomeOf(err)
+	tags := ddTags(cfg, "script", id, "cluster", opts.ClusterID, "outcome", outcomeNames[outcome])
+	lines := []string{
+		fmt.Sprintf("%squery.duration:%g|ms|#%s", ns, float64(elapsed.Microseconds())/1000, tags),
+		fmt.Sprintf("%squery.count:1|c|#%s", ns, tags),
+	}
+	if res != nil {
+		lines = append(lines, fmt.Sprintf("%squery.rows:%d|h|#%s", ns, len(res.Rows), tags))
+		if res.Stats != nil {
+			lines = append(lines, fmt.Sprintf("%squery.bytes_processed:%d|h|#%s", ns, res.Stats.BytesProcessed, tags))
+		}
+	}
+	d.send(cfg.Addr, lines)
+}
+
+// event sends a DogStatsD event with the given alert type (info, warning, error or success)
+func (d *dogStatsD) event(cfg *DatadogConfig, title, text, alertType string, kv ...string) {
+	if cfg.Addr == "" {
+		return
+	}
+	text = strings.ReplaceAll(text, "\n", `\n`)
+	d.send(cfg.Addr, []string{fmt.Sprintf("_e{%d,%d}:%s|%s|t:%s|s:pixie-data-service|#%s",
+		len(title), len(text), title, text, alertType, ddTags(cfg, kv...))})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatadogObserve(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cfg := &DatadogConfig{Addr: conn.LocalAddr().String(), Tags: []string{"env:test"}, Events: true}
+	d := &dogStatsD{}
+
+	failure := &scriptError{http.StatusInternalServerError, "Streaming failed", errors.New("vizier went away")}
+	d.observe(cfg, execOptions{Name: "conns", ClusterID: "c1"}, "", 1500*time.Microsecond, nil, failure)
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	for _, want := range []string{"pixie.query.duration:1.5|ms|#env:test,script:conns,cluster:c1,outcome:", "pixie.query.count:1|c|"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics %q lack %q", got, want)
+		}
+	}
+	// An interactive failure is only counted; the scheduler sends the failure events
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := conn.ReadFrom(buf); err == nil {
+		t.Errorf("unexpected datagram %q", buf[:n])
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// startTime is when the process started, for uptime reporting
+var startTime = time.Now()
+
+// debugState summarizes runtime internals for diagnosing memory growth
+func debugState() interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	clients, viziers := pool.size()
+
+	results.mu.Lock()
+	cache := map[string]interface{}{
+		"entries": len(results.entries),
+		"bytes":   results.bytes,
+		"hits":    results.hits,
+		"misses":  results.misses,
+	}
+	results.mu.Unlock()
+
+	return map[string]interface{}{
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+		"active_queries": queries.active(),
+		"goroutines":     runtime.NumGoroutine(),
+		"pool": map[string]int{
+			"cloud_clients":  clients,
+			"vizier_clients": viziers,
+		},
+		"cache":   cache,
+		"queue":   queue.state(),
+		"history": history != nil,
+		"memory": map[string]uint64{
+			"heap_alloc_bytes":  mem.HeapAlloc,
+			"heap_inuse_bytes":  mem.HeapInuse,
+			"heap_objects":      mem.HeapObjects,
+			"stack_inuse_bytes": mem.StackInuse,
+			"sys_bytes":         mem.Sys,
+			"total_alloc_bytes": mem.TotalAlloc,
+			"next_gc_bytes":     mem.NextGC,
+			"num_gc":            uint64(mem.NumGC),
+			"pause_total_ns":    mem.PauseTotalNs,
+		},
+	}
+}
+
+func init() {
+	expvar.Publish("state", expvar.Func(debugState))
+}
+
+// debugStateHandler serves debugState as JSON
+func debugStateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, debugState())
+}
+
+// registerDebug adds pprof, expvar and /debug/state to rt behind the given middleware
+func registerDebug(rt *router, mws ...middleware) {
+	rt.handle("/debug/state", debugStateHandler, mws...)
+	rt.handle("/debug/vars", expvar.Handler().ServeHTTP, mws...)
+	rt.handle("/debug/pprof/", pprof.Index, mws...)
+	rt.handle("/debug/pprof/cmdline", pprof.Cmdline, mws...)
+	rt.handle("/debug/pprof/profile", pprof.Profile, mws...)
+	rt.handle("/debug/pprof/symbol", pprof.Symbol, mws...)
+	rt.handle("/debug/pprof/trace", pprof.Trace, mws...)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diffRequest selects two result sets to compare: either the same script run over two
+// time ranges, or two archived results from the query history
+type diffRequest struct {
+	Script  string     `json:"script"`
+	Cluster string     `json:"cluster"`
+	Before  *timeRange `json:"before"`
+	After   *timeRange `json:"after"`
+
+	BeforeID int64 `json:"before_id"`
+	AfterID  int64 `json:"after_id"`
+
+	// KeyColumns identify a row across both result sets
+	KeyColumns []string `json:"key_columns"`
+	// IgnoreColumns are left out of the comparison, e.g. timestamps
+	IgnoreColumns []string `json:"ignore_columns"`
+}
+
+// rowChange is a row present in both result sets with differing values
+type rowChange struct {
+	Key     []string `json:"key"`
+	Before  []string `json:"before"`
+	After   []string `json:"after"`
+	Changed []string `json:"changed_columns"`
+}
+
+// diffResult lists how the after result set differs from the before one
+type diffResult struct {
+	KeyColumns []string    `json:"key_columns"`
+	Columns    []string    `json:"columns"`
+	Added      [][]string  `json:"added"`
+	Removed    [][]string  `json:"removed"`
+	Changed    []rowChange `json:"changed"`
+	Summary    diffSummary `json:"summary"`
+}
+
+type diffSummary struct {
+	BeforeRows int `json:"before_rows"`
+	AfterRows  int `json:"after_rows"`
+	Added      int `json:"added"`
+	Removed    int `json:"removed"`
+	Changed    int `json:"changed"`
+	Unchanged  int `json:"unchanged"`
+}
+
+// projectRow reorders a row into the given columns; missing columns are left empty
+func projectRow(row []string, idx map[string]int, cols []string) []string {
+	out := make([]string, len(cols))
+	for i, c := range cols {
+		if j, ok := idx[c]; ok && j < len(row) {
+			out[i] = row[j]
+		}
+	}
+	return out
+}
+
+// diffResults compares two result sets keyed by keyCols. Rows sharing a key are matched in order.
+func diffResults(before, after *queryResult, keyCols, ignoreCols []string) (*diffResult, error) {
+	beforeIdx, afterIdx := map[string]int{}, map[string]int{}
+	for i, c := range before.Columns {
+		beforeIdx[c] = i
+	}
+	for i, c := range after.Columns {
+		afterIdx[c] = i
+	}
+	for _, k := range keyCols {
+		if _, ok := beforeIdx[k]; !ok {
+			return nil, fmt.Errorf("key column %q not found in the before result", k)
+		}
+		if _, ok := afterIdx[k]; !ok {
+			return nil, fmt.Errorf("key column %q not found in the after result", k)
+		}
+	}
+
+	// Output columns are the union of both sides, in the after result's order
+	ignored := map[string]bool{}
+	for _, c := range ignoreCols {
+		ignored[c] = true
+	}
+	var cols []string
+	seen := map[string]bool{}
+	for _, c := range append(append([]string{}, after.Columns...), before.Columns...) {
+		if !seen[c] && !ignored[c] {
+			seen[c] = true
+			cols = append(cols, c)
+		}
+	}
+
+	keyOf := func(row []string, idx map[string]int, occurrences map[string]int) (string, []string) {
+		key := projectRow(row, idx, keyCols)
+		k := strings.Join(key, "\x00")
+		occurrences[k]++
+		return k + "\x00" + strconv.Itoa(occurrences[k]), key
+	}
+
+	beforeRows := map[string][]string{}
+	var beforeOrder []string
+	occurrences := map[string]int{}
+	for _, row := range before.Rows {
+		k, _ := keyOf(row, beforeIdx, occurrences)
+		beforeRows[k] = projectRow(row, beforeIdx, cols)
+		beforeOrder = append(beforeOrder, k)
+	}
+
+	res := &diffResult{KeyColumns: keyCols, Columns: cols, Added: [][]string{}, Removed: [][]string{}, Changed: []rowChange{}}
+	res.Summary.BeforeRows, res.Summary.AfterRows = len(before.Rows), len(after.Rows)
+	matched := map[string]bool{}
+	occurrences = map[string]int{}
+	for _, row := range after.Rows {
+		k, key := keyOf(row, afterIdx, occurrences)
+		a := projectRow(row, afterIdx, cols)
+		b, ok := beforeRows[k]
+		if !ok {
+			res.Added = append(res.Added, a)
+			continue
+		}
+		matched[k] = true
+		var changed []string
+		for i, c := range cols {
+			if a[i] != b[i] {
+				changed = append(changed, c)
+			}
+		}
+		if len(changed) == 0 {
+			res.Summary.Unchanged++
+			continue
+		}
+		res.Changed = append(res.Changed, rowChange{Key: key, Before: b, After: a, Changed: changed})
+	}
+	for _, k := range beforeOrder {
+		if !matched[k] {
+			res.Removed = append(res.Removed, beforeRows[k])
+		}
+	}
+	res.Summary.Added, res.Summary.Removed, res.Summary.Changed = len(res.Added), len(res.Removed), len(res.Changed)
+	return res, nil
+}
+
+// archivedResult loads a result of a tenant ("" for any tenant) from the query history
+func archivedResult(id int64, tenant string) (*queryResult, error) {
+	if history == nil {
+		return nil, &scriptError{http.StatusNotFound, "Cannot load archived result", errors.New("query history is not enabled")}
+	}
+	payload, err := history.result(id, tenant)
+	if errors.Is(err, errNoResult) {
+		return nil, &scriptError{http.StatusNotFound, "Cannot load archived result", fmt.Errorf("no archived result for query %d", id)}
+	}
+	if err != nil {
+		return nil, &scriptError{http.StatusInternalServerError, "Cannot load archived result", err}
+	}
+	var res queryResult
+	if err := json.Unmarshal(payload, &res); err != nil {
+		return nil, &scriptError{http.StatusInternalServerError, "Cannot decode archived result", err}
+	}
+	return &res, nil
+}
+
+// diffHandler compares two executions of a script, or two archived results
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req diffRequest
+	if err := decodeBody(r, &req, false); err != nil {
+		writeScriptError(w, err)
+		return
+	}
+	if len(req.KeyColumns) == 0 {
+		http.Error(w, "Missing 'key_columns' field in request body", http.StatusBadRequest)
+		return
+	}
+
+	var before, after *queryResult
+	var err error
+	switch {
+	case req.BeforeID != 0 || req.AfterID != 0:
+		if req.BeforeID == 0 || req.AfterID == 0 {
+			http.Error(w, "Both 'before_id' and 'after_id' are required to compare archived results", http.StatusBadRequest)
+			return
+		}
+		if before, err = archivedResult(req.BeforeID, historyScope(r)); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		if after, err = archivedResult(req.AfterID, historyScope(r)); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+	case req.Script != "":
+		if req.Before == nil || req.After == nil {
+			http.Error(w, "Both 'before' and 'after' time ranges are required", http.StatusBadRequest)
+			return
+		}
+		// Without a start_time to rewrite both runs would query the same window
+		if !hasStartTime(req.Script) {
+			http.Error(w, "Script has no start_time argument to apply the 'before' and 'after' ranges to", http.StatusUnprocessableEntity)
+			return
+		}
+		now := time.Now()
+		beforeStart, beforeEnd, err := req.Before.resolve(now)
+		if err != nil {
+			http.Error(w, "Invalid 'before' time range: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		afterStart, afterEnd, err := req.After.resolve(now)
+		if err != nil {
+			http.Error(w, "Invalid 'after' time range: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		config, err := requestConfig(r)
+		if err != nil {
+			log.Printf("ERROR: Failed to load config: %v\n", err)
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+		if denyArbitraryScripts(w, config) {
+			return
+		}
+		timeout, err := requestTimeout(r, config)
+		if err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		clusterID, err := config.clusterID(req.Cluster)
+		if err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		if err := config.checkScript(req.Script); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		opts := execOptions{Tenant: tenantFromRequest(r), ClusterID: clusterID, Timeout: timeout}
+		if before, err = runScript(r.Context(), config, applyTimeRange(req.Script, beforeStart, beforeEnd), opts); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		if after, err = runScript(r.Context(), config, applyTimeRange(req.Script, afterStart, afterEnd), opts); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+	default:
+		http.Error(w, "Either 'script' or 'before_id'/'after_id' is required", http.StatusBadRequest)
+		return
+	}
+
+	res, err := diffResults(before, after, req.KeyColumns, req.IgnoreColumns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffResults(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after *queryResult
+		keys, ignore  []string
+		want          diffSummary
+		wantColumns   []string
+		wantChanged   [][]string
+		wantErr       string
+	}{
+		{
+			name:        "added removed changed",
+			before:      &queryResult{Columns: []string{"pod", "reqs"}, Rows: [][]string{{"a", "1"}, {"b", "2"}, {"c", "3"}}},
+			after:       &queryResult{Columns: []string{"pod", "reqs"}, Rows: [][]string{{"a", "1"}, {"b", "5"}, {"d", "4"}}},
+			keys:        []string{"pod"},
+			want:        diffSummary{BeforeRows: 3, AfterRows: 3, Added: 1, Removed: 1, Changed: 1, Unchanged: 1},
+			wantColumns: []string{"pod", "reqs"},
+			wantChanged: [][]string{{"reqs"}},
+		},
+		{
+			name:        "ignored columns don't count as changes",
+			before:      &queryResult{Columns: []string{"time_", "pod", "reqs"}, Rows: [][]string{{"1", "a", "1"}}},
+			after:       &queryResult{Columns: []string{"time_", "pod", "reqs"}, Rows: [][]string{{"2", "a", "1"}}},
+			keys:        []string{"pod"},
+			ignore:      []string{"time_"},
+			want:        diffSummary{BeforeRows: 1, AfterRows: 1, Unchanged: 1},
+			wantColumns: []string{"pod", "reqs"},
+		},
+		{
+			name:        "columns are matched by name",
+			before:      &queryResult{Columns: []string{"reqs", "pod"}, Rows: [][]string{{"1", "a"}}},
+			after:       &queryResult{Columns: []string{"pod", "reqs", "errs"}, Rows: [][]string{{"a", "1", "0"}}},
+			keys:        []string{"pod"},
+			want:        diffSummary{BeforeRows: 1, AfterRows: 1, Changed: 1},
+			wantColumns: []string{"pod", "reqs", "errs"},
+			wantChanged: [][]string{{"errs"}},
+		},
+		{
+			name:        "duplicate keys are matched in order",
+			before:      &queryResult{Columns: []string{"pod", "reqs"}, Rows: [][]string{{"a", "1"}, {"a", "2"}}},
+			after:       &queryResult{Columns: []string{"pod", "reqs"}, Rows: [][]string{{"a", "1"}, {"a", "3"}, {"a", "4"}}},
+			keys:        []string{"pod"},
+			want:        diffSummary{BeforeRows: 2, AfterRows: 3, Added: 1, Changed: 1, Unchanged: 1},
+			wantColumns: []string{"pod", "reqs"},
+			wantChanged: [][]string{{"reqs"}},
+		},
+		{
+			name:        "composite keys",
+			before:      &queryResult{Columns: []string{"ns", "pod", "reqs"}, Rows: [][]string{{"x", "a", "1"}, {"y", "a", "1"}}},
+			after:       &queryResult{Columns: []string{"ns", "pod", "reqs"}, Rows: [][]string{{"x", "a", "1"}}},
+			keys:        []string{"ns", "pod"},
+			want:        diffSummary{BeforeRows: 2, AfterRows: 1, Removed: 1, Unchanged: 1},
+			wantColumns: []string{"ns", "pod", "reqs"},
+		},
+		{
+			name:    "missing key column",
+			before:  &queryResult{Columns: []string{"pod"}},
+			after:   &queryResult{Columns: []string{"name"}},
+			keys:    []string{"pod"},
+			wantErr: "not found in the after result",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := diffResults(tt.before, tt.after, tt.keys, tt.ignore)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Summary != tt.want {
+				t.Errorf("summary = %+v, want %+v", res.Summary, tt.want)
+			}
+			if !reflect.DeepEqual(res.Columns, tt.wantColumns) {
+				t.Errorf("columns = %v, want %v", res.Columns, tt.wantColumns)
+			}
+			var changed [][]string
+			for _, c := range res.Changed {
+				changed = append(changed, c.Changed)
+			}
+			if !reflect.DeepEqual(changed, tt.wantChanged) {
+				t.Errorf("changed columns = %v, want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestDiffHandlerRequiresStartTime(t *testing.T) {
+	body := `{"script": "import px\ndf = px.DataFrame(table='http_events')\npx.display(df)",
+		"before": {"start": "-2h", "end": "-1h"}, "after": {"start": "-1h"}, "key_columns": ["pod"]}`
+	w := httptest.NewRecorder()
+	diffHandler(w, httptest.NewRequest(http.MethodPost, "/pixie/diff", strings.NewReader(body)))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want 422: %s", w.Code, w.Body)
+	}
+}
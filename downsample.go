@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// time64Layout is how formatDatum renders TIME64NS cells
+const time64Layout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// downsampleSpec reduces a time series to one row per step, per group
+type downsampleSpec struct {
+	Step time.Duration
+	// Agg is avg, min, max, sum, count, last or a percentile such as p99
+	Agg string
+	// TimeColumn defaults to the first time64ns column
+	TimeColumn string
+	// ValueColumns default to all numeric columns
+	ValueColumns []string
+	// By lists columns that split the result into separate series, e.g. pod
+	By []string
+
+	quantile float64
+}
+
+// key identifies the spec in cache keys
+func (s *downsampleSpec) key() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v|%s|%s|%s|%s", s.Step, s.Agg, s.TimeColumn, strings.Join(s.ValueColumns, ","), strings.Join(s.By, ","))
+}
+
+// requestDownsample reads ?step=, ?agg=, ?time_column=, ?value= and ?by=. It returns nil
+// when no step is given.
+func requestDownsample(r *http.Request) (*downsampleSpec, error) {
+	q := r.URL.Query()
+	if q.Get("step") == "" {
+		if q.Get("agg") != "" {
+			return nil, &scriptError{http.StatusBadRequest, "Invalid downsampling", fmt.Errorf("agg requires step")}
+		}
+		return nil, nil
+	}
+	step, err := time.ParseDuration(q.Get("step"))
+	if err != nil || step <= 0 {
+		return nil, &scriptError{http.StatusBadRequest, "Invalid downsampling", fmt.Errorf("invalid step %q", q.Get("step"))}
+	}
+	spec := &downsampleSpec{Step: step, Agg: q.Get("agg"), TimeColumn: q.Get("time_column"), ValueColumns: splitList(q.Get("value")), By: splitList(q.Get("by"))}
+	switch spec.Agg {
+	case "":
+		spec.Agg = "avg"
+	case "avg", "min", "max", "sum", "count", "last":
+	default:
+		p, err := strconv.ParseFloat(strings.TrimPrefix(spec.Agg, "p"), 64)
+		if !strings.HasPrefix(spec.Agg, "p") || err != nil || p <= 0 || p > 100 {
+			return nil, &scriptError{http.StatusBadRequest, "Invalid downsampling", fmt.Errorf("unknown agg %q: expected avg, min, max, sum, count, last or a percentile like p99", spec.Agg)}
+		}
+		spec.quantile = p / 100
+	}
+	return spec, nil
+}
+
+// splitList parses a comma-separated list
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// typedValue parses a cell back into the Go value of its column type: time.Time for
+// time64ns, float64 for int64 and float64 columns, the string otherwise
+func typedValue(col columnSchema, cell string) (interface{}, bool) {
+	switch col.Type {
+	case "time64ns":
+		t, err := time.Parse(time64Layout, cell)
+		return t, err == nil
+	case "int64", "float64":
+		v, err := strconv.ParseFloat(cell, 64)
+		return v, err == nil
+	}
+	return cell, true
+}
+
+// downsample aggregates the rows of a result into step-sized time buckets. The result
+// holds the bucket start, the group columns and the aggregated value columns, ordered
+// by group and time.
+func downsample(res *queryResult, spec *downsampleSpec) (*queryResult, error) {
+	index := make(map[string]int, len(res.Schema))
+	for i, col := range res.Schema {
+		index[col.Name] = i
+	}
+	timeCol := -1
+	if spec.TimeColumn != "" {
+		i, ok := index[spec.TimeColumn]
+		if !ok || res.Schema[i].Type != "time64ns" {
+			return nil, fmt.Errorf("time column %q is not a time64ns column of the result", spec.TimeColumn)
+		}
+		timeCol = i
+	} else {
+		for i, col := range res.Schema {
+			if col.Type == "time64ns" {
+				timeCol = i
+				break
+			}
+		}
+		if timeCol < 0 {
+			return nil, fmt.Errorf("result has no time64ns column to downsample on")
+		}
+	}
+	var byCols, valueCols []int
+	for _, name := range spec.By {
+		i, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("group column %q not in result", name)
+		}
+		byCols = append(byCols, i)
+	}
+	if len(spec.ValueColumns) == 0 {
+		for i, col := range res.Schema {
+			if (col.Type == "int64" || col.Type == "float64") && !containsInt(byCols, i) {
+				valueCols = append(valueCols, i)
+			}
+		}
+	}
+	for _, name := range spec.ValueColumns {
+		i, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("value column %q not in result", name)
+		}
+		if t := res.Schema[i].Type; t != "int64" && t != "float64" {
+			return nil, fmt.Errorf("value column %q is %s, not numeric", name, t)
+		}
+		valueCols = append(valueCols, i)
+	}
+
+	// Collect the values of each group and bucket
+	type bucket struct {
+		group  []string
+		start  time.Time
+		values [][]float64
+	}
+	width := slices.Max(append(append([]int{timeCol}, byCols...), valueCols...)) + 1
+	buckets := make(map[string]*bucket)
+	for _, row := range res.Rows {
+		// Rows of another shape than the schema can't be placed in a bucket
+		if len(row) < width {
+			continue
+		}
+		v, ok := typedValue(res.Schema[timeCol], row[timeCol])
+		if !ok {
+			continue
+		}
+		start := v.(time.Time).Truncate(spec.Step)
+		group := make([]string, len(byCols))
+		for i, c := range byCols {
+			group[i] = row[c]
+		}
+		key := strings.Join(group, "\x00") + "\x00" + strconv.FormatInt(start.UnixNano(), 10)
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{group: group, start: start, values: make([][]float64, len(valueCols))}
+			buckets[key] = b
+		}
+		for i, c := range valueCols {
+			if v, ok := typedValue(res.Schema[c], row[c]); ok {
+				b.values[i] = append(b.values[i], v.(float64))
+			}
+		}
+	}
+	ordered := make([]*bucket, 0, len(buckets))
+	for _, b := range buckets {
+		ordered = append(ordered, b)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if ga, gb := strings.Join(a.group, "\x00"), strings.Join(b.group, "\x00"); ga != gb {
+			return ga < gb
+		}
+		return a.start.Before(b.start)
+	})
+
+	out := &queryResult{Stats: res.Stats, table: res.table, script: res.script, cluster: res.cluster}
+	for _, c := range append(append([]int{timeCol}, byCols...), valueCols...) {
+		col := res.Schema[c]
+		if containsInt(valueCols, c) {
+			col.Type = "float64"
+			if spec.Agg == "count" {
+				col.Type, col.SemanticType, col.semantic = "int64", "", 0
+			}
+		}
+		out.Columns = append(out.Columns, col.Name)
+		out.Schema = append(out.Schema, col)
+	}
+	for _, b := range ordered {
+		row := make([]string, 0, len(out.Columns))
+		row = append(row, b.start.String())
+		row = append(row, b.group...)
+		for _, values := range b.values {
+			row = append(row, aggregate(spec, values))
+		}
+		out.Rows = append(out.Rows, row)
+	}
+	return out, nil
+}
+
+// aggregate reduces the values of one bucket
+func aggregate(spec *downsampleSpec, values []float64) string {
+	if spec.Agg == "count" {
+		return strconv.Itoa(len(values))
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	var v float64
+	switch spec.Agg {
+	case "avg", "sum":
+		for _, x := range values {
+			v += x
+		}
+		if spec.Agg == "avg" {
+			v /= float64(len(values))
+		}
+	case "min":
+		v = math.Inf(1)
+		for _, x := range values {
+			v = math.Min(v, x)
+		}
+	case "max":
+		v = math.Inf(-1)
+		for _, x := range values {
+			v = math.Max(v, x)
+		}
+	case "last":
+		v = values[len(values)-1]
+	default:
+		// Nearest-rank percentile
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		rank := int(math.Ceil(spec.quantile*float64(len(sorted)))) - 1
+		v = sorted[max(rank, 0)]
+	}
+	return strconv.FormatFloat(v, 'f', 6, 64)
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
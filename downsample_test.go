@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	at := func(sec int) string {
+		return time.Date(2026, 3, 1, 10, 0, sec, 0, time.UTC).Format(time64Layout)
+	}
+	bucket := func(sec int) string {
+		return time.Date(2026, 3, 1, 10, 0, sec, 0, time.UTC).String()
+	}
+	res := &queryResult{
+		Columns: []string{"time_", "pod", "latency"},
+		Schema:  []columnSchema{{Name: "time_", Type: "time64ns"}, {Name: "pod", Type: "string"}, {Name: "latency", Type: "int64"}},
+		Rows: [][]string{
+			{at(1), "a", "10"},
+			{at(5), "a", "30"},
+			{at(12), "a", "5"},
+			{at(3), "b", "7"},
+			// Rows without a parseable time or of another shape are skipped
+			{"n/a", "a", "1000"},
+			{at(2)},
+		},
+	}
+	tests := []struct {
+		name     string
+		spec     downsampleSpec
+		wantCols []string
+		want     [][]string
+	}{
+		{
+			name:     "average per bucket",
+			spec:     downsampleSpec{Step: 10 * time.Second, Agg: "avg"},
+			wantCols: []string{"time_", "latency"},
+			want:     [][]string{{bucket(0), "15.666667"}, {bucket(10), "5.000000"}},
+		},
+		{
+			name:     "series per group",
+			spec:     downsampleSpec{Step: 10 * time.Second, Agg: "max", By: []string{"pod"}},
+			wantCols: []string{"time_", "pod", "latency"},
+			want:     [][]string{{bucket(0), "a", "30.000000"}, {bucket(10), "a", "5.000000"}, {bucket(0), "b", "7.000000"}},
+		},
+		{
+			name:     "count",
+			spec:     downsampleSpec{Step: time.Minute, Agg: "count"},
+			wantCols: []string{"time_", "latency"},
+			want:     [][]string{{bucket(0), "4"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := downsample(res, &tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Columns, tt.wantCols) || !reflect.DeepEqual(got.Rows, tt.want) {
+				t.Errorf("downsample() = %v %v, want %v %v", got.Columns, got.Rows, tt.wantCols, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"px.dev/pxapi/types"
+)
+
+// cellSlabSize is the number of cells handed out per pooled slab
+const cellSlabSize = 4096
+
+// cellSlabPool recycles the backing arrays rows are sliced from, so a query allocates one
+// slab per few thousand cells instead of one growing slice per row
+var cellSlabPool = sync.Pool{
+	New: func() interface{} {
+		s := make([]string, cellSlabSize)
+		return &s
+	},
+}
+
+// cellAllocator slices fixed-size rows out of pooled slabs
+type cellAllocator struct {
+	free  []string
+	slabs []*[]string
+}
+
+// row returns an n-cell row backed by a pooled slab
+func (a *cellAllocator) row(n int) []string {
+	if n > cellSlabSize {
+		return make([]string, n)
+	}
+	if len(a.free) < n {
+		s := cellSlabPool.Get().(*[]string)
+		a.slabs = append(a.slabs, s)
+		a.free = *s
+	}
+	row := a.free[:n:n]
+	a.free = a.free[n:]
+	return row
+}
+
+// release returns all slabs to the pool. Rows handed out must no longer be used.
+func (a *cellAllocator) release() {
+	for _, s := range a.slabs {
+		clear(*s)
+		cellSlabPool.Put(s)
+	}
+	a.slabs, a.free = nil, nil
+}
+
+// adopt takes over the slabs of b, so rows handed out by b are released with a
+func (a *cellAllocator) adopt(b *cellAllocator) {
+	a.slabs = append(a.slabs, b.slabs...)
+	b.slabs, b.free = nil, nil
+}
+
+// formatDatum renders a value like Datum.String, without the fmt round trip for common types
+func formatDatum(d types.Datum) string {
+	switch v := d.(type) {
+	case *types.StringValue:
+		return v.Value()
+	case *types.Int64Value:
+		return strconv.FormatInt(v.Value(), 10)
+	case *types.Float64Value:
+		return strconv.FormatFloat(v.Value(), 'f', 6, 64)
+	case *types.BooleanValue:
+		return strconv.FormatBool(v.Value())
+	case *types.Time64NSValue:
+		return v.Value().String()
+	}
+	return d.String()
+}
+
+// maxPooledBuffer keeps unusually large response buffers from being retained by the pool
+const maxPooledBuffer = 4 << 20
+
+// pooledEncoder is a JSON encoder bound to a reusable buffer
+type pooledEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		e := &pooledEncoder{}
+		e.enc = json.NewEncoder(&e.buf)
+		return e
+	},
+}
+
+func getEncoder() *pooledEncoder {
+	return encoderPool.Get().(*pooledEncoder)
+}
+
+func (e *pooledEncoder) put() {
+	if e.buf.Cap() > maxPooledBuffer {
+		return
+	}
+	e.buf.Reset()
+	encoderPool.Put(e)
+}
+
+// encodeJSON marshals v using a pooled encoder
+func encodeJSON(v interface{}) ([]byte, error) {
+	e := getEncoder()
+	defer e.put()
+	if err := e.enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(e.buf.Bytes()), nil
+}
+
+// writeJSON writes v as a JSON response using a pooled encoder
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	e := getEncoder()
+	defer e.put()
+	if err := e.enc.Encode(v); err != nil {
+		http.Error(w, "Failed to encode response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(e.buf.Len()))
+	w.Write(e.buf.Bytes())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"px.dev/pxapi"
+	"px.dev/pxapi/proto/vizierpb"
+	"px.dev/pxapi/types"
+)
+
+// benchRowsPerQuery approximates a mid-sized query result
+const benchRowsPerQuery = 1000
+
+// benchSchema is the schema of a typical http_events table
+var benchSchema = []types.ColSchema{
+	{Name: "time_", Type: vizierpb.TIME64NS},
+	{Name: "req_path", Type: vizierpb.STRING},
+	{Name: "latency", Type: vizierpb.INT64},
+	{Name: "cpu", Type: vizierpb.FLOAT64},
+	{Name: "ok", Type: vizierpb.BOOLEAN},
+}
+
+// benchTable announces a table of benchSchema to tp and returns its record handler
+func benchTable(tp *tablePrinter) pxapi.TableRecordHandler {
+	h, _ := tp.AcceptTable(context.Background(), types.TableMetadata{Name: "http_events", ColInfo: benchSchema})
+	return h
+}
+
+// benchRecord builds a record shaped like a typical http_events row
+func benchRecord() *types.Record {
+	schema := benchSchema
+	t := types.NewTime64NSValue(&schema[0])
+	t.ScanInt64(time.Now().UnixNano())
+	path := types.NewStringValue(&schema[1])
+	path.ScanString("/api/v1/users")
+	latency := types.NewInt64Value(&schema[2])
+	latency.ScanInt64(1234567)
+	cpu := types.NewFloat64Value(&schema[3])
+	cpu.ScanFloat64(0.42)
+	ok := types.NewBooleanValue(&schema[4])
+	ok.ScanBool(true)
+	return &types.Record{Data: []types.Datum{t, path, latency, cpu, ok}}
+}
+
+// BenchmarkHandleRecordNaive is the former per-row append/String implementation, for comparison
+func BenchmarkHandleRecordNaive(b *testing.B) {
+	rec := benchRecord()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var rows [][]string
+		for n := 0; n < benchRowsPerQuery; n++ {
+			var row []string
+			for _, d := range rec.Data {
+				row = append(row, d.String())
+			}
+			rows = append(rows, row)
+		}
+	}
+}
+
+func BenchmarkHandleRecord(b *testing.B) {
+	rec := benchRecord()
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tp := &tablePrinter{}
+		h := benchTable(tp)
+		for n := 0; n < benchRowsPerQuery; n++ {
+			h.HandleRecord(ctx, rec)
+		}
+		tp.cells.release()
+	}
+}
+
+func benchResult() *queryResult {
+	rec := benchRecord()
+	tp := &tablePrinter{}
+	h := benchTable(tp)
+	for n := 0; n < benchRowsPerQuery; n++ {
+		h.HandleRecord(context.Background(), rec)
+	}
+	return tp.result()
+}
+
+// BenchmarkEncodeNewEncoder is the former per-request json.NewEncoder, for comparison
+func BenchmarkEncodeNewEncoder(b *testing.B) {
+	res := benchResult()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		w.Body = nil
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func BenchmarkWriteJSON(b *testing.B) {
+	res := benchResult()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		w.Body = nil
+		writeJSON(w, res)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EncryptionConfig encrypts what the service persists, such as the query history, with
+// AES-256-GCM
+type EncryptionConfig struct {
+	// Key is a base64-encoded 32-byte key; encryption at rest is disabled when neither it
+	// nor KeyFile is set
+	Key string `json:"key,omitempty"`
+	// KeyFile reads the key from a file instead, e.g. a secret mounted from a KMS
+	KeyFile string `json:"key_file,omitempty"`
+	// PreviousKeys still decrypt data written before the key was rotated
+	PreviousKeys []string `json:"previous_keys,omitempty"`
+}
+
+// sealedMagic prefixes encrypted values, followed by the key ID, the nonce and the ciphertext
+var sealedMagic = []byte("pxe1")
+
+// sealedText prefixes encrypted values stored in text columns, followed by their base64 encoding
+const sealedText = "pxe1:"
+
+const keyIDSize = 4
+
+// sealer encrypts values with the current key and decrypts them with any configured key.
+// A nil sealer stores values in the clear.
+type sealer struct {
+	id   [keyIDSize]byte
+	keys map[[keyIDSize]byte]cipher.AEAD
+}
+
+// newSealer loads the configured keys, returning nil when encryption is disabled
+func newSealer(cfg EncryptionConfig) (*sealer, error) {
+	key := cfg.Key
+	if cfg.KeyFile != "" {
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read encryption key: %w", err)
+		}
+		key = strings.TrimSpace(string(data))
+	}
+	if key == "" {
+		return nil, nil
+	}
+	s := &sealer{keys: make(map[[keyIDSize]byte]cipher.AEAD)}
+	for i, k := range append([]string{key}, cfg.PreviousKeys...) {
+		id, aead, err := parseKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %w", i, err)
+		}
+		if i == 0 {
+			s.id = id
+		}
+		s.keys[id] = aead
+	}
+	return s, nil
+}
+
+// parseKey decodes a base64 AES-256 key; its ID is a prefix of its hash
+func parseKey(k string) ([keyIDSize]byte, cipher.AEAD, error) {
+	var id [keyIDSize]byte
+	raw, err := base64.StdEncoding.DecodeString(k)
+	if err != nil {
+		return id, nil, err
+	}
+	if len(raw) != 32 {
+		return id, nil, fmt.Errorf("expected 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return id, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return id, nil, err
+	}
+	sum := sha256.Sum256(raw)
+	copy(id[:], sum[:])
+	return id, aead, nil
+}
+
+// seal encrypts data. aad names what the value is, so values can't be swapped between fields.
+func (s *sealer) seal(data []byte, aad string) []byte {
+	if s == nil || data == nil {
+		return data
+	}
+	aead := s.keys[s.id]
+	out := make([]byte, 0, len(sealedMagic)+keyIDSize+aead.NonceSize()+len(data)+aead.Overhead())
+	out = append(append(out, sealedMagic...), s.id[:]...)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, []byte(aad))
+}
+
+// open decrypts a value written by seal. Values without the prefix were written before
+// encryption was enabled and are returned as they are.
+func (s *sealer) open(data []byte, aad string) ([]byte, error) {
+	if !bytes.HasPrefix(data, sealedMagic) {
+		return data, nil
+	}
+	if s == nil {
+		return nil, errors.New("value is encrypted but no encryption key is configured")
+	}
+	data = data[len(sealedMagic):]
+	if len(data) < keyIDSize {
+		return nil, errors.New("truncated encrypted value")
+	}
+	aead, ok := s.keys[[keyIDSize]byte(data[:keyIDSize])]
+	if !ok {
+		return nil, errors.New("value is encrypted with an unknown key")
+	}
+	data = data[keyIDSize:]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("truncated encrypted value")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(aad))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt value: %w", err)
+	}
+	return plain, nil
+}
+
+// sealString encrypts a value stored in a text column
+func (s *sealer) sealString(v, aad string) string {
+	if s == nil {
+		return v
+	}
+	return sealedText + base64.StdEncoding.EncodeToString(s.seal([]byte(v), aad))
+}
+
+// openString decrypts a value written by sealString
+func (s *sealer) openString(v, aad string) (string, error) {
+	enc, ok := strings.CutPrefix(v, sealedText)
+	if !ok {
+		return v, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	if !bytes.HasPrefix(data, sealedMagic) {
+		return "", errors.New("malformed encrypted value")
+	}
+	plain, err := s.open(data, aad)
+	return string(plain), err
+}
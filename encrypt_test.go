@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+// testKey returns a base64 AES-256 key filled with b
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func mustSealer(t *testing.T, cfg EncryptionConfig) *sealer {
+	t.Helper()
+	s, err := newSealer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNewSealer(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     EncryptionConfig
+		wantNil bool
+		wantErr bool
+	}{
+		{"disabled", EncryptionConfig{}, true, false},
+		{"key", EncryptionConfig{Key: testKey(1)}, false, false},
+		{"previous keys", EncryptionConfig{Key: testKey(1), PreviousKeys: []string{testKey(2)}}, false, false},
+		{"not base64", EncryptionConfig{Key: "not base64!"}, false, true},
+		{"short key", EncryptionConfig{Key: base64.StdEncoding.EncodeToString(make([]byte, 16))}, false, true},
+		{"bad previous key", EncryptionConfig{Key: testKey(1), PreviousKeys: []string{"x"}}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSealer(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSealer() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && (s == nil) != tt.wantNil {
+				t.Errorf("newSealer() = %v, want nil: %v", s, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestSealerOpen(t *testing.T) {
+	old := mustSealer(t, EncryptionConfig{Key: testKey(1)})
+	rotated := mustSealer(t, EncryptionConfig{Key: testKey(2), PreviousKeys: []string{testKey(1)}})
+	other := mustSealer(t, EncryptionConfig{Key: testKey(3)})
+	plain := []byte("px.display(df)")
+
+	tampered := old.seal(plain, "script")
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		opener  *sealer
+		data    []byte
+		aad     string
+		wantErr bool
+	}{
+		{"round trip", old, old.seal(plain, "script"), "script", false},
+		{"previous key after rotation", rotated, old.seal(plain, "script"), "script", false},
+		{"current key after rotation", rotated, rotated.seal(plain, "script"), "script", false},
+		{"clear values written before encryption", old, plain, "script", false},
+		{"clear values without a key", nil, plain, "script", false},
+		{"rotated out key", old, rotated.seal(plain, "script"), "script", true},
+		{"unknown key", other, old.seal(plain, "script"), "script", true},
+		{"swapped field", old, old.seal(plain, "script"), "result", true},
+		{"tampered", old, tampered, "script", true},
+		{"truncated", old, old.seal(plain, "script")[:10], "script", true},
+		{"encrypted without a key", nil, old.seal(plain, "script"), "script", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.opener.open(tt.data, tt.aad)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("open() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, plain) {
+				t.Errorf("open() = %q, want %q", got, plain)
+			}
+		})
+	}
+}
+
+func TestSealerSeal(t *testing.T) {
+	s := mustSealer(t, EncryptionConfig{Key: testKey(1)})
+	a, b := s.seal([]byte("secret"), "script"), s.seal([]byte("secret"), "script")
+	if bytes.Equal(a, b) {
+		t.Error("sealing twice produced the same ciphertext")
+	}
+	if bytes.Contains(a, []byte("secret")) || !bytes.HasPrefix(a, sealedMagic) {
+		t.Errorf("sealed value %q isn't encrypted", a)
+	}
+	if got := (*sealer)(nil).seal([]byte("secret"), "script"); string(got) != "secret" {
+		t.Errorf("nil sealer changed the value to %q", got)
+	}
+	if s.seal(nil, "result") != nil {
+		t.Error("sealing nil produced a value")
+	}
+}
+
+func TestSealerStrings(t *testing.T) {
+	old := mustSealer(t, EncryptionConfig{Key: testKey(1)})
+	rotated := mustSealer(t, EncryptionConfig{Key: testKey(2), PreviousKeys: []string{testKey(1)}})
+	tests := []struct {
+		name    string
+		opener  *sealer
+		value   string
+		aad     string
+		want    string
+		wantErr bool
+	}{
+		{"round trip", old, old.sealString("team-a", "caller"), "caller", "team-a", false},
+		{"previous key", rotated, old.sealString("team-a", "caller"), "caller", "team-a", false},
+		{"clear text", rotated, "team-a", "caller", "team-a", false},
+		{"clear text without a key", nil, "team-a", "caller", "team-a", false},
+		{"malformed base64", old, sealedText + "!!", "caller", "", true},
+		{"prefix without a sealed value", old, sealedText + base64.StdEncoding.EncodeToString([]byte("team-a")), "caller", "", true},
+		{"wrong field", old, old.sealString("team-a", "caller"), "script", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.opener.openString(tt.value, tt.aad)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("openString() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("openString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ExportJob runs a library script on a schedule and ships its rows to a destination
+type ExportJob struct {
+	// Script names the library script to run
+	Script  string            `json:"script"`
+	Params  map[string]string `json:"params,omitempty"`
+	Cluster string            `json:"cluster,omitempty"`
+	// Interval between runs, e.g. "5m". Each run queries the window since the end of the
+	// last successful one, so consecutive runs don't overlap.
+	Interval string `json:"interval"`
+	// Tenant the runs are metered against (default "scheduler")
+	Tenant string `json:"tenant,omitempty"`
+	// Priority class of the runs when executions are queued: "scheduled" or "export" (default)
+	Priority string `json:"priority,omitempty"`
+	// Shard splits each run's window into chunks of this length, e.g. "15m", so long windows
+	// don't hit Vizier-side timeouts
+	Shard string `json:"shard,omitempty"`
+	// ShardParallelism is the number of chunks executed at once (default 1)
+	ShardParallelism int `json:"shard_parallelism,omitempty"`
+	// Anomalies flags values of numeric columns that deviate from their rolling baselines
+	Anomalies *AnomalyConfig `json:"anomalies,omitempty"`
+	// BigQuery streams the rows into a BigQuery table
+	BigQuery *BigQueryDestination `json:"bigquery,omitempty"`
+	// S3 and GCS write the rows of each run as one object, Parquet by default
+	S3  *S3Destination  `json:"s3,omitempty"`
+	GCS *GCSDestination `json:"gcs,omitempty"`
+}
+
+const (
+	defaultExportTenant = "scheduler"
+	// exportTick is how often the scheduler re-reads the config and starts due jobs
+	exportTick = time.Second
+	// maxExportCatchUp bounds the window of a run after failed ones, in intervals
+	maxExportCatchUp = 10
+)
+
+// exportRun identifies the window one run of an export job covers
+type exportRun struct {
+	Job        string
+	Start, End time.Time
+	// catchUp is set when the window was cut short of the time the run started
+	catchUp bool
+}
+
+// exportSink is a destination for the results of export jobs
+type exportSink interface {
+	write(ctx context.Context, run exportRun, res *queryResult) error
+}
+
+// sink returns the destination of the job
+func (j *ExportJob) sink(config *Config) (exportSink, error) {
+	switch {
+	case j.BigQuery != nil:
+		return bigQuerySink{j.BigQuery}, nil
+	case j.S3 != nil:
+		return newObjectSink(config, &j.S3.ObjectDestination, s3Store{dest: j.S3})
+	case j.GCS != nil:
+		return newObjectSink(config, &j.GCS.ObjectDestination, gcsStore{dest: j.GCS})
+	}
+	return nil, errors.New("export job has no destination")
+}
+
+// destination describes where the job ships its rows
+func (j *ExportJob) destination() string {
+	switch {
+	case j.BigQuery != nil:
+		return "bigquery:" + j.BigQuery.Project + "." + j.BigQuery.Dataset + "." + j.BigQuery.Table
+	case j.S3 != nil:
+		return "s3://" + j.S3.Bucket + "/" + j.S3.Prefix
+	case j.GCS != nil:
+		return "gs://" + j.GCS.Bucket + "/" + j.GCS.Prefix
+	}
+	return "none"
+}
+
+// exportState tracks the runs of one export job
+type exportState struct {
+	Running     bool       `json:"running"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// WindowEnd is the end of the last exported window, where the next run starts
+	WindowEnd *time.Time `json:"window_end,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	LastRows  int        `json:"last_rows"`
+	// LastAnomalies is the number of values the last successful run flagged
+	LastAnomalies int `json:"last_anomalies"`
+	// CatchingUp is set while the job works through a backlog of windows in runs no longer
+	// than its script's max_range, started one after the other without waiting an interval
+	CatchingUp bool   `json:"catching_up"`
+	Runs       uint64 `json:"runs"`
+	Failures   uint64 `json:"failures"`
+}
+
+// next returns the next run of a job if it is due. The window starts where the last
+// successful run ended, at most maxExportCatchUp intervals back. A window longer than an
+// interval, after failed runs, is cut to the script's maxRange (0 for none) so the backlog
+// is exported in runs the script accepts.
+func (st *exportState) next(job string, now time.Time, interval time.Duration, maxRange func() time.Duration) (exportRun, bool) {
+	if st.Running || (!st.CatchingUp && st.LastRun != nil && now.Sub(*st.LastRun) < interval) {
+		return exportRun{}, false
+	}
+	run := exportRun{Job: job, Start: now.Add(-interval), End: now}
+	if st.WindowEnd != nil {
+		run.Start = *st.WindowEnd
+		if earliest := now.Add(-maxExportCatchUp * interval); run.Start.Before(earliest) {
+			run.Start = earliest
+		}
+	}
+	if run.End.Sub(run.Start) > interval {
+		if limit := maxRange(); limit > 0 && run.End.Sub(run.Start) > limit {
+			run.End, run.catchUp = run.Start.Add(limit), true
+		}
+	}
+	return run, true
+}
+
+// record updates the state with the outcome of a run
+func (st *exportState) record(run exportRun, rows, anomalies int, err error) {
+	st.Running = false
+	st.Runs++
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+		// A failed run waits an interval before it is retried
+		st.CatchingUp = false
+		return
+	}
+	end := run.End
+	st.LastSuccess, st.WindowEnd, st.LastError, st.LastRows = &end, &end, "", rows
+	st.LastAnomalies = anomalies
+	st.CatchingUp = run.catchUp
+}
+
+// maxRange returns the max_range of the job's script manifest, or 0 if it has none
+func (j *ExportJob) maxRange(config *Config) time.Duration {
+	s, err := loadScript(config.scriptDir(), j.Script)
+	if err != nil || s.Manifest == nil {
+		// exportOnce reports the error
+		return 0
+	}
+	d, _ := configDuration("max_range", s.Manifest.MaxRange, 0)
+	return d
+}
+
+// exportScheduler starts export jobs when they are due and keeps their state
+type exportScheduler struct {
+	mu   sync.Mutex
+	jobs map[string]*exportState
+}
+
+var exports = &exportScheduler{jobs: make(map[string]*exportState)}
+
+// run starts due export jobs until ctx is done. The config is re-read on every tick, so
+// jobs can be added and changed without a restart.
+func (s *exportScheduler) run(ctx context.Context) {
+	t := time.NewTicker(exportTick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			config, err := loadConfig("config.json")
+			if err != nil {
+				continue
+			}
+			s.startDue(ctx, config, now)
+		}
+	}
+}
+
+// startDue starts every job whose interval has passed since its last run
+func (s *exportScheduler) startDue(ctx context.Context, config *Config, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, job := range config.Exports {
+		st, ok := s.jobs[name]
+		if !ok {
+			st = &exportState{}
+			s.jobs[name] = st
+		}
+		interval, err := configDuration("interval", job.Interval, 0)
+		if err != nil {
+			if st.LastError != err.Error() {
+				log.Printf("ERROR: Export %s: %v\n", name, err)
+				st.LastError = err.Error()
+			}
+			continue
+		}
+		run, due := st.next(name, now, interval, func() time.Duration { return job.maxRange(config) })
+		if !due {
+			continue
+		}
+		st.Running, st.LastRun = true, &now
+		go s.runJob(ctx, config, name, job, run)
+	}
+}
+
+// runJob executes one run of an export job and records its outcome
+func (s *exportScheduler) runJob(ctx context.Context, config *Config, name string, job ExportJob, run exportRun) {
+	rows, raised, err := exportOnce(ctx, config, job, run)
+
+	s.mu.Lock()
+	s.jobs[name].record(run, rows, len(raised), err)
+	s.mu.Unlock()
+	reportAnomalies(config, name, raised)
+
+	if err != nil {
+		log.Printf("ERROR: Export %s failed: %v\n", name, err)
+		if config.Datadog.Events {
+			datadog.event(&config.Datadog, "Pixie export failed: "+name, err.Error(), "error", "export", name, "script", job.Script)
+		}
+	}
+}
+
+// exportOnce runs the job's script over the run's window under the guardrails of its
+// manifest, checks it for anomalies and writes it to the job's destination. The anomaly
+// baselines and alerts are only updated once the write succeeded.
+func exportOnce(ctx context.Context, config *Config, job ExportJob, run exportRun) (int, []anomalyAlert, error) {
+	sink, err := job.sink(config)
+	if err != nil {
+		return 0, nil, err
+	}
+	s, err := loadScript(config.scriptDir(), job.Script)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := config.verifyScript(s); err != nil {
+		return 0, nil, err
+	}
+	// Without a start_time to apply the run's window to, every run would export the same rows
+	if !usesTimeRange(s.Source) {
+		return 0, nil, &scriptError{http.StatusUnprocessableEntity, "Script can't be exported", errors.New("it has no start_time argument or ${start_time} parameter to apply the run's window to")}
+	}
+	clusterID, err := config.clusterID(job.Cluster)
+	if err != nil {
+		return 0, nil, err
+	}
+	timeout, err := configDuration("exec_timeout", config.ExecTimeout, defaultExecTimeout)
+	if err != nil {
+		return 0, nil, err
+	}
+	prio, err := parsePriority(job.Priority, priorityExport)
+	if err != nil {
+		return 0, nil, err
+	}
+	shards, err := newShardSpec(config, job.Shard, job.ShardParallelism)
+	if err != nil {
+		return 0, nil, err
+	}
+	opts := execOptions{
+		Tenant:    cmp.Or(job.Tenant, defaultExportTenant),
+		ClusterID: clusterID,
+		Timeout:   timeout,
+		Params:    job.Params,
+		Range:     timeRange{Start: run.Start.Format(time.RFC3339Nano), End: run.End.Format(time.RFC3339Nano)},
+		Name:      s.Name,
+		Priority:  prio,
+		Shards:    shards,
+	}
+	config.applyDefaults(job.Cluster, s.Name, s.Source, s.Manifest, &opts)
+	if m := s.Manifest; m != nil {
+		// Export jobs are set up by the operator, so they hold whatever role the script requires
+		caller := &identity{Tenant: opts.Tenant, Roles: []string{m.Role}}
+		if err := m.enforce(caller, false, job.Cluster, &opts); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	res, err := runRange(ctx, config, s.Source, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.release()
+	var check *anomalyCheck
+	if job.Anomalies != nil {
+		check = anomalies.check(run.Job, job.Anomalies, res, run.End)
+		if job.Anomalies.Annotate {
+			annotate(res, check.flags)
+			history.amend(res)
+		}
+	}
+	if err := sink.write(ctx, run, res); err != nil {
+		return 0, nil, err
+	}
+	if check == nil {
+		return len(res.Rows), nil, nil
+	}
+	// A failed write is retried over the same window, so only a delivered result counts
+	anomalies.commit(check)
+	return len(res.Rows), check.raised, nil
+}
+
+// exportsHandler lists the configured export jobs along with the state of their runs
+func exportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	config, err := requestConfig(r)
+	if err != nil {
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+	type job struct {
+		Name        string `json:"name"`
+		Script      string `json:"script"`
+		Cluster     string `json:"cluster"`
+		Interval    string `json:"interval"`
+		Destination string `json:"destination"`
+		exportState
+	}
+	jobs := []job{}
+	exports.mu.Lock()
+	for name, j := range config.Exports {
+		entry := job{Name: name, Script: j.Script, Cluster: j.Cluster, Interval: j.Interval, Destination: j.destination()}
+		if st, ok := exports.jobs[name]; ok {
+			entry.exportState = *st
+		}
+		jobs = append(jobs, entry)
+	}
+	exports.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	writeJSON(w, map[string]interface{}{"exports": jobs})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// BigQueryDestination streams export rows into a BigQuery table, creating it with a schema
+// derived from the column types on first use
+type BigQueryDestination struct {
+	Project string `json:"project"`
+	Dataset string `json:"dataset"`
+	Table   string `json:"table"`
+	// PartitionColumn is the time64ns column new tables are partitioned by day on
+	// (default: the first time64ns column)
+	PartitionColumn string `json:"partition_column,omitempty"`
+	// CredentialsFile is a service account key file; Application Default Credentials are
+	// used when empty
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	// Endpoint overrides the API root (default https://bigquery.googleapis.com)
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+const (
+	bigQueryScope           = "https://www.googleapis.com/auth/bigquery"
+	defaultBigQueryEndpoint = "https://bigquery.googleapis.com"
+	// bigQueryBatchRows is the number of rows per insertAll request recommended by BigQuery
+	bigQueryBatchRows = 500
+	// bigQueryTimestamp is the microsecond precision BigQuery stores timestamps with
+	bigQueryTimestamp = "2006-01-02T15:04:05.999999Z"
+)
+
+// bigQuery caches the tables known to exist
+var bigQuery = struct {
+	mu     sync.Mutex
+	tables map[string]bool
+}{tables: make(map[string]bool)}
+
+// bigQueryField restricts column names to what BigQuery accepts
+var bigQueryField = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func bigQueryFieldName(col string) string {
+	name := bigQueryField.ReplaceAllString(col, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// bigQueryType maps a Pixie column type to a BigQuery column type
+func bigQueryType(typ string) string {
+	switch typ {
+	case "time64ns":
+		return "TIMESTAMP"
+	case "int64":
+		return "INT64"
+	case "float64":
+		return "FLOAT64"
+	case "boolean":
+		return "BOOL"
+	}
+	return "STRING"
+}
+
+type bigQuerySink struct {
+	dest *BigQueryDestination
+}
+
+// client returns an HTTP client authorized for BigQuery
+func (s bigQuerySink) client() (*http.Client, error) {
+	return googleClient(s.dest.CredentialsFile, bigQueryScope)
+}
+
+// googleClients caches authorized clients per scope and credentials file
+var googleClients = struct {
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}{clients: make(map[string]*http.Client)}
+
+// googleClient returns an HTTP client authorized for a Google Cloud API scope with the
+// service account key in credentialsFile, or Application Default Credentials when it's empty
+func googleClient(credentialsFile, scope string) (*http.Client, error) {
+	googleClients.mu.Lock()
+	defer googleClients.mu.Unlock()
+	key := scope + "\x00" + credentialsFile
+	if c, ok := googleClients.clients[key]; ok {
+		return c, nil
+	}
+	// Tokens are refreshed long after this run, so they don't use its context
+	var creds *google.Credentials
+	var err error
+	if credentialsFile != "" {
+		var data []byte
+		if data, err = os.ReadFile(credentialsFile); err != nil {
+			return nil, fmt.Errorf("could not read Google Cloud credentials: %w", err)
+		}
+		creds, err = google.CredentialsFromJSON(context.Background(), data, scope)
+	} else {
+		creds, err = google.FindDefaultCredentials(context.Background(), scope)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load Google Cloud credentials: %w", err)
+	}
+	c := oauth2.NewClient(context.Background(), creds.TokenSource)
+	googleClients.clients[key] = c
+	return c, nil
+}
+
+// tablesURL is the REST collection of tables in the destination dataset
+func (s bigQuerySink) tablesURL() string {
+	endpoint := strings.TrimSuffix(s.dest.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = defaultBigQueryEndpoint
+	}
+	return fmt.Sprintf("%s/bigquery/v2/projects/%s/datasets/%s/tables", endpoint, url.PathEscape(s.dest.Project), url.PathEscape(s.dest.Dataset))
+}
+
+// call sends a JSON request and decodes the response into out, turning API errors into Go errors
+func (s bigQuerySink) call(ctx context.Context, c *http.Client, method, u string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return resp.StatusCode, fmt.Errorf("BigQuery %s %s: %s %s", method, u, resp.Status, apiErr.Error.Message)
+	}
+	if out == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ensureTable creates the destination table from the result's schema unless it exists
+func (s bigQuerySink) ensureTable(ctx context.Context, c *http.Client, res *queryResult) error {
+	key := s.dest.Project + "." + s.dest.Dataset + "." + s.dest.Table
+	bigQuery.mu.Lock()
+	known := bigQuery.tables[key]
+	bigQuery.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	status, err := s.call(ctx, c, http.MethodGet, s.tablesURL()+"/"+url.PathEscape(s.dest.Table), nil, nil)
+	if status == http.StatusNotFound {
+		type field struct {
+			Name        string `json:"name"`
+			Type        string `json:"type"`
+			Mode        string `json:"mode"`
+			Description string `json:"description,omitempty"`
+		}
+		fields := make([]field, len(res.Schema))
+		for i, col := range res.Schema {
+			fields[i] = field{Name: bigQueryFieldName(col.Name), Type: bigQueryType(col.Type), Mode: "NULLABLE", Description: col.SemanticType}
+		}
+		table := map[string]interface{}{
+			"tableReference": map[string]string{"projectId": s.dest.Project, "datasetId": s.dest.Dataset, "tableId": s.dest.Table},
+			"schema":         map[string]interface{}{"fields": fields},
+		}
+		partition := s.dest.PartitionColumn
+		if partition == "" {
+			if i := firstTimeColumn(res.Schema); i >= 0 {
+				partition = res.Schema[i].Name
+			}
+		}
+		if partition != "" {
+			table["timePartitioning"] = map[string]string{"type": "DAY", "field": bigQueryFieldName(partition)}
+		}
+		status, err = s.call(ctx, c, http.MethodPost, s.tablesURL(), table, nil)
+		if status == http.StatusConflict {
+			// Created concurrently
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	bigQuery.mu.Lock()
+	bigQuery.tables[key] = true
+	bigQuery.mu.Unlock()
+	return nil
+}
+
+// write streams the rows of res into the destination table. Insert IDs derive from the
+// run's window, so BigQuery drops duplicates when a run is retried shortly after.
+func (s bigQuerySink) write(ctx context.Context, run exportRun, res *queryResult) error {
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+	if err := s.ensureTable(ctx, c, res); err != nil {
+		return err
+	}
+
+	names := make([]string, len(res.Schema))
+	for i, col := range res.Schema {
+		names[i] = bigQueryFieldName(col.Name)
+	}
+	type row struct {
+		InsertID string                 `json:"insertId"`
+		JSON     map[string]interface{} `json:"json"`
+	}
+	var resp struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	u := s.tablesURL() + "/" + url.PathEscape(s.dest.Table) + "/insertAll"
+	for offset := 0; offset < len(res.Rows); offset += bigQueryBatchRows {
+		batch := res.Rows[offset:min(offset+bigQueryBatchRows, len(res.Rows))]
+		rows := make([]row, len(batch))
+		for i, cells := range batch {
+			values := make(map[string]interface{}, len(cells))
+			for j, cell := range cells {
+				switch v := typedCell(res.Schema[j].Type, cell).(type) {
+				case time.Time:
+					values[names[j]] = v.UTC().Format(bigQueryTimestamp)
+				case int64:
+					// Sent as a string so values above 2^53 survive JSON
+					values[names[j]] = strconv.FormatInt(v, 10)
+				default:
+					values[names[j]] = v
+				}
+			}
+			rows[i] = row{InsertID: fmt.Sprintf("%s-%d-%d", run.Job, run.Start.UnixNano(), offset+i), JSON: values}
+		}
+		resp.InsertErrors = nil
+		if _, err := s.call(ctx, c, http.MethodPost, u, map[string]interface{}{"rows": rows}, &resp); err != nil {
+			return err
+		}
+		if len(resp.InsertErrors) > 0 {
+			e := resp.InsertErrors[0]
+			msg := "unknown error"
+			if len(e.Errors) > 0 {
+				msg = e.Errors[0].Reason + ": " + e.Errors[0].Message
+			}
+			return fmt.Errorf("BigQuery rejected %d rows, the first at index %d: %s", len(resp.InsertErrors), offset+e.Index, msg)
+		}
+	}
+	return nil
+}
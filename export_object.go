@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ObjectDestination writes the rows of each run as one object to a bucket. Objects are named
+// after the job and the run's window, so a retried run replaces the object of its failed attempt.
+type ObjectDestination struct {
+	Bucket string `json:"bucket"`
+	// Prefix is prepended to object names, e.g. "pixie/"
+	Prefix string `json:"prefix,omitempty"`
+	// Format is the output format of the objects (default parquet)
+	Format string `json:"format,omitempty"`
+	// Compression is the codec of formats with a choice (default: the format's entry in
+	// compression, then the format's default)
+	Compression string `json:"compression,omitempty"`
+	// Endpoint overrides the API root, e.g. for S3-compatible stores
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// S3Destination writes export objects to an S3 bucket
+type S3Destination struct {
+	ObjectDestination
+	Region string `json:"region"`
+	// AccessKeyID and SecretAccessKey sign the requests; AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN are used when they're empty
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+}
+
+// GCSDestination writes export objects to a Google Cloud Storage bucket
+type GCSDestination struct {
+	ObjectDestination
+	// CredentialsFile is a service account key file; Application Default Credentials are
+	// used when empty
+	CredentialsFile string `json:"credentials_file,omitempty"`
+}
+
+const (
+	// defaultObjectFormat is the format of export objects; typed columns suit data lakes
+	defaultObjectFormat = "parquet"
+	defaultGCSEndpoint  = "https://storage.googleapis.com"
+	gcsScope            = "https://www.googleapis.com/auth/devstorage.read_write"
+	// objectTimestamp names the window bounds of export objects
+	objectTimestamp = "20060102T150405Z"
+)
+
+// format returns the output format name and its codec
+func (d *ObjectDestination) format(config *Config) (string, Formatter, string, error) {
+	name := d.Format
+	if name == "" {
+		name = defaultObjectFormat
+	}
+	f, ok := formatters[name]
+	if !ok {
+		return "", nil, "", fmt.Errorf("format %q is not one of %s", name, strings.Join(formatNames(), ", "))
+	}
+	codec, err := formatCodec(config, name, f, d.Compression)
+	if err != nil {
+		// Report the problem with the setting rather than a request parameter
+		var se *scriptError
+		if errors.As(err, &se) {
+			err = se.err
+		}
+		return "", nil, "", err
+	}
+	return name, f, codec, nil
+}
+
+// objectName is the name of the object a run writes: <prefix><job>/<start>_<end>.<format>
+func (d *ObjectDestination) objectName(run exportRun, format string) string {
+	return fmt.Sprintf("%s%s/%s_%s.%s", d.Prefix, run.Job, run.Start.UTC().Format(objectTimestamp), run.End.UTC().Format(objectTimestamp), format)
+}
+
+// objectStore uploads objects to a bucket
+type objectStore interface {
+	put(ctx context.Context, name, contentType string, body []byte) error
+}
+
+// objectSink renders each run's result in one format and uploads it to a bucket
+type objectSink struct {
+	dest      *ObjectDestination
+	store     objectStore
+	format    string
+	formatter Formatter
+	codec     string
+}
+
+func newObjectSink(config *Config, dest *ObjectDestination, store objectStore) (objectSink, error) {
+	name, f, codec, err := dest.format(config)
+	if err != nil {
+		return objectSink{}, err
+	}
+	return objectSink{dest: dest, store: store, format: name, formatter: f, codec: codec}, nil
+}
+
+func (s objectSink) write(ctx context.Context, run exportRun, res *queryResult) error {
+	var payload []byte
+	var err error
+	if cf, ok := s.formatter.(codecFormatter); ok {
+		payload, err = cf.FormatCodec(res, s.codec)
+	} else {
+		payload, err = s.formatter.Format(res)
+	}
+	if err != nil {
+		return fmt.Errorf("could not encode %s: %w", s.format, err)
+	}
+	return s.store.put(ctx, s.dest.objectName(run, s.format), s.formatter.ContentType(), payload)
+}
+
+// s3Store uploads objects with SigV4-signed PUT requests
+type s3Store struct {
+	dest *S3Destination
+}
+
+// objectURL addresses the object virtual-hosted style on AWS and path style on a custom endpoint
+func (s s3Store) objectURL(name string) string {
+	if s.dest.Endpoint == "" {
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.dest.Bucket, s.dest.Region, s3Escape(name))
+	}
+	return strings.TrimSuffix(s.dest.Endpoint, "/") + "/" + s3Escape(s.dest.Bucket) + "/" + s3Escape(name)
+}
+
+// credentials returns the access key, secret and session token to sign with
+func (s s3Store) credentials() (string, string, string, error) {
+	if s.dest.AccessKeyID != "" {
+		return s.dest.AccessKeyID, s.dest.SecretAccessKey, "", nil
+	}
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return "", "", "", fmt.Errorf("no S3 credentials: set access_key_id and secret_access_key or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return id, secret, os.Getenv("AWS_SESSION_TOKEN"), nil
+}
+
+func (s s3Store) put(ctx context.Context, name, contentType string, body []byte) error {
+	id, secret, token, err := s.credentials()
+	if err != nil {
+		return err
+	}
+	u := s.objectURL(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signS3(req, body, id, secret, s.dest.Region, time.Now().UTC())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 PUT %s: %s %s", u, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// signS3 adds an AWS Signature Version 4 to req, covering the host, the payload hash and the
+// headers set on req
+func signS3(req *http.Request, body []byte, id, secret, region string, now time.Time) {
+	date, stamp := now.Format("20060102"), now.Format("20060102T150405Z")
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(v[0])
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		id, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes an object name the way SigV4 expects, keeping the slashes
+func s3Escape(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// gcsStore uploads objects with the JSON API's simple media upload
+type gcsStore struct {
+	dest *GCSDestination
+}
+
+func (s gcsStore) put(ctx context.Context, name, contentType string, body []byte) error {
+	c, err := googleClient(s.dest.CredentialsFile, gcsScope)
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimSuffix(s.dest.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = defaultGCSEndpoint
+	}
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s", endpoint, url.PathEscape(s.dest.Bucket), url.QueryEscape(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("GCS upload of %s to %s: %s %s", name, s.dest.Bucket, resp.Status, apiErr.Error.Message)
+	}
+	return nil
+}
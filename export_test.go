@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExportSchedulerRecovers(t *testing.T) {
+	const interval, maxRange = 5 * time.Minute, 15 * time.Minute
+	t0 := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	st := &exportState{}
+	// tick starts the job at now if it is due, as startDue does, and records the outcome
+	tick := func(now time.Time, fail bool) (exportRun, bool) {
+		run, due := st.next("job", now, interval, func() time.Duration { return maxRange })
+		if !due {
+			return run, false
+		}
+		st.Running, st.LastRun = true, &now
+		var err error
+		if fail {
+			err = errors.New("destination unavailable")
+		}
+		st.record(run, 0, 0, err)
+		return run, true
+	}
+
+	if run, _ := tick(t0, false); !run.Start.Equal(t0.Add(-interval)) || !run.End.Equal(t0) {
+		t.Fatalf("first run covers %v to %v, want the interval before %v", run.Start, run.End, t0)
+	}
+	// The destination is down for half an hour
+	for now := t0.Add(interval); now.Before(t0.Add(35 * time.Minute)); now = now.Add(interval) {
+		if _, due := tick(now, true); !due {
+			t.Fatalf("job not retried at %v", now)
+		}
+		if _, due := tick(now.Add(time.Second), true); due {
+			t.Fatalf("failed job retried right away at %v", now)
+		}
+	}
+
+	// Once it is back the backlog is exported in windows the script accepts, one after
+	// the other, without gaps
+	now := t0.Add(35 * time.Minute)
+	want := []struct{ start, end time.Time }{
+		{t0, t0.Add(15 * time.Minute)},
+		{t0.Add(15 * time.Minute), t0.Add(30 * time.Minute)},
+		{t0.Add(30 * time.Minute), now.Add(2 * time.Second)},
+	}
+	for i, w := range want {
+		run, due := tick(now.Add(time.Duration(i)*time.Second), false)
+		if !due {
+			t.Fatalf("catch-up run %d not started", i+1)
+		}
+		if !run.Start.Equal(w.start) || !run.End.Equal(w.end) || run.End.Sub(run.Start) > maxRange {
+			t.Errorf("catch-up run %d covers %v to %v, want %v to %v", i+1, run.Start, run.End, w.start, w.end)
+		}
+	}
+	if st.CatchingUp || st.LastError != "" {
+		t.Errorf("state after catching up = %+v", st)
+	}
+	if _, due := tick(now.Add(3*time.Second), false); due {
+		t.Error("job started again before its interval passed")
+	}
+}
+
+func TestExportWindowWithoutMaxRange(t *testing.T) {
+	const interval = time.Minute
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	last := now.Add(-time.Hour)
+	st := &exportState{WindowEnd: &last, LastRun: &last}
+	run, due := st.next("job", now, interval, func() time.Duration { return 0 })
+	if !due {
+		t.Fatal("job not due")
+	}
+	// Without a max_range the window is only bounded by maxExportCatchUp intervals
+	if !run.Start.Equal(now.Add(-maxExportCatchUp*interval)) || !run.End.Equal(now) || run.catchUp {
+		t.Errorf("run = %+v, want the last %d intervals", run, maxExportCatchUp)
+	}
+}
+
+func TestExportRejectsScriptsWithoutTimeRange(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "all_conns.pxl"), []byte("import px\ndf = px.DataFrame(table='conn_stats')\npx.display(df)\n"), 0o644)
+	config := &Config{ScriptDir: dir}
+	job := ExportJob{Script: "all_conns", Interval: "5m", BigQuery: &BigQueryDestination{Project: "p", Dataset: "d", Table: "t"}}
+	now := time.Now()
+
+	_, _, err := exportOnce(context.Background(), config, job, exportRun{Job: "conns", Start: now.Add(-5 * time.Minute), End: now})
+	var se *scriptError
+	if !errors.As(err, &se) || se.status != http.StatusUnprocessableEntity {
+		t.Fatalf("exportOnce() error = %v, want 422", err)
+	}
+}
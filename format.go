@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formatter renders a query result in one output format
+type Formatter interface {
+	// ContentType is the media type of the rendered result
+	ContentType() string
+	// Format renders the result
+	Format(res *queryResult) ([]byte, error)
+}
+
+// aliasedFormatter is implemented by formats known under more than one media type
+type aliasedFormatter interface {
+	Aliases() []string
+}
+
+// codecFormatter is implemented by formats with a choice of compression codecs, picked with
+// ?compression= or the format's entry in the compression setting
+type codecFormatter interface {
+	// Codecs lists the supported codecs, the default first
+	Codecs() []string
+	FormatCodec(res *queryResult, codec string) ([]byte, error)
+}
+
+// formatCodec picks the codec for a format, rejecting codecs it doesn't support
+func formatCodec(config *Config, format string, f Formatter, requested string) (string, error) {
+	cf, ok := f.(codecFormatter)
+	if !ok {
+		if requested != "" {
+			return "", &scriptError{http.StatusBadRequest, "Invalid 'compression' parameter", fmt.Errorf("format %q has no compression codecs", format)}
+		}
+		return "", nil
+	}
+	codec := cmp.Or(requested, config.Compression[format], cf.Codecs()[0])
+	if !slices.Contains(cf.Codecs(), codec) {
+		return "", &scriptError{http.StatusBadRequest, "Invalid 'compression' parameter", fmt.Errorf("format %q supports %s", format, strings.Join(cf.Codecs(), ", "))}
+	}
+	return codec, nil
+}
+
+// formatters are the registered output formats by name, as selected with ?format=
+var formatters = make(map[string]Formatter)
+
+// registerFormatter makes a format available to all result endpoints
+func registerFormatter(name string, f Formatter) {
+	formatters[name] = f
+}
+
+const defaultFormat = "json"
+
+// negotiateFormat picks the output format from ?format= or, failing that, the Accept header
+func negotiateFormat(r *http.Request) (string, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		if _, ok := formatters[name]; !ok {
+			return "", &scriptError{http.StatusNotAcceptable, "Unknown format", fmt.Errorf("%q is not one of %s", name, strings.Join(formatNames(), ", "))}
+		}
+		return name, nil
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return defaultFormat, nil
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType == "*/*" || mediaType == "application/*" {
+			return defaultFormat, nil
+		}
+		for _, name := range formatNames() {
+			f := formatters[name]
+			if t, _, _ := mime.ParseMediaType(f.ContentType()); t == mediaType {
+				return name, nil
+			}
+			if a, ok := f.(aliasedFormatter); ok && slices.Contains(a.Aliases(), mediaType) {
+				return name, nil
+			}
+		}
+	}
+	return "", &scriptError{http.StatusNotAcceptable, "Not acceptable", fmt.Errorf("no format matches %q; use ?format= with one of %s", accept, strings.Join(formatNames(), ", "))}
+}
+
+// formatNames lists the registered formats in a stable order
+func formatNames() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerFormatter("json", jsonFormatter{})
+	registerFormatter("ndjson", ndjsonFormatter{})
+	registerFormatter("csv", csvFormatter{})
+	registerFormatter("influx", influxFormatter{})
+	registerFormatter("prometheus", prometheusFormatter{})
+}
+
+// jsonFormatter renders the result as a single JSON document
+type jsonFormatter struct{}
+
+func (jsonFormatter) ContentType() string { return "application/json" }
+
+func (jsonFormatter) Format(res *queryResult) ([]byte, error) {
+	return encodeJSON(res)
+}
+
+// ndjsonFormatter renders one JSON object per row, keyed by column name
+type ndjsonFormatter struct{}
+
+func (ndjsonFormatter) ContentType() string { return "application/x-ndjson" }
+
+func (ndjsonFormatter) Format(res *queryResult) ([]byte, error) {
+	var buf bytes.Buffer
+	obj := make(map[string]string, len(res.Columns))
+	for _, row := range res.Rows {
+		for i, col := range res.Columns {
+			if i < len(row) {
+				obj[col] = row[i]
+			}
+		}
+		line, err := encodeJSON(obj)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+	}
+	return buf.Bytes(), nil
+}
+
+// csvFormatter renders a header row followed by the data rows
+type csvFormatter struct{}
+
+func (csvFormatter) ContentType() string { return "text/csv; charset=utf-8" }
+
+func (csvFormatter) Format(res *queryResult) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(res.Columns)
+	w.WriteAll(res.Rows)
+	return buf.Bytes(), w.Error()
+}
+
+// influxFormatter renders InfluxDB line protocol. The table is the measurement, string
+// columns become tags, numeric and boolean columns fields, and the first time64ns column
+// the timestamp.
+type influxFormatter struct{}
+
+func (influxFormatter) ContentType() string { return "application/vnd.influx.line-protocol" }
+
+var (
+	influxTagEscaper   = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxFieldEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+func (influxFormatter) Format(res *queryResult) ([]byte, error) {
+	measurement := res.table
+	if measurement == "" {
+		measurement = "pixie"
+	}
+	timeCol := firstTimeColumn(res.Schema)
+	var buf bytes.Buffer
+	for _, row := range res.Rows {
+		buf.WriteString(influxTagEscaper.Replace(measurement))
+		var fields []string
+		for i, col := range res.Schema {
+			if i == timeCol || i >= len(row) || row[i] == "" {
+				continue
+			}
+			cell := row[i]
+			switch col.Type {
+			case "string", "uint128":
+				fmt.Fprintf(&buf, ",%s=%s", influxTagEscaper.Replace(col.Name), influxTagEscaper.Replace(cell))
+				continue
+			case "int64":
+				if _, err := strconv.ParseInt(cell, 10, 64); err == nil {
+					cell += "i"
+				} else {
+					cell = `"` + influxFieldEscaper.Replace(cell) + `"`
+				}
+			case "float64":
+				if _, err := strconv.ParseFloat(cell, 64); err != nil {
+					cell = `"` + influxFieldEscaper.Replace(cell) + `"`
+				}
+			case "time64ns":
+				if t, err := time.Parse(time64Layout, cell); err == nil {
+					cell = strconv.FormatInt(t.UnixNano(), 10) + "i"
+				}
+			}
+			fields = append(fields, influxTagEscaper.Replace(col.Name)+"="+cell)
+		}
+		if len(fields) == 0 {
+			// Line protocol requires at least one field
+			fields = append(fields, "count=1i")
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strings.Join(fields, ","))
+		if timeCol >= 0 && timeCol < len(row) {
+			if t, err := time.Parse(time64Layout, row[timeCol]); err == nil {
+				buf.WriteByte(' ')
+				buf.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// prometheusFormatter renders each numeric column as a gauge named pixie_<column>, labelled
+// with the string columns of the row and timestamped by the first time64ns column
+type prometheusFormatter struct{}
+
+func (prometheusFormatter) ContentType() string { return "text/plain; version=0.0.4; charset=utf-8" }
+
+var promInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func (prometheusFormatter) Format(res *queryResult) ([]byte, error) {
+	timeCol := firstTimeColumn(res.Schema)
+	var labelCols, valueCols []int
+	for i, col := range res.Schema {
+		switch col.Type {
+		case "string", "uint128":
+			labelCols = append(labelCols, i)
+		case "int64", "float64", "boolean":
+			valueCols = append(valueCols, i)
+		}
+	}
+	var buf bytes.Buffer
+	for _, c := range valueCols {
+		name := "pixie_" + promInvalidChars.ReplaceAllString(res.Schema[c].Name, "_")
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", name)
+		for _, row := range res.Rows {
+			value := row[c]
+			switch value {
+			case "true":
+				value = "1"
+			case "false":
+				value = "0"
+			}
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+			buf.WriteString(name)
+			if len(labelCols) > 0 {
+				labels := make([]string, len(labelCols))
+				for i, l := range labelCols {
+					labels[i] = fmt.Sprintf("%s=%q", promInvalidChars.ReplaceAllString(res.Schema[l].Name, "_"), row[l])
+				}
+				buf.WriteString("{" + strings.Join(labels, ",") + "}")
+			}
+			buf.WriteString(" " + value)
+			if timeCol >= 0 {
+				if t, err := time.Parse(time64Layout, row[timeCol]); err == nil {
+					buf.WriteString(" " + strconv.FormatInt(t.UnixMilli(), 10))
+				}
+			}
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// firstTimeColumn returns the index of the first time64ns column, or -1
+func firstTimeColumn(schema []columnSchema) int {
+	for i, col := range schema {
+		if col.Type == "time64ns" {
+			return i
+		}
+	}
+	return -1
+}
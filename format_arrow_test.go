@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+)
+
+func TestArrowFormat(t *testing.T) {
+	res := &queryResult{
+		Columns: []string{"pod", "reqs", "cpu"},
+		Schema:  []columnSchema{{Name: "pod", Type: "string"}, {Name: "reqs", Type: "int64", SemanticType: "bytes"}, {Name: "cpu", Type: "float64"}},
+		// The second row is shorter than the schema and the third doesn't parse as its types
+		Rows: [][]string{{"a", "1", "0.5"}, {"b"}, {"c", "n/a", "1.5"}},
+	}
+	payload, err := arrowFormatter{}.Format(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ipc.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Release()
+	if !r.Next() {
+		t.Fatal("stream holds no record")
+	}
+	rec := r.Record()
+	if rec.NumRows() != 3 || rec.NumCols() != 3 {
+		t.Fatalf("record is %dx%d, want 3x3", rec.NumRows(), rec.NumCols())
+	}
+	if md := rec.Schema().Field(1).Metadata; md.FindKey("semantic_type") < 0 {
+		t.Error("semantic type missing from the field metadata")
+	}
+	reqs, cpu := rec.Column(1).(*array.Int64), rec.Column(2).(*array.Float64)
+	if reqs.Value(0) != 1 || cpu.Value(0) != 0.5 || cpu.Value(2) != 1.5 {
+		t.Errorf("typed values = %v %v", reqs, cpu)
+	}
+	for _, null := range []struct {
+		col, row int
+	}{{1, 1}, {2, 1}, {1, 2}} {
+		if !rec.Column(null.col).IsNull(null.row) {
+			t.Errorf("column %d of row %d isn't null", null.col, null.row)
+		}
+	}
+}
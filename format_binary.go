@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"pixie-data-service/resultpb"
+)
+
+func init() {
+	registerFormatter("msgpack", msgpackFormatter{})
+	registerFormatter("protobuf", protobufFormatter{})
+}
+
+// typedCell parses a cell into the Go value of its column type: int64, float64, bool or
+// time.Time. Cells that don't parse, and other types, stay strings; empty cells are nil.
+func typedCell(typ, cell string) interface{} {
+	switch typ {
+	case "int64":
+		if v, err := strconv.ParseInt(cell, 10, 64); err == nil {
+			return v
+		}
+		// Downsampled and computed values may be fractional
+		if v, err := strconv.ParseFloat(cell, 64); err == nil {
+			return v
+		}
+	case "float64":
+		if v, err := strconv.ParseFloat(cell, 64); err == nil {
+			return v
+		}
+	case "boolean":
+		if v, err := strconv.ParseBool(cell); err == nil {
+			return v
+		}
+	case "time64ns":
+		if v, err := time.Parse(time64Layout, cell); err == nil {
+			return v
+		}
+	}
+	if cell == "" && typ != "string" {
+		return nil
+	}
+	return cell
+}
+
+// msgpackFormatter renders the JSON document shape in MessagePack, with typed cells and
+// timestamps as the MessagePack timestamp extension
+type msgpackFormatter struct{}
+
+func (msgpackFormatter) ContentType() string { return "application/msgpack" }
+
+func (msgpackFormatter) Aliases() []string { return []string{"application/x-msgpack"} }
+
+func (msgpackFormatter) Format(res *queryResult) ([]byte, error) {
+	var e msgpackEncoder
+	e.mapHeader(4)
+	e.str("columns")
+	e.arrayHeader(len(res.Columns))
+	for _, c := range res.Columns {
+		e.str(c)
+	}
+	e.str("schema")
+	e.arrayHeader(len(res.Schema))
+	for _, col := range res.Schema {
+		e.mapHeader(3)
+		e.str("name")
+		e.str(col.Name)
+		e.str("type")
+		e.str(col.Type)
+		e.str("semantic_type")
+		e.str(col.SemanticType)
+	}
+	e.str("rows")
+	e.arrayHeader(len(res.Rows))
+	for _, row := range res.Rows {
+		e.arrayHeader(len(row))
+		for i, cell := range row {
+			typ := ""
+			if i < len(res.Schema) {
+				typ = res.Schema[i].Type
+			}
+			e.value(typedCell(typ, cell))
+		}
+	}
+	e.str("stats")
+	if res.Stats == nil {
+		e.buf.WriteByte(0xc0)
+	} else {
+		s := res.Stats
+		e.mapHeader(6)
+		for _, kv := range []struct {
+			k string
+			v int64
+		}{
+			{"AcceptedBytes", s.AcceptedBytes}, {"TotalBytes", s.TotalBytes},
+			{"ExecutionTime", int64(s.ExecutionTime)}, {"CompilationTime", int64(s.CompilationTime)},
+			{"BytesProcessed", s.BytesProcessed}, {"RecordsProcessed", s.RecordsProcessed},
+		} {
+			e.str(kv.k)
+			e.int(kv.v)
+		}
+	}
+	return e.buf.Bytes(), nil
+}
+
+// msgpackEncoder writes the subset of MessagePack results need
+type msgpackEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *msgpackEncoder) header(fix byte, fixMax int, b16, b32 byte, n int) {
+	switch {
+	case n <= fixMax:
+		e.buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		e.buf.WriteByte(b16)
+		e.buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		e.buf.WriteByte(b32)
+		e.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func (e *msgpackEncoder) mapHeader(n int)   { e.header(0x80, 15, 0xde, 0xdf, n) }
+func (e *msgpackEncoder) arrayHeader(n int) { e.header(0x90, 15, 0xdc, 0xdd, n) }
+
+func (e *msgpackEncoder) str(s string) {
+	if len(s) <= 31 {
+		e.buf.WriteByte(0xa0 | byte(len(s)))
+	} else if len(s) <= math.MaxUint8 {
+		e.buf.WriteByte(0xd9)
+		e.buf.WriteByte(byte(len(s)))
+	} else {
+		e.header(0, -1, 0xda, 0xdb, len(s))
+	}
+	e.buf.WriteString(s)
+}
+
+func (e *msgpackEncoder) int(v int64) {
+	switch {
+	case v >= 0 && v <= 127:
+		e.buf.WriteByte(byte(v))
+	case v < 0 && v >= -32:
+		e.buf.WriteByte(byte(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		e.buf.WriteByte(0xd2)
+		e.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(int32(v))))
+	default:
+		e.buf.WriteByte(0xd3)
+		e.buf.Write(binary.BigEndian.AppendUint64(nil, uint64(v)))
+	}
+}
+
+func (e *msgpackEncoder) value(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		e.buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			e.buf.WriteByte(0xc3)
+		} else {
+			e.buf.WriteByte(0xc2)
+		}
+	case int64:
+		e.int(v)
+	case float64:
+		e.buf.WriteByte(0xcb)
+		e.buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+	case time.Time:
+		// timestamp 96: ext 8, type -1, uint32 nanoseconds, int64 seconds
+		e.buf.Write([]byte{0xc7, 12, 0xff})
+		e.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(v.Nanosecond())))
+		e.buf.Write(binary.BigEndian.AppendUint64(nil, uint64(v.Unix())))
+	case string:
+		e.str(v)
+	}
+}
+
+// protobufFormatter renders the resultpb.Result message
+type protobufFormatter struct{}
+
+func (protobufFormatter) ContentType() string { return "application/x-protobuf" }
+
+func (protobufFormatter) Aliases() []string { return []string{"application/protobuf"} }
+
+func (protobufFormatter) Format(res *queryResult) ([]byte, error) {
+	msg := &resultpb.Result{Table: res.table}
+	for _, col := range res.Schema {
+		msg.Columns = append(msg.Columns, &resultpb.Column{Name: col.Name, Type: col.Type, SemanticType: col.SemanticType})
+	}
+	for _, row := range res.Rows {
+		pbRow := &resultpb.Row{Values: make([]*resultpb.Value, len(row))}
+		for i, cell := range row {
+			typ := ""
+			if i < len(res.Schema) {
+				typ = res.Schema[i].Type
+			}
+			v := &resultpb.Value{}
+			switch t := typedCell(typ, cell).(type) {
+			case int64:
+				v.Kind = &resultpb.Value_Int64Value{Int64Value: t}
+			case float64:
+				v.Kind = &resultpb.Value_Float64Value{Float64Value: t}
+			case bool:
+				v.Kind = &resultpb.Value_BoolValue{BoolValue: t}
+			case time.Time:
+				v.Kind = &resultpb.Value_TimeNs{TimeNs: t.UnixNano()}
+			case string:
+				v.Kind = &resultpb.Value_StringValue{StringValue: t}
+			}
+			pbRow.Values[i] = v
+		}
+		msg.Rows = append(msg.Rows, pbRow)
+	}
+	if s := res.Stats; s != nil {
+		msg.Stats = &resultpb.Stats{
+			AcceptedBytes:     s.AcceptedBytes,
+			TotalBytes:        s.TotalBytes,
+			ExecutionTimeNs:   int64(s.ExecutionTime),
+			CompilationTimeNs: int64(s.CompilationTime),
+			BytesProcessed:    s.BytesProcessed,
+			RecordsProcessed:  s.RecordsProcessed,
+		}
+	}
+	return proto.Marshal(msg)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMsgpackEncoder(t *testing.T) {
+	long := strings.Repeat("x", 32)
+	tests := []struct {
+		name   string
+		encode func(e *msgpackEncoder)
+		want   string
+	}{
+		{"positive fixint", func(e *msgpackEncoder) { e.int(127) }, "7f"},
+		{"negative fixint", func(e *msgpackEncoder) { e.int(-32) }, "e0"},
+		{"int32 below fixint", func(e *msgpackEncoder) { e.int(-33) }, "d2ffffffdf"},
+		{"int32 above fixint", func(e *msgpackEncoder) { e.int(128) }, "d200000080"},
+		{"int64", func(e *msgpackEncoder) { e.int(1 << 40) }, "d30000010000000000"},
+		{"min int64", func(e *msgpackEncoder) { e.int(math.MinInt64) }, "d38000000000000000"},
+		{"empty fixstr", func(e *msgpackEncoder) { e.str("") }, "a0"},
+		{"fixstr", func(e *msgpackEncoder) { e.str("abc") }, "a3616263"},
+		{"str8", func(e *msgpackEncoder) { e.str(long) }, "d920" + strings.Repeat("78", 32)},
+		{"str16", func(e *msgpackEncoder) { e.str(strings.Repeat("x", 256)) }, "da0100" + strings.Repeat("78", 256)},
+		{"fixarray", func(e *msgpackEncoder) { e.arrayHeader(15) }, "9f"},
+		{"array16", func(e *msgpackEncoder) { e.arrayHeader(16) }, "dc0010"},
+		{"array32", func(e *msgpackEncoder) { e.arrayHeader(1 << 16) }, "dd00010000"},
+		{"fixmap", func(e *msgpackEncoder) { e.mapHeader(3) }, "83"},
+		{"map16", func(e *msgpackEncoder) { e.mapHeader(16) }, "de0010"},
+		{"nil", func(e *msgpackEncoder) { e.value(nil) }, "c0"},
+		{"true", func(e *msgpackEncoder) { e.value(true) }, "c3"},
+		{"false", func(e *msgpackEncoder) { e.value(false) }, "c2"},
+		{"float64", func(e *msgpackEncoder) { e.value(1.5) }, "cb3ff8000000000000"},
+		{"timestamp96", func(e *msgpackEncoder) { e.value(time.Unix(1, 5)) }, "c70cff000000050000000000000001"},
+		{"timestamp before 1970", func(e *msgpackEncoder) { e.value(time.Unix(-1, 0)) }, "c70cff00000000ffffffffffffffff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e msgpackEncoder
+			tt.encode(&e)
+			if got := hex.EncodeToString(e.buf.Bytes()); got != tt.want {
+				t.Errorf("encoded %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMsgpackFormat(t *testing.T) {
+	res := &queryResult{
+		Columns: []string{"n", "ok"},
+		Schema:  []columnSchema{{Name: "n", Type: "int64"}, {Name: "ok", Type: "boolean"}},
+		Rows:    [][]string{{"7", "true"}, {"", "x"}},
+	}
+	got, err := msgpackFormatter{}.Format(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rows are typed: 7 and true, then nil for the empty int and the unparseable bool as text
+	wantRows, _ := hex.DecodeString("a4726f7773" + "92" + "9207c3" + "92c0a178")
+	if !bytes.Contains(got, wantRows) {
+		t.Errorf("rows not encoded as %x in %x", wantRows, got)
+	}
+	// Results without stats end with a nil stats value
+	if got[0] != 0x84 || !bytes.HasSuffix(got, append([]byte("\xa5stats"), 0xc0)) {
+		t.Errorf("unexpected document framing: %x", got)
+	}
+}
+
+func TestTypedCell(t *testing.T) {
+	tests := []struct {
+		typ, cell string
+		want      interface{}
+	}{
+		{"int64", "42", int64(42)},
+		{"int64", "2.5", 2.5},
+		{"float64", "1e3", 1000.0},
+		{"boolean", "false", false},
+		{"time64ns", "2026-03-01 10:00:00.000000001 +0000 UTC", time.Date(2026, 3, 1, 10, 0, 0, 1, time.UTC)},
+		{"int64", "n/a", "n/a"},
+		{"int64", "", nil},
+		{"string", "", ""},
+		{"uint128", "abc", "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ+"/"+tt.cell, func(t *testing.T) {
+			if got := typedCell(tt.typ, tt.cell); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("typedCell(%q, %q) = %#v, want %#v", tt.typ, tt.cell, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"time"
+)
+
+func init() {
+	registerFormatter("html", htmlFormatter{})
+}
+
+// htmlFormatter renders a sortable HTML table for eyeballing results in a browser
+type htmlFormatter struct{}
+
+func (htmlFormatter) ContentType() string { return "text/html; charset=utf-8" }
+
+var htmlResult = template.Must(template.New("result").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Script}} – Pixie Data Service</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; margin: 1.5em; color: #222; }
+h1 { font-size: 1.2em; margin-bottom: 0.2em; }
+dl { display: flex; flex-wrap: wrap; gap: 0.3em 1.5em; margin: 0.5em 0 1em; font-size: 0.9em; color: #555; }
+dt { font-weight: 600; }
+dd { margin: 0 0 0 0.3em; }
+table { border-collapse: collapse; font-size: 0.85em; }
+th, td { border: 1px solid #ddd; padding: 0.25em 0.6em; text-align: left; white-space: nowrap; }
+th { background: #f4f4f4; cursor: pointer; position: sticky; top: 0; user-select: none; }
+th small { font-weight: normal; color: #888; }
+th[aria-sort=ascending]::after { content: " ▲"; }
+th[aria-sort=descending]::after { content: " ▼"; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+tr:nth-child(even) td { background: #fafafa; }
+</style>
+</head>
+<body>
+<h1>{{.Script}}</h1>
+<dl>
+<div><dt>Cluster</dt><dd>{{.Cluster}}</dd></div>
+{{- if .Table}}<div><dt>Table</dt><dd>{{.Table}}</dd></div>{{end}}
+<div><dt>Rows</dt><dd>{{len .Rows}}</dd></div>
+{{- with .Stats}}
+<div><dt>Execution</dt><dd>{{.Execution}}</dd></div>
+<div><dt>Compilation</dt><dd>{{.Compilation}}</dd></div>
+<div><dt>Records processed</dt><dd>{{.RecordsProcessed}}</dd></div>
+<div><dt>Bytes processed</dt><dd>{{.BytesProcessed}}</dd></div>
+{{- end}}
+</dl>
+<table>
+<thead><tr>{{range .Columns}}<th title="{{.Type}}{{with .SemanticType}} ({{.}}){{end}}">{{.Name}} <small>{{or .SemanticType .Type}}</small></th>{{end}}</tr></thead>
+<tbody>
+{{- range .Rows}}
+<tr>{{range $i, $cell := .}}<td{{if index $.Numeric $i}} class="num"{{end}}>{{$cell}}</td>{{end}}</tr>
+{{- end}}
+</tbody>
+</table>
+<script>
+document.querySelectorAll("th").forEach(function (th, col) {
+  th.addEventListener("click", function () {
+    var asc = th.getAttribute("aria-sort") !== "ascending";
+    document.querySelectorAll("th").forEach(function (h) { h.removeAttribute("aria-sort"); });
+    th.setAttribute("aria-sort", asc ? "ascending" : "descending");
+    var tbody = document.querySelector("tbody");
+    var rows = Array.from(tbody.rows);
+    rows.sort(function (a, b) {
+      var x = a.cells[col].textContent, y = b.cells[col].textContent;
+      var nx = parseFloat(x), ny = parseFloat(y);
+      var c = (!isNaN(nx) && !isNaN(ny)) ? nx - ny : x.localeCompare(y);
+      return asc ? c : -c;
+    });
+    rows.forEach(function (r) { tbody.appendChild(r); });
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+func (htmlFormatter) Format(res *queryResult) ([]byte, error) {
+	type stats struct {
+		Execution, Compilation time.Duration
+		RecordsProcessed       int64
+		BytesProcessed         string
+	}
+	data := struct {
+		Script, Cluster, Table string
+		Columns                []columnSchema
+		Numeric                []bool
+		Rows                   [][]string
+		Stats                  *stats
+	}{Script: res.script, Cluster: res.cluster, Table: res.table, Columns: res.Schema, Rows: res.Rows}
+	if data.Script == "" {
+		data.Script = "Query result"
+	}
+	for _, col := range res.Schema {
+		data.Numeric = append(data.Numeric, col.Type == "int64" || col.Type == "float64")
+	}
+	if s := res.Stats; s != nil {
+		data.Stats = &stats{
+			Execution:        s.ExecutionTime,
+			Compilation:      s.CompilationTime,
+			RecordsProcessed: s.RecordsProcessed,
+			BytesProcessed:   formatBytes(float64(s.BytesProcessed)),
+		}
+	}
+	var buf bytes.Buffer
+	if err := htmlResult.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
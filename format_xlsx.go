@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func init() {
+	registerFormatter("xlsx", xlsxFormatter{})
+}
+
+// xlsxFormatter renders the result as an Excel workbook with one worksheet per result table,
+// a bold header row and typed cells: numbers, booleans and timestamps in UTC
+type xlsxFormatter struct{}
+
+func (xlsxFormatter) ContentType() string {
+	return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+}
+
+// The static parts of the workbook. Style 1 is the bold header, style 2 timestamps.
+const (
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss.000"/></numFmts><fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts><fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills><borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders><cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs><cellXfs count="3"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/><xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/></cellXfs></styleSheet>`
+)
+
+// excelEpoch is day zero of Excel's 1900 date system, adjusted for its 1900 leap year bug
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// xlsxSheetChars replaces the characters Excel doesn't allow in worksheet names
+var xlsxSheetChars = strings.NewReplacer("[", "_", "]", "_", ":", "_", "*", "_", "?", "_", "/", "_", `\`, "_")
+
+// xlsxMaxSheetName is the longest worksheet name Excel accepts, in characters
+const xlsxMaxSheetName = 31
+
+// xlsxSheetNames makes the table names valid and unique worksheet names. Excel compares them
+// case-insensitively, so duplicates get a numbered suffix.
+func xlsxSheetNames(tables []*queryResult) []string {
+	names := make([]string, len(tables))
+	seen := make(map[string]bool)
+	for i, t := range tables {
+		base := xlsxSheetChars.Replace(t.table)
+		if base == "" {
+			base = "Result"
+		}
+		name := truncateRunes(base, xlsxMaxSheetName)
+		for n := 2; seen[strings.ToLower(name)]; n++ {
+			suffix := fmt.Sprintf(" (%d)", n)
+			name = truncateRunes(base, xlsxMaxSheetName-len(suffix)) + suffix
+		}
+		seen[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+// truncateRunes shortens s to at most n characters without splitting one
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+func (xlsxFormatter) Format(res *queryResult) ([]byte, error) {
+	tables := res.split()
+	names := xlsxSheetNames(tables)
+
+	var types, sheets, rels strings.Builder
+	types.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	rels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`)
+	for i, name := range names {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+		fmt.Fprintf(&sheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(name), n, n)
+	}
+	types.WriteString(`</Types>`)
+	rels.WriteString(`</Relationships>`)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", types.String()},
+		{"_rels/.rels", xlsxRels},
+		{"xl/_rels/workbook.xml.rels", rels.String()},
+		{"xl/styles.xml", xlsxStyles},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>` + sheets.String() + `</sheets></workbook>`},
+	}
+	for _, p := range parts {
+		f, err := zw.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(f, p.body)
+	}
+	for i, t := range tables {
+		f, err := zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return nil, err
+		}
+		if err := writeXLSXSheet(f, t); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeXLSXSheet writes the worksheet XML: the header row, then one row per result row
+func writeXLSXSheet(w io.Writer, res *queryResult) error {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	if len(res.Columns) > 0 {
+		// Freeze the header row
+		b.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	}
+	b.WriteString(`<sheetData><row r="1">`)
+	for c, name := range res.Columns {
+		fmt.Fprintf(&b, `<c r="%s1" t="inlineStr" s="1"><is><t>%s</t></is></c>`, xlsxColumn(c), xmlEscape(name))
+	}
+	b.WriteString(`</row>`)
+	for i, row := range res.Rows {
+		r := strconv.Itoa(i + 2)
+		b.WriteString(`<row r="` + r + `">`)
+		for c, cell := range row {
+			ref := xlsxColumn(c) + r
+			typ := ""
+			if c < len(res.Schema) {
+				typ = res.Schema[c].Type
+			}
+			b.WriteString(xlsxCell(ref, typ, cell))
+		}
+		b.WriteString(`</row>`)
+		// Flush periodically so large results don't build one huge string
+		if b.Len() > 1<<20 {
+			if _, err := io.WriteString(w, b.String()); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// xlsxCell renders one typed cell, falling back to text for values that don't parse
+func xlsxCell(ref, typ, cell string) string {
+	switch typ {
+	case "int64", "float64":
+		if v, err := strconv.ParseFloat(cell, 64); err == nil {
+			return `<c r="` + ref + `"><v>` + strconv.FormatFloat(v, 'f', -1, 64) + `</v></c>`
+		}
+	case "boolean":
+		if v, err := strconv.ParseBool(cell); err == nil {
+			n := "0"
+			if v {
+				n = "1"
+			}
+			return `<c r="` + ref + `" t="b"><v>` + n + `</v></c>`
+		}
+	case "time64ns":
+		if t, err := time.Parse(time64Layout, cell); err == nil {
+			days := float64(t.UTC().Sub(excelEpoch)) / float64(24*time.Hour)
+			return `<c r="` + ref + `" s="2"><v>` + strconv.FormatFloat(days, 'f', -1, 64) + `</v></c>`
+		}
+	}
+	return `<c r="` + ref + `" t="inlineStr"><is><t xml:space="preserve">` + xmlEscape(cell) + `</t></is></c>`
+}
+
+// xlsxColumn converts a zero-based column index to its letters: A, B, ..., Z, AA, ...
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"px.dev/pxapi"
+	"px.dev/pxapi/proto/vizierpb"
+	"px.dev/pxapi/types"
+)
+
+func TestXLSXSheetNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		tables []string
+		want   []string
+	}{
+		{"invalid characters", []string{"a/b:c"}, []string{"a_b_c"}},
+		{"unnamed table", []string{""}, []string{"Result"}},
+		{"long names are cut by character", []string{strings.Repeat("é", 40)}, []string{strings.Repeat("é", 31)}},
+		{"duplicates are numbered", []string{"output", "Output", "output"}, []string{"output", "Output (2)", "output (3)"}},
+		{"numbered names stay within the limit", []string{strings.Repeat("x", 40), strings.Repeat("x", 40)}, []string{strings.Repeat("x", 31), strings.Repeat("x", 27) + " (2)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tables []*queryResult
+			for _, name := range tt.tables {
+				tables = append(tables, &queryResult{table: name})
+			}
+			if got := xlsxSheetNames(tables); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("xlsxSheetNames() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// stringRecord builds a record of string cells for the columns of schema
+func stringRecord(schema []types.ColSchema, cells ...string) *types.Record {
+	r := &types.Record{}
+	for i, c := range cells {
+		v := types.NewStringValue(&schema[i])
+		v.ScanString(c)
+		r.Data = append(r.Data, v)
+	}
+	return r
+}
+
+func TestXLSXSheetPerTable(t *testing.T) {
+	pods := []types.ColSchema{{Name: "pod", Type: vizierpb.STRING}, {Name: "cpu", Type: vizierpb.STRING}}
+	services := []types.ColSchema{{Name: "service", Type: vizierpb.STRING}, {Name: "errors", Type: vizierpb.STRING}}
+	ctx := context.Background()
+
+	// Pixie announces every table before streaming their records interleaved
+	tp := &tablePrinter{}
+	podTable, _ := tp.AcceptTable(ctx, types.TableMetadata{Name: "pods", ColInfo: pods})
+	serviceTable, _ := tp.AcceptTable(ctx, types.TableMetadata{Name: "services", ColInfo: services})
+	for _, send := range []struct {
+		h     pxapi.TableRecordHandler
+		cells []string
+	}{
+		{podTable, []string{"a", "0.1"}},
+		{serviceTable, []string{"checkout", "3"}},
+		{podTable, []string{"b", "0.2"}},
+		{serviceTable, []string{"cart", "0"}},
+		{podTable, []string{"c", "0.3"}},
+	} {
+		schema := pods
+		if send.h == serviceTable {
+			schema = services
+		}
+		if err := send.h.HandleRecord(ctx, stringRecord(schema, send.cells...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := tp.result()
+	if want := [][]string{{"a", "0.1"}, {"b", "0.2"}, {"c", "0.3"}}; !reflect.DeepEqual(res.Columns, []string{"pod", "cpu"}) || !reflect.DeepEqual(res.Rows, want) {
+		t.Errorf("result = %v %v, want the pods table", res.Columns, res.Rows)
+	}
+	if len(res.OtherTables) != 1 || res.OtherTables[0].Name != "services" || len(res.OtherTables[0].Rows) != 2 {
+		t.Fatalf("other tables = %+v, want the services table", res.OtherTables)
+	}
+
+	payload, err := xlsxFormatter{}.Format(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(payload), int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(rc)
+		rc.Close()
+		parts[f.Name] = string(body)
+	}
+	for _, want := range []string{`name="pods" sheetId="1" r:id="rId1"`, `name="services" sheetId="2" r:id="rId2"`} {
+		if !strings.Contains(parts["xl/workbook.xml"], want) {
+			t.Errorf("workbook lacks %s", want)
+		}
+	}
+	for _, want := range []string{"worksheets/sheet1.xml", "worksheets/sheet2.xml"} {
+		if !strings.Contains(parts["xl/_rels/workbook.xml.rels"], want) || !strings.Contains(parts["[Content_Types].xml"], want) {
+			t.Errorf("rels or content types lack %s", want)
+		}
+	}
+	if s := parts["xl/worksheets/sheet1.xml"]; !strings.Contains(s, ">pod<") || strings.Contains(s, "checkout") || !strings.Contains(s, `r="A4"`) {
+		t.Errorf("first sheet doesn't hold just the first table: %s", s)
+	}
+	if s := parts["xl/worksheets/sheet2.xml"]; !strings.Contains(s, ">service<") || !strings.Contains(s, "checkout") || strings.Contains(s, `r="A4"`) {
+		t.Errorf("second sheet doesn't hold just the second table: %s", s)
+	}
+}
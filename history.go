@@ -0,0 +1,336 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// HistoryConfig controls the query history archive
+type HistoryConfig struct {
+	// Path of the SQLite database; history is disabled when empty
+	Path string `json:"path,omitempty"`
+	// StoreResults also archives the result payload of successful queries
+	StoreResults bool `json:"store_results,omitempty"`
+	// RetentionDays deletes entries older than this many days (0 keeps them forever)
+	RetentionDays int `json:"retention_days,omitempty"`
+	// ResultRetentionDays drops archived payloads older than this many days but keeps the entry
+	ResultRetentionDays int `json:"result_retention_days,omitempty"`
+	// MaxEntries keeps at most this many of the newest entries (0 means unlimited)
+	MaxEntries int `json:"max_entries,omitempty"`
+	// CompactionInterval is how often the retention policy runs (default 1h)
+	CompactionInterval string `json:"compaction_interval,omitempty"`
+}
+
+// historyEntry is one executed query
+type historyEntry struct {
+	ID         int64             `json:"id"`
+	StartedAt  time.Time         `json:"started_at"`
+	Script     string            `json:"script"`
+	Params     map[string]string `json:"params"`
+	Cluster    string            `json:"cluster"`
+	Caller     string            `json:"caller"`
+	DurationMs int64             `json:"duration_ms"`
+	RowCount   int               `json:"row_count"`
+	Error      string            `json:"error,omitempty"`
+	HasResult  bool              `json:"has_result"`
+}
+
+// historyStore persists executed queries in SQLite. Scripts, parameters and results are
+// encrypted when a key is configured.
+type historyStore struct {
+	db     *sql.DB
+	cfg    HistoryConfig
+	sealer *sealer
+}
+
+// history is nil when the archive is disabled
+var history *historyStore
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS queries (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	started_at  INTEGER NOT NULL,
+	script      TEXT    NOT NULL,
+	params      TEXT    NOT NULL DEFAULT '{}',
+	cluster     TEXT    NOT NULL,
+	caller      TEXT    NOT NULL,
+	duration_ms INTEGER NOT NULL,
+	row_count   INTEGER NOT NULL,
+	error       TEXT    NOT NULL DEFAULT '',
+	result      BLOB
+);
+CREATE INDEX IF NOT EXISTS queries_started_at ON queries(started_at);
+`
+
+// openHistory opens (and creates if needed) the history database
+func openHistory(cfg HistoryConfig, s *sealer) (*historyStore, error) {
+	db, err := sql.Open("sqlite", cfg.Path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("could not open history database: %w", err)
+	}
+	// SQLite allows a single writer; serialize access instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not initialize history database: %w", err)
+	}
+	return &historyStore{db: db, cfg: cfg, sealer: s}, nil
+}
+
+// save archives an entry and returns its ID, or 0 if it wasn't saved; result may be nil
+func (h *historyStore) save(e *historyEntry, result []byte) int64 {
+	if h == nil {
+		return 0
+	}
+	if !h.cfg.StoreResults {
+		result = nil
+	}
+	params, _ := json.Marshal(e.Params)
+	if e.Params == nil {
+		params = []byte("{}")
+	}
+	res, err := h.db.Exec(
+		`INSERT INTO queries (started_at, script, params, cluster, caller, duration_ms, row_count, error, result)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.StartedAt.UnixMilli(), h.sealer.sealString(e.Script, "script"), h.sealer.sealString(string(params), "params"),
+		e.Cluster, e.Caller, e.DurationMs, e.RowCount, e.Error, h.sealer.seal(result, "result"))
+	if err != nil {
+		log.Printf("ERROR: Failed to save query history: %v\n", err)
+		return 0
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// amend replaces the archived results of res, e.g. after columns were added to it, in the
+// entries of the executions it came from
+func (h *historyStore) amend(res *queryResult) {
+	if h == nil {
+		return
+	}
+	for i, part := range res.archived {
+		end := len(res.Rows)
+		if i+1 < len(res.archived) {
+			end = res.archived[i+1].start
+		}
+		// The archive keeps its stats and other tables; only the rows of the first change
+		var archived queryResult
+		payload, err := h.result(part.id, "")
+		if err == nil {
+			err = json.Unmarshal(payload, &archived)
+		}
+		if err == nil {
+			archived.Columns, archived.Schema, archived.Rows = res.Columns, res.Schema, res.Rows[part.start:end]
+			payload, err = encodeJSON(&archived)
+		}
+		if err == nil {
+			_, err = h.db.Exec(`UPDATE queries SET result = ? WHERE id = ? AND result IS NOT NULL`, h.sealer.seal(payload, "result"), part.id)
+		}
+		if err != nil {
+			log.Printf("ERROR: Failed to update archived result of query %d: %v\n", part.id, err)
+		}
+	}
+}
+
+// list returns the newest entries of a tenant ("" for all tenants), optionally only those
+// older than beforeID
+func (h *historyStore) list(limit int, beforeID int64, tenant string) ([]historyEntry, error) {
+	query := `SELECT id, started_at, script, params, cluster, caller, duration_ms, row_count, error, result IS NOT NULL
+		FROM queries WHERE 1 = 1`
+	args := []interface{}{}
+	if beforeID > 0 {
+		query += ` AND id < ?`
+		args = append(args, beforeID)
+	}
+	if tenant != "" {
+		query += ` AND caller = ?`
+		args = append(args, tenant)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []historyEntry{}
+	for rows.Next() {
+		var e historyEntry
+		var startedAt int64
+		var params string
+		if err := rows.Scan(&e.ID, &startedAt, &e.Script, &params, &e.Cluster, &e.Caller,
+			&e.DurationMs, &e.RowCount, &e.Error, &e.HasResult); err != nil {
+			return nil, err
+		}
+		e.StartedAt = time.UnixMilli(startedAt).UTC()
+		if e.Script, err = h.sealer.openString(e.Script, "script"); err != nil {
+			return nil, fmt.Errorf("history entry %d: %w", e.ID, err)
+		}
+		if params, err = h.sealer.openString(params, "params"); err != nil {
+			return nil, fmt.Errorf("history entry %d: %w", e.ID, err)
+		}
+		json.Unmarshal([]byte(params), &e.Params)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// errNoResult is returned when an entry does not exist, belongs to another tenant or has no
+// archived payload
+var errNoResult = errors.New("no archived result")
+
+// result returns the archived payload of an entry of a tenant ("" for any tenant)
+func (h *historyStore) result(id int64, tenant string) ([]byte, error) {
+	var result []byte
+	err := h.db.QueryRow(`SELECT result FROM queries WHERE id = ? AND (? = '' OR caller = ?)`, id, tenant, tenant).Scan(&result)
+	if err == sql.ErrNoRows || (err == nil && result == nil) {
+		return nil, errNoResult
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h.sealer.open(result, "result")
+}
+
+// compact applies the retention policy and, if it dropped anything, reclaims free space
+func (h *historyStore) compact() error {
+	now := time.Now()
+	var dropped int64
+	exec := func(query string, args ...interface{}) error {
+		res, err := h.db.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		dropped += n
+		return nil
+	}
+	if h.cfg.RetentionDays > 0 {
+		cutoff := now.AddDate(0, 0, -h.cfg.RetentionDays).UnixMilli()
+		if err := exec(`DELETE FROM queries WHERE started_at < ?`, cutoff); err != nil {
+			return err
+		}
+	}
+	if h.cfg.ResultRetentionDays > 0 {
+		cutoff := now.AddDate(0, 0, -h.cfg.ResultRetentionDays).UnixMilli()
+		if err := exec(`UPDATE queries SET result = NULL WHERE started_at < ? AND result IS NOT NULL`, cutoff); err != nil {
+			return err
+		}
+	}
+	if h.cfg.MaxEntries > 0 {
+		if err := exec(`DELETE FROM queries WHERE id NOT IN (SELECT id FROM queries ORDER BY id DESC LIMIT ?)`, h.cfg.MaxEntries); err != nil {
+			return err
+		}
+	}
+	// VACUUM rewrites the whole database, so it only runs when there is space to reclaim
+	if dropped == 0 {
+		return nil
+	}
+	_, err := h.db.Exec(`VACUUM`)
+	return err
+}
+
+// runCompaction applies the retention policy periodically
+func (h *historyStore) runCompaction() {
+	interval := time.Hour
+	if h.cfg.CompactionInterval != "" {
+		if d, err := time.ParseDuration(h.cfg.CompactionInterval); err == nil && d > 0 {
+			interval = d
+		} else {
+			log.Printf("ERROR: Invalid history compaction_interval %q, using %v\n", h.cfg.CompactionInterval, interval)
+		}
+	}
+	for {
+		if err := h.compact(); err != nil {
+			log.Printf("ERROR: History compaction failed: %v\n", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// historyScope returns the tenant whose history the caller may see, or "" for all tenants.
+// Token holders only see their own tenant's queries unless they hold the admin role.
+func historyScope(r *http.Request) string {
+	if id := identityFrom(r.Context()); id == nil || id.hasRole("admin") {
+		return ""
+	}
+	return tenantFromRequest(r)
+}
+
+// historyHandler lists executed queries, newest first
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if history == nil {
+		http.Error(w, "Query history is not enabled", http.StatusNotFound)
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid 'limit' parameter", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, 500)
+	}
+	var beforeID int64
+	if v := r.URL.Query().Get("before_id"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid 'before_id' parameter", http.StatusBadRequest)
+			return
+		}
+		beforeID = n
+	}
+
+	entries, err := history.list(limit, beforeID, historyScope(r))
+	if err != nil {
+		log.Printf("ERROR: Failed to list query history: %v\n", err)
+		http.Error(w, "Failed to read query history", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"entries": entries})
+}
+
+// historyResultHandler serves the archived result payload of a query
+func historyResultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if history == nil {
+		http.Error(w, "Query history is not enabled", http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid history id", http.StatusBadRequest)
+		return
+	}
+
+	result, err := history.result(id, historyScope(r))
+	if errors.Is(err, errNoResult) {
+		http.Error(w, "No archived result for this query", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to read archived result %d: %v\n", id, err)
+		http.Error(w, "Failed to read archived result", http.StatusInternalServerError)
+		return
+	}
+	writeCachable(w, r, result, etagFor(result), "application/json")
+}
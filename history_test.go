@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryTenantScope(t *testing.T) {
+	h, err := openHistory(HistoryConfig{Path: filepath.Join(t.TempDir(), "history.db"), StoreResults: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.db.Close()
+	h.save(&historyEntry{StartedAt: time.Now(), Script: "a", Caller: "team-a"}, []byte(`{"rows":[]}`))
+	h.save(&historyEntry{StartedAt: time.Now(), Script: "b", Caller: "team-b"}, []byte(`{"rows":[]}`))
+
+	tests := []struct {
+		name    string
+		id      *identity
+		entries int
+		// readable is whether the caller may download entry 2, owned by team-b
+		readable bool
+	}{
+		{"tokens disabled", nil, 2, true},
+		{"admin", &identity{Tenant: "sre", Roles: []string{"admin"}}, 2, true},
+		{"owner", &identity{Tenant: "team-b"}, 1, true},
+		{"other tenant", &identity{Tenant: "team-a"}, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/history", nil)
+			if tt.id != nil {
+				r = r.WithContext(context.WithValue(r.Context(), identityKey{}, tt.id))
+			}
+			entries, err := h.list(10, 0, historyScope(r))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.entries {
+				t.Errorf("listed %d entries, want %d", len(entries), tt.entries)
+			}
+			_, err = h.result(2, historyScope(r))
+			if readable := !errors.Is(err, errNoResult); readable != tt.readable || (readable && err != nil) {
+				t.Errorf("result(2) error = %v, want readable %v", err, tt.readable)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"px.dev/pxapi"
+)
+
+// KeepaliveConfig keeps the pooled connections to each cluster warm, so interactive
+// requests after idle periods don't pay for cloud authentication and dialing Vizier
+type KeepaliveConfig struct {
+	// Interval is how long a cluster may go without a successful query before it is pinged,
+	// e.g. "1m"; unset disables keepalives
+	Interval string `json:"interval,omitempty"`
+	// Jitter spreads pings by up to this fraction of the interval (default 0.2), so clusters
+	// aren't all pinged at once
+	Jitter float64 `json:"jitter,omitempty"`
+	// Cloud pings by asking the Pixie cloud about the cluster instead of running a one-row
+	// script; cheaper, but it leaves the connection to Vizier cold
+	Cloud bool `json:"cloud,omitempty"`
+}
+
+const (
+	defaultKeepaliveJitter = 0.2
+	// keepaliveTick is how often the keepalive loop re-reads the config and pings due clusters
+	keepaliveTick = time.Second
+	// keepaliveScript is the script pings run; it reads a single row
+	keepaliveScript = "import px\npx.display(px.DataFrame(table='process_stats', start_time='-10s').head(1), 'keepalive')\n"
+)
+
+// keepaliver pings clusters that have been idle and counts the outcomes
+type keepaliver struct {
+	mu sync.Mutex
+	// next is when each cluster ID is due for a ping
+	next map[string]time.Time
+	// pinging holds the cluster IDs with a ping in flight
+	pinging map[string]bool
+	ok, bad uint64
+}
+
+var keepalive = &keepaliver{next: make(map[string]time.Time), pinging: make(map[string]bool)}
+
+// configuredClusters returns the IDs of px_cluster_id and the registered clusters by name,
+// "default" for px_cluster_id. Clusters without an ID are left out.
+func configuredClusters(config *Config) map[string]string {
+	ids := make(map[string]string)
+	if config.PXClusterID != "" {
+		ids["default"] = config.PXClusterID
+	}
+	for name, cluster := range config.Clusters {
+		if cluster.ClusterID != "" {
+			ids[name] = cluster.ClusterID
+		}
+	}
+	return ids
+}
+
+// ping runs keepaliveScript on a cluster through the pool, or with cloud only asks the Pixie
+// cloud about it. A rejected client is dropped from the pool so the next request
+// authenticates from scratch.
+func ping(ctx context.Context, config *Config, clusterID string, cloud bool) error {
+	ctx, cancel := context.WithTimeout(ctx, clusterStatusTimeout)
+	defer cancel()
+	if cloud {
+		info, err := pool.vizierInfo(ctx, config, clusterID)
+		if err != nil {
+			return err
+		}
+		_, err = pool.get(ctx, config, clusterID)
+		if err == nil && info.Status != pxapi.VizierStatusHealthy {
+			err = fmt.Errorf("vizier is %s", info.Status)
+		}
+		return err
+	}
+	vz, err := pool.get(ctx, config, clusterID)
+	if err != nil {
+		return err
+	}
+	rs, err := vz.ExecuteScript(ctx, keepaliveScript, &tablePrinter{maxBytes: 1 << 20})
+	if err == nil {
+		err = rs.Stream()
+		rs.Close()
+	}
+	if isAuthError(err) {
+		pool.refresh(config, clusterID)
+	}
+	// Pings execute like any other query, so they tell about the cluster's health
+	pool.observe(clusterID, err)
+	return err
+}
+
+// warmUp connects to every configured cluster so the first requests find pooled clients
+func warmUp(config *Config) {
+	var wg sync.WaitGroup
+	for name, id := range configuredClusters(config) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			began := time.Now()
+			if err := ping(context.Background(), config, id, config.Keepalive.Cloud); err != nil {
+				log.Printf("ERROR: Warm-up of cluster %s (%s) failed: %v\n", name, id, err)
+				return
+			}
+			log.Printf("Cluster %s (%s) warmed up in %v\n", name, id, time.Since(began).Round(time.Millisecond))
+		}()
+	}
+	wg.Wait()
+}
+
+// run pings idle clusters until ctx is done. The config is re-read on every tick, so
+// keepalives can be enabled and clusters added without a restart.
+func (k *keepaliver) run(ctx context.Context) {
+	t := time.NewTicker(keepaliveTick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			config, err := loadConfig("config.json")
+			if err != nil || config.Keepalive.Interval == "" {
+				continue
+			}
+			interval, err := configDuration("keepalive.interval", config.Keepalive.Interval, 0)
+			if err != nil {
+				continue
+			}
+			k.pingDue(ctx, config, interval, now)
+		}
+	}
+}
+
+// pingDue pings the clusters that haven't had a successful query for an interval
+func (k *keepaliver) pingDue(ctx context.Context, config *Config, interval time.Duration, now time.Time) {
+	jitter := config.Keepalive.Jitter
+	if jitter <= 0 || jitter >= 1 {
+		jitter = defaultKeepaliveJitter
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for name, id := range configuredClusters(config) {
+		if k.pinging[id] || now.Before(k.next[id]) {
+			continue
+		}
+		spread := time.Duration(float64(interval) * jitter * (2*rand.Float64() - 1))
+		// Requests keep the connection warm too; only ping once they stopped
+		if health, _ := pool.clusterState(id); now.Sub(health.LastSuccess) < interval {
+			k.next[id] = health.LastSuccess.Add(interval + spread)
+			continue
+		}
+		k.next[id] = now.Add(interval + spread)
+		k.pinging[id] = true
+		go func() {
+			err := ping(ctx, config, id, config.Keepalive.Cloud)
+			if err != nil {
+				log.Printf("ERROR: Keepalive of cluster %s (%s) failed: %v\n", name, id, err)
+			}
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			delete(k.pinging, id)
+			if err != nil {
+				k.bad++
+			} else {
+				k.ok++
+			}
+		}()
+	}
+}
+
+// writeMetrics appends the keepalive metrics in the Prometheus text exposition format
+func (k *keepaliver) writeMetrics(b *strings.Builder) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	b.WriteString("# HELP pixie_keepalive_pings_total Keepalive pings of idle clusters, by result.\n")
+	b.WriteString("# TYPE pixie_keepalive_pings_total counter\n")
+	fmt.Fprintf(b, "pixie_keepalive_pings_total{result=\"ok\"} %d\n", k.ok)
+	fmt.Fprintf(b, "pixie_keepalive_pings_total{result=\"error\"} %d\n", k.bad)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestConfiguredClusters(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		want   map[string]string
+	}{
+		{"default only", &Config{PXClusterID: "c1"}, map[string]string{"default": "c1"}},
+		{
+			"registered clusters",
+			&Config{PXClusterID: "c1", Clusters: map[string]ClusterConfig{"prod": {ClusterID: "c2"}}},
+			map[string]string{"default": "c1", "prod": "c2"},
+		},
+		{
+			"no px_cluster_id",
+			&Config{Clusters: map[string]ClusterConfig{"prod": {ClusterID: "c2"}}},
+			map[string]string{"prod": "c2"},
+		},
+		{"cluster without an ID", &Config{Clusters: map[string]ClusterConfig{"staging": {}}}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := configuredClusters(tt.config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("configuredClusters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPingRunsScript(t *testing.T) {
+	saved := pool
+	defer func() { pool = saved }()
+
+	tests := []struct {
+		name      string
+		cloud     bool
+		wantQuery bool
+	}{
+		{"default", false, true},
+		{"cloud", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool = newTestPool()
+			// The test cloud is unreachable, so the ping fails whichever way it goes
+			if err := ping(context.Background(), testPoolConfig, "cluster-a", tt.cloud); err == nil {
+				t.Fatal("ping of an unreachable cluster succeeded")
+			}
+			// Only executed scripts are observed as queries against the cluster
+			health, _ := pool.clusterState("cluster-a")
+			if ran := !health.LastError.IsZero(); ran != tt.wantQuery {
+				t.Errorf("ping ran the keepalive script: %v, want %v", ran, tt.wantQuery)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultScriptDir = "scripts"
+
+// scriptName restricts library names so they can't escape the script directory
+var scriptName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// scriptManifest holds the guardrails of a library script, read from an optional
+// <name>.yaml, <name>.yml or <name>.json file next to <name>.pxl
+type scriptManifest struct {
+	Description string `json:"description,omitempty" yaml:"description"`
+	// Params declares the parameters the script accepts; others are rejected
+	Params map[string]paramSpec `json:"params,omitempty" yaml:"params"`
+	// DefaultRange is the time range used when the request gives none, e.g. 15m
+	DefaultRange string `json:"default_range,omitempty" yaml:"default_range"`
+	// MaxRange bounds the length of the requested time range
+	MaxRange string `json:"max_range,omitempty" yaml:"max_range"`
+	// Timeout and MaxTimeout override exec_timeout and max_exec_timeout
+	Timeout    string `json:"timeout,omitempty" yaml:"timeout"`
+	MaxTimeout string `json:"max_timeout,omitempty" yaml:"max_timeout"`
+	// CacheTTL overrides the cache ttl; "0s" disables caching for the script
+	CacheTTL string `json:"cache_ttl,omitempty" yaml:"cache_ttl"`
+	// Clusters lists the cluster names the script may run on ("" is the default cluster)
+	Clusters []string `json:"clusters,omitempty" yaml:"clusters"`
+	// Role is required of the caller, as granted by its API token
+	Role string `json:"role,omitempty" yaml:"role"`
+	// SHA256 is the hex checksum of the .pxl file, checked before every run
+	SHA256 string `json:"sha256,omitempty" yaml:"sha256"`
+	// Signature is a base64 Ed25519 signature of the .pxl file by one of lockdown.public_keys
+	Signature string `json:"signature,omitempty" yaml:"signature"`
+}
+
+// paramSpec declares one script parameter
+type paramSpec struct {
+	Description string `json:"description,omitempty" yaml:"description"`
+	Default     string `json:"default,omitempty" yaml:"default"`
+	Required    bool   `json:"required,omitempty" yaml:"required"`
+	// Pattern, if set, is a regular expression the whole value must match
+	Pattern string `json:"pattern,omitempty" yaml:"pattern"`
+}
+
+// libraryScript is a PXL script from the library along with its manifest
+type libraryScript struct {
+	Name     string          `json:"name"`
+	Source   string          `json:"source,omitempty"`
+	Manifest *scriptManifest `json:"manifest,omitempty"`
+}
+
+// scriptDir returns the directory of the script library
+func (c *Config) scriptDir() string {
+	if c.ScriptDir == "" {
+		return defaultScriptDir
+	}
+	return c.ScriptDir
+}
+
+// loadScript reads a library script and its manifest
+func loadScript(dir, name string) (*libraryScript, error) {
+	if !scriptName.MatchString(name) {
+		return nil, &scriptError{http.StatusBadRequest, "Invalid script name", fmt.Errorf("%q may only contain letters, digits, '_', '-' and '.'", name)}
+	}
+	source, err := readPXLScript(filepath.Join(dir, name+".pxl"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &scriptError{http.StatusNotFound, "Unknown script", fmt.Errorf("no script %q in the library", name)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &libraryScript{Name: name, Source: source}
+	for _, ext := range []string{".yaml", ".yml", ".json"} {
+		data, err := os.ReadFile(filepath.Join(dir, name+ext))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read manifest of %s: %w", name, err)
+		}
+		var m scriptManifest
+		if ext == ".json" {
+			err = json.Unmarshal(data, &m)
+		} else {
+			err = yaml.Unmarshal(data, &m)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest %s%s: %w", name, ext, err)
+		}
+		s.Manifest = &m
+		break
+	}
+	return s, nil
+}
+
+// listScripts returns the names of all scripts in the library
+func listScripts(dir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.pxl"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(matches))
+	for _, m := range matches {
+		if name := strings.TrimSuffix(filepath.Base(m), ".pxl"); scriptName.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// enforce checks an execution by caller against the manifest and fills in its defaults.
+// timeoutSet tells whether opts.Timeout was requested explicitly.
+func (m *scriptManifest) enforce(caller *identity, timeoutSet bool, cluster string, opts *execOptions) error {
+	if m.Role != "" && !caller.hasRole(m.Role) {
+		return &scriptError{http.StatusForbidden, "Forbidden", fmt.Errorf("script requires the %q role", m.Role)}
+	}
+	if len(m.Clusters) > 0 && !slices.Contains(m.Clusters, cluster) {
+		return &scriptError{http.StatusForbidden, "Forbidden", fmt.Errorf("script may not run on cluster %q", cluster)}
+	}
+
+	// Parameters: reject undeclared ones, apply defaults and check the declared ones
+	params := make(map[string]string, len(m.Params))
+	for name, value := range opts.Params {
+		if _, ok := m.Params[name]; !ok {
+			return &scriptError{http.StatusBadRequest, "Invalid parameter", fmt.Errorf("script does not accept parameter %q", name)}
+		}
+		params[name] = value
+	}
+	for name, spec := range m.Params {
+		value, ok := params[name]
+		if !ok {
+			if spec.Required {
+				return &scriptError{http.StatusBadRequest, "Missing parameter", fmt.Errorf("parameter %q is required", name)}
+			}
+			if spec.Default == "" {
+				continue
+			}
+			value = spec.Default
+			params[name] = value
+		}
+		if spec.Pattern != "" {
+			re, err := regexp.Compile("^(?:" + spec.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("invalid pattern for parameter %q in manifest: %w", name, err)
+			}
+			if !re.MatchString(value) {
+				return &scriptError{http.StatusBadRequest, "Invalid parameter", fmt.Errorf("value of %q does not match %s", name, spec.Pattern)}
+			}
+		}
+	}
+	opts.Params = params
+
+	// Time range
+	if opts.Range == (timeRange{}) && m.DefaultRange != "" {
+		opts.Range = timeRange{Start: "-" + m.DefaultRange}
+	}
+	if m.MaxRange != "" {
+		maxRange, err := configDuration("max_range", m.MaxRange, 0)
+		if err != nil {
+			return err
+		}
+		if opts.Range == (timeRange{}) {
+			return &scriptError{http.StatusBadRequest, "Invalid time range", fmt.Errorf("script requires a time range of at most %v", maxRange)}
+		}
+		start, end, err := opts.Range.resolve(time.Now())
+		if err != nil {
+			return &scriptError{http.StatusBadRequest, "Invalid time range", err}
+		}
+		if end.Sub(start) > maxRange {
+			return &scriptError{http.StatusBadRequest, "Invalid time range", fmt.Errorf("%v exceeds the maximum of %v for this script", end.Sub(start), maxRange)}
+		}
+	}
+
+	// Timeouts
+	if !timeoutSet && m.Timeout != "" {
+		timeout, err := configDuration("timeout", m.Timeout, 0)
+		if err != nil {
+			return err
+		}
+		opts.Timeout = timeout
+	}
+	if m.MaxTimeout != "" {
+		maxTimeout, err := configDuration("max_timeout", m.MaxTimeout, 0)
+		if err != nil {
+			return err
+		}
+		if timeoutSet && opts.Timeout > maxTimeout {
+			return &scriptError{http.StatusBadRequest, "Invalid 'timeout' parameter", fmt.Errorf("%v exceeds the maximum of %v for this script", opts.Timeout, maxTimeout)}
+		}
+		opts.Timeout = min(opts.Timeout, maxTimeout)
+	}
+
+	if m.CacheTTL != "" {
+		if _, err := time.ParseDuration(m.CacheTTL); err != nil {
+			return fmt.Errorf("invalid cache_ttl %q in manifest", m.CacheTTL)
+		}
+		opts.CacheTTL = m.CacheTTL
+	}
+	return nil
+}
+
+// scriptsHandler lists the script library
+func scriptsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	config, err := requestConfig(r)
+	if err != nil {
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+	names, err := listScripts(config.scriptDir())
+	if err != nil {
+		http.Error(w, "Failed to list scripts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	scripts := []libraryScript{}
+	for _, name := range names {
+		s, err := loadScript(config.scriptDir(), name)
+		if err != nil {
+			log.Printf("ERROR: Skipping library script %s: %v\n", name, err)
+			continue
+		}
+		s.Source = ""
+		scripts = append(scripts, *s)
+	}
+	writeJSON(w, map[string]interface{}{"scripts": scripts})
+}
+
+// scriptHandler returns a library script with its manifest
+func scriptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	config, err := requestConfig(r)
+	if err != nil {
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+	s, err := loadScript(config.scriptDir(), r.PathValue("name"))
+	if err != nil {
+		writeScriptError(w, err)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// runScriptHandler executes a library script under the guardrails of its manifest
+func runScriptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Params  requestParams `json:"params"`
+		Cluster string        `json:"cluster"`
+	}
+	// The body is optional for scripts without parameters
+	if err := decodeBody(r, &req, true); err != nil {
+		writeScriptError(w, err)
+		return
+	}
+
+	config, err := requestConfig(r)
+	if err != nil {
+		log.Printf("ERROR: Failed to load config: %v\n", err)
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+	s, err := loadScript(config.scriptDir(), r.PathValue("name"))
+	if err != nil {
+		writeScriptError(w, err)
+		return
+	}
+	if err := config.verifyScript(s); err != nil {
+		writeScriptError(w, err)
+		return
+	}
+	opts, err := requestOptions(r, config)
+	if err != nil {
+		writeScriptError(w, err)
+		return
+	}
+	if err := config.checkParams(req.Params); err != nil {
+		writeScriptError(w, err)
+		return
+	}
+	opts.Params, opts.Name = req.Params, s.Name
+	config.applyDefaults(req.Cluster, s.Name, s.Source, s.Manifest, &opts)
+	if s.Manifest != nil {
+		if err := s.Manifest.enforce(identityFrom(r.Context()), r.URL.Query().Get("timeout") != "", req.Cluster, &opts); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+	}
+
+	res, err := executeCached(r, config, req.Cluster, s.Source, opts)
+	if err != nil {
+		writeScriptError(w, err)
+		return
+	}
+	if res.cache != "" {
+		w.Header().Set("X-Cache", res.cache)
+	}
+	setCostHeaders(w, res.estimate)
+	writeCachable(w, r, res.payload, res.etag, res.contentType)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Limits guards the service against oversized requests and responses. Zero values use
+// the defaults, negative values disable a limit.
+type Limits struct {
+	// MaxBodyBytes bounds request bodies on the query endpoints (default 1 MiB)
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	// MaxScriptBytes bounds the size of a submitted script (default 64 KiB)
+	MaxScriptBytes int64 `json:"max_script_bytes,omitempty"`
+	// MaxParams bounds the number of parameters of a script execution (default 32)
+	MaxParams int64 `json:"max_params,omitempty"`
+	// MaxParamBytes bounds the length of a single parameter value (default 1 KiB)
+	MaxParamBytes int64 `json:"max_param_bytes,omitempty"`
+	// MaxResponseBytes bounds the encoded size of a single result (default 128 MiB)
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+	// MaxBatchBytes bounds the encoded results of all queries of a batch together
+	// (default 256 MiB)
+	MaxBatchBytes int64 `json:"max_batch_bytes,omitempty"`
+}
+
+const (
+	defaultMaxBodyBytes     = 1 << 20
+	defaultMaxScriptBytes   = 64 << 10
+	defaultMaxParams        = 32
+	defaultMaxParamBytes    = 1 << 10
+	defaultMaxResponseBytes = 128 << 20
+	defaultMaxBatchBytes    = 256 << 20
+)
+
+// limitValue resolves a configured limit, returning 0 when it is disabled
+func limitValue(v, def int64) int64 {
+	switch {
+	case v < 0:
+		return 0
+	case v == 0:
+		return def
+	}
+	return v
+}
+
+// limitError describes a value that exceeded a configured limit
+type limitError struct {
+	what        string
+	size, limit int64
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%s %d exceeds the limit of %d", e.what, e.size, e.limit)
+}
+
+// checkLimit returns a scriptError with the given status if size is over limit
+func checkLimit(status int, msg, what string, size, limit int64) error {
+	if limit > 0 && size > limit {
+		return &scriptError{status, msg, &limitError{what, size, limit}}
+	}
+	return nil
+}
+
+// checkScript rejects scripts larger than max_script_bytes
+func (c *Config) checkScript(script string) error {
+	return checkLimit(http.StatusRequestEntityTooLarge, "Script too large", "script size in bytes",
+		int64(len(script)), limitValue(c.Limits.MaxScriptBytes, defaultMaxScriptBytes))
+}
+
+// checkParams rejects too many or too long parameters
+func (c *Config) checkParams(params map[string]string) error {
+	if err := checkLimit(http.StatusUnprocessableEntity, "Too many parameters", "parameter count",
+		int64(len(params)), limitValue(c.Limits.MaxParams, defaultMaxParams)); err != nil {
+		return err
+	}
+	max := limitValue(c.Limits.MaxParamBytes, defaultMaxParamBytes)
+	for name, value := range params {
+		if err := checkLimit(http.StatusUnprocessableEntity, "Parameter too long", fmt.Sprintf("length of parameter %q", name),
+			int64(len(value)), max); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkResponse rejects encoded results larger than max_response_bytes
+func (c *Config) checkResponse(payload []byte) error {
+	return checkLimit(http.StatusRequestEntityTooLarge, "Response too large", "encoded result size in bytes",
+		int64(len(payload)), limitValue(c.Limits.MaxResponseBytes, defaultMaxResponseBytes))
+}
+
+// withBodyLimit rejects request bodies over max_body_bytes with 413 before they reach
+// the handler
+func withBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, err := requestConfig(r)
+		if err != nil {
+			writeErrorJSON(w, http.StatusInternalServerError, "Failed to load configuration")
+			return
+		}
+		max := limitValue(config.Limits.MaxBodyBytes, defaultMaxBodyBytes)
+		if max == 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tooLarge := func(size int64) {
+			writeScriptError(w, checkLimit(http.StatusRequestEntityTooLarge, "Request body too large", "body size in bytes", size, max))
+		}
+		if r.ContentLength > max {
+			tooLarge(r.ContentLength)
+			return
+		}
+		// Bodies without a Content-Length are buffered up to the limit
+		body, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+		if err != nil {
+			writeErrorJSON(w, http.StatusBadRequest, "Failed to read request body")
+			return
+		}
+		if int64(len(body)) > max {
+			tooLarge(int64(len(body)))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
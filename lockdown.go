@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// LockdownConfig restricts what the service will execute
+type LockdownConfig struct {
+	// Enabled disables the endpoints that accept arbitrary PXL, leaving only the script library
+	Enabled bool `json:"enabled,omitempty"`
+	// RequireChecksum only runs library scripts whose manifest carries a matching sha256
+	RequireChecksum bool `json:"require_checksum,omitempty"`
+	// PublicKeys are base64 Ed25519 public keys; when set, library scripts only run with a
+	// manifest signature by one of them
+	PublicKeys []string `json:"public_keys,omitempty"`
+}
+
+// errLockedDown is returned by endpoints that accept arbitrary PXL while lockdown is enabled
+var errLockedDown = errors.New("arbitrary scripts are disabled, run a library script with POST /scripts/{name}/run")
+
+// denyArbitraryScripts writes a 403 and returns true if lockdown mode is enabled
+func denyArbitraryScripts(w http.ResponseWriter, config *Config) bool {
+	if !config.Lockdown.Enabled {
+		return false
+	}
+	writeErrorJSON(w, http.StatusForbidden, "Lockdown mode: "+errLockedDown.Error())
+	return true
+}
+
+// verifyScript checks a library script against the checksum and signature in its manifest.
+// A checksum that is present is always checked; lockdown settings decide whether one is required.
+func (c *Config) verifyScript(s *libraryScript) error {
+	var m scriptManifest
+	if s.Manifest != nil {
+		m = *s.Manifest
+	}
+	if c.Lockdown.Enabled {
+		if err := m.checkLockedParams(s); err != nil {
+			return err
+		}
+	}
+	if m.SHA256 != "" {
+		sum := sha256.Sum256([]byte(s.Source))
+		if !strings.EqualFold(m.SHA256, hex.EncodeToString(sum[:])) {
+			return &scriptError{http.StatusForbidden, "Script verification failed", fmt.Errorf("%s.pxl does not match the sha256 in its manifest", s.Name)}
+		}
+	} else if c.Lockdown.RequireChecksum {
+		return &scriptError{http.StatusForbidden, "Script verification failed", fmt.Errorf("manifest of %s has no sha256", s.Name)}
+	}
+
+	if len(c.Lockdown.PublicKeys) == 0 {
+		return nil
+	}
+	if m.Signature == "" {
+		return &scriptError{http.StatusForbidden, "Script verification failed", fmt.Errorf("manifest of %s has no signature", s.Name)}
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return &scriptError{http.StatusForbidden, "Script verification failed", fmt.Errorf("signature of %s is not valid base64", s.Name)}
+	}
+	for _, k := range c.Lockdown.PublicKeys {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid lockdown public key %q in config file", k)
+		}
+		if ed25519.Verify(ed25519.PublicKey(key), []byte(s.Source), sig) {
+			return nil
+		}
+	}
+	return &scriptError{http.StatusForbidden, "Script verification failed", fmt.Errorf("signature of %s does not match any trusted key", s.Name)}
+}
+
+// checkLockedParams makes sure every parameter s substitutes is declared in its manifest with a
+// pattern. Values are spliced into the PXL verbatim, so in lockdown mode only validated ones
+// may reach the script.
+func (m *scriptManifest) checkLockedParams(s *libraryScript) error {
+	for _, ref := range paramRef.FindAllStringSubmatch(s.Source, -1) {
+		name := ref[1]
+		spec, ok := m.Params[name]
+		if !ok {
+			return &scriptError{http.StatusForbidden, "Script verification failed", fmt.Errorf("%s.pxl uses parameter %q, which its manifest doesn't declare", s.Name, name)}
+		}
+		if spec.Pattern == "" {
+			return &scriptError{http.StatusForbidden, "Script verification failed", fmt.Errorf("parameter %q of %s has no pattern to validate it against", name, s.Name)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifyScript(t *testing.T) {
+	const source = "import px\ndf = px.DataFrame(table='http_events')\npx.display(df[df.req_path == '${path}'])\n"
+	sum := sha256.Sum256([]byte(source))
+	checksum := hex.EncodeToString(sum[:])
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := base64.StdEncoding.EncodeToString(pub)
+	untrusted := base64.StdEncoding.EncodeToString(otherPub)
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(source)))
+	validated := map[string]paramSpec{"path": {Pattern: `/[a-z/]*`}}
+
+	tests := []struct {
+		name     string
+		lockdown LockdownConfig
+		manifest *scriptManifest
+		// wantStatus is the status of the scriptError expected, -1 for a config error
+		wantStatus int
+	}{
+		{"no manifest", LockdownConfig{}, nil, 0},
+		{"matching checksum", LockdownConfig{}, &scriptManifest{SHA256: checksum}, 0},
+		{"uppercase checksum", LockdownConfig{}, &scriptManifest{SHA256: strings.ToUpper(checksum)}, 0},
+		{"mismatched checksum", LockdownConfig{}, &scriptManifest{SHA256: hex.EncodeToString(make([]byte, 32))}, http.StatusForbidden},
+		{"required checksum missing", LockdownConfig{RequireChecksum: true}, &scriptManifest{}, http.StatusForbidden},
+		{"valid signature", LockdownConfig{PublicKeys: []string{untrusted, trusted}}, &scriptManifest{Signature: signature}, 0},
+		{"signature by an untrusted key", LockdownConfig{PublicKeys: []string{untrusted}}, &scriptManifest{Signature: signature}, http.StatusForbidden},
+		{"missing signature", LockdownConfig{PublicKeys: []string{trusted}}, &scriptManifest{}, http.StatusForbidden},
+		{"signature not base64", LockdownConfig{PublicKeys: []string{trusted}}, &scriptManifest{Signature: "!"}, http.StatusForbidden},
+		{"invalid public key", LockdownConfig{PublicKeys: []string{"c2hvcnQ="}}, &scriptManifest{Signature: signature}, -1},
+		{"locked down with validated params", LockdownConfig{Enabled: true}, &scriptManifest{Params: validated}, 0},
+		{"locked down with an undeclared param", LockdownConfig{Enabled: true}, &scriptManifest{}, http.StatusForbidden},
+		{"locked down with a param without pattern", LockdownConfig{Enabled: true}, &scriptManifest{Params: map[string]paramSpec{"path": {}}}, http.StatusForbidden},
+		{"undeclared param outside lockdown", LockdownConfig{}, &scriptManifest{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &libraryScript{Name: "http", Source: source, Manifest: tt.manifest}
+			err := (&Config{Lockdown: tt.lockdown}).verifyScript(s)
+			var se *scriptError
+			switch {
+			case tt.wantStatus == 0 && err != nil:
+				t.Errorf("verifyScript() error = %v", err)
+			case tt.wantStatus > 0 && (!errors.As(err, &se) || se.status != tt.wantStatus):
+				t.Errorf("verifyScript() error = %v, want status %d", err, tt.wantStatus)
+			case tt.wantStatus < 0 && (err == nil || errors.As(err, &se)):
+				t.Errorf("verifyScript() error = %v, want a config error", err)
+			}
+		})
+	}
+}
+
+func TestDenyArbitraryScripts(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		denied := denyArbitraryScripts(w, &Config{Lockdown: LockdownConfig{Enabled: enabled}})
+		if denied != enabled || (enabled && w.Code != http.StatusForbidden) {
+			t.Errorf("lockdown %v: denied %v with status %d", enabled, denied, w.Code)
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"px.dev/pxapi"
@@ -28,6 +33,173 @@ type Config struct {
 	PXAPIKey    string `json:"px_api_key"`
 	PXClusterID string `json:"px_cluster_id"`
 	CloudAddr   string `json:"cloud_addr"`
+
+	// Clusters registers additional Vizier clusters by name; px_cluster_id is the default
+	Clusters map[string]ClusterConfig `json:"clusters,omitempty"`
+
+	// AdminToken enables the /admin API for callers presenting it as a bearer token
+	AdminToken string `json:"admin_token,omitempty"`
+	// APITokens, when set, are required as bearer tokens on the query endpoints and
+	// determine the caller's tenant and roles
+	APITokens map[string]APIToken `json:"api_tokens,omitempty"`
+	// RateLimit bounds the request rate of each tenant on the query endpoints
+	RateLimit RateLimit `json:"rate_limit,omitzero"`
+	// CORSOrigins lists browser origins allowed to call the API ("*" allows any)
+	CORSOrigins []string `json:"cors_origins,omitempty"`
+	// DebugAddr serves pprof, expvar and /debug/state on a separate listener; when empty
+	// they are served on the main listener behind admin auth
+	DebugAddr string `json:"debug_addr,omitempty"`
+
+	// Quotas maps tenant IDs to usage limits; the "*" entry applies to unlisted tenants
+	Quotas map[string]TenantQuota `json:"quotas,omitempty"`
+
+	// History configures the SQLite query history archive
+	History HistoryConfig `json:"history,omitzero"`
+	// Encryption encrypts persisted scripts, parameters and results at rest
+	Encryption EncryptionConfig `json:"encryption,omitzero"`
+	// Snapshots controls result sets shared as read-only links
+	Snapshots SnapshotConfig `json:"snapshots,omitzero"`
+
+	// ExecTimeout is the default deadline for a whole script execution (default 30s)
+	ExecTimeout string `json:"exec_timeout,omitempty"`
+	// MaxExecTimeout bounds the ?timeout= parameter callers may request (default 5m)
+	MaxExecTimeout string `json:"max_exec_timeout,omitempty"`
+
+	// MaxResultBytes is the memory budget for the rows of a single query (default 256 MiB,
+	// negative disables the limit)
+	MaxResultBytes int64 `json:"max_result_bytes,omitempty"`
+	// Limits bounds request bodies, scripts, parameters and encoded responses
+	Limits Limits `json:"limits,omitzero"`
+	// Redaction masks sensitive columns in every result
+	Redaction RedactionConfig `json:"redaction,omitzero"`
+	// Lockdown restricts execution to verified library scripts
+	Lockdown LockdownConfig `json:"lockdown,omitzero"`
+
+	// Cost estimates what queries will process and guards against expensive ones
+	Cost CostConfig `json:"cost,omitzero"`
+
+	// Cache configures the in-memory result cache
+	Cache CacheConfig `json:"cache,omitzero"`
+
+	// ScriptDir holds the script library: <name>.pxl files with optional manifests (default "scripts")
+	ScriptDir string `json:"script_dir,omitempty"`
+
+	// BatchConcurrency bounds how many scripts of a /pixie/batch request run at once (default 4)
+	BatchConcurrency int `json:"batch_concurrency,omitempty"`
+	// MaxShardParallelism bounds how many chunks of a sharded execution run at once (default 4)
+	MaxShardParallelism int `json:"max_shard_parallelism,omitempty"`
+	// Queue bounds concurrent executions, queueing the rest by priority
+	Queue QueueConfig `json:"queue,omitzero"`
+	// Keepalive pings idle clusters so their pooled connections stay warm
+	Keepalive KeepaliveConfig `json:"keepalive,omitzero"`
+
+	// SLOTarget is the success-rate objective error budget burn is computed against (default 0.99)
+	SLOTarget float64 `json:"slo_target,omitempty"`
+	// Datadog exports execution metrics and failure events to DogStatsD
+	Datadog DatadogConfig `json:"datadog,omitzero"`
+
+	// Defaults are parameters and time ranges merged into executions per cluster and script
+	Defaults DefaultsConfig `json:"defaults,omitzero"`
+
+	// Compression sets the default codec per output format, e.g. {"parquet": "zstd"}
+	Compression map[string]string `json:"compression,omitempty"`
+
+	// Exports are library scripts run on a schedule, with their rows shipped to a destination
+	Exports map[string]ExportJob `json:"exports,omitempty"`
+}
+
+const (
+	defaultExecTimeout    = 30 * time.Second
+	defaultMaxExecTimeout = 5 * time.Minute
+	defaultMaxResultBytes = 256 << 20
+)
+
+// resultBudget returns the per-query row memory budget, or 0 if unlimited
+func (c *Config) resultBudget() int64 {
+	switch {
+	case c.MaxResultBytes < 0:
+		return 0
+	case c.MaxResultBytes == 0:
+		return defaultMaxResultBytes
+	}
+	return c.MaxResultBytes
+}
+
+// configDuration parses a duration setting, falling back to def when it is unset
+func configDuration(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q in config file", name, value)
+	}
+	return d, nil
+}
+
+// requestTimeout returns the execution deadline for a request: the ?timeout= parameter if
+// given, bounded by max_exec_timeout, otherwise exec_timeout
+func requestTimeout(r *http.Request, config *Config) (time.Duration, error) {
+	def, err := configDuration("exec_timeout", config.ExecTimeout, defaultExecTimeout)
+	if err != nil {
+		return 0, err
+	}
+	max, err := configDuration("max_exec_timeout", config.MaxExecTimeout, defaultMaxExecTimeout)
+	if err != nil {
+		return 0, err
+	}
+	v := r.URL.Query().Get("timeout")
+	if v == "" {
+		return min(def, max), nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, &scriptError{http.StatusBadRequest, "Invalid 'timeout' parameter", fmt.Errorf("%q is not a positive duration", v)}
+	}
+	if d > max {
+		return 0, &scriptError{http.StatusBadRequest, "Invalid 'timeout' parameter", fmt.Errorf("%v exceeds the server maximum of %v", d, max)}
+	}
+	return d, nil
+}
+
+// ClusterConfig describes a registered Vizier cluster
+type ClusterConfig struct {
+	ClusterID string `json:"cluster_id"`
+}
+
+// clusterID resolves a cluster name to its ID; an empty name selects px_cluster_id
+func (c *Config) clusterID(name string) (string, error) {
+	if name == "" {
+		return c.PXClusterID, nil
+	}
+	cluster, ok := c.Clusters[name]
+	if !ok {
+		return "", &scriptError{http.StatusNotFound, "Unknown cluster", errUnknownCluster(name)}
+	}
+	return cluster.ClusterID, nil
+}
+
+func errUnknownCluster(name string) error {
+	return fmt.Errorf("no cluster registered as %q", name)
+}
+
+// configMu serializes read-modify-write updates of the config file
+var configMu sync.Mutex
+
+// saveConfig atomically writes configuration back to a JSON file
+func saveConfig(filename string, config *Config) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode config: %w", err)
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("could not write config file: %w", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("could not replace config file: %w", err)
+	}
+	return nil
 }
 
 // loadConfig reads configuration from a JSON file
@@ -38,85 +210,417 @@ func loadConfig(filename string) (*Config, error) {
 		return nil, fmt.Errorf("could not read config file: %w", err)
 	}
 
-	// Parse JSON
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
+	config, err := decodeConfig(data)
+	if err != nil {
 		return nil, fmt.Errorf("could not parse config file: %w", err)
 	}
-
-	// Validate required fields
-	if config.PXAPIKey == "" {
-		return nil, fmt.Errorf("PX_API_KEY is not set in config file")
-	}
-	if config.PXClusterID == "" {
-		return nil, fmt.Errorf("PX_CLUSTER_ID is not set in config file")
+	if err := config.validate(); err != nil {
+		return nil, err
 	}
-	if config.CloudAddr == "" {
-		return nil, fmt.Errorf("CLOUD_ADDR is not set in config file")
-	}
-
-	return &config, nil
+	return config, nil
 }
 
-// tablePrinter accumulates query results
+// errResultTooLarge aborts a query whose accumulated rows exceed its memory budget
+var errResultTooLarge = errors.New("result too large")
+
+// Approximate in-memory overhead of a row slice and of each string header
+const (
+	rowOverhead  = 24
+	cellOverhead = 16
+)
+
+// tablePrinter accumulates query results. Pixie announces every output table before it
+// streams their records, interleaved, so each table collects its rows in its own buffer.
 type tablePrinter struct {
-	cols []string
-	rows [][]string
+	tables []*tableBuffer
+	cells  cellAllocator
+
+	// maxBytes is the memory budget for rows (0 means unlimited)
+	maxBytes int64
+	bytes    int64
+	// shared, when set, counts the rows of other executions against maxBytes as well
+	shared *atomic.Int64
+	// streamed, when set, counts the rows received for the query registry
+	streamed *atomic.Int64
+}
+
+// tableBuffer receives the records of one output table
+type tableBuffer struct {
+	printer *tablePrinter
+	resultTable
 }
 
 // Implement TableMuxer interface
 func (t *tablePrinter) AcceptTable(ctx context.Context, metadata types.TableMetadata) (pxapi.TableRecordHandler, error) {
 	// Initialize column names here since we have access to metadata
-	v := reflect.ValueOf(metadata)
-	if v.Kind() == reflect.Ptr {
-		v = v.Elem()
-	}
-	// Try to find column names in common field names
-	fieldNames := []string{"Columns", "ColNames", "Fields", "Schema"}
-	for _, name := range fieldNames {
-		field := v.FieldByName(name)
-		if field.IsValid() {
-			// Handle different possible types for column names
-			if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String {
-				t.cols = field.Interface().([]string)
-				break
-			} else if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
-				// If it's a slice of structs, try to get Name field from each
-				for i := 0; i < field.Len(); i++ {
-					item := field.Index(i)
-					nameField := item.FieldByName("Name")
-					if nameField.IsValid() && nameField.Kind() == reflect.String {
-						t.cols = append(t.cols, nameField.String())
-					}
-				}
-				if len(t.cols) > 0 {
-					break
-				}
-			}
-		}
-	}
-	return t, nil
+	b := &tableBuffer{printer: t, resultTable: resultTable{
+		Name:    metadata.Name,
+		Columns: make([]string, 0, len(metadata.ColInfo)),
+		Schema:  make([]columnSchema, 0, len(metadata.ColInfo)),
+	}}
+	for _, col := range metadata.ColInfo {
+		b.Columns = append(b.Columns, col.Name)
+		b.Schema = append(b.Schema, newColumnSchema(col))
+	}
+	t.tables = append(t.tables, b)
+	return b, nil
+}
+
+// rowCount is the number of rows received across all tables
+func (t *tablePrinter) rowCount() int {
+	n := 0
+	for _, b := range t.tables {
+		n += len(b.Rows)
+	}
+	return n
+}
+
+// result returns the first output table as the result, carrying any others along
+func (t *tablePrinter) result() *queryResult {
+	res := &queryResult{cells: &t.cells}
+	if len(t.tables) == 0 {
+		return res
+	}
+	first := t.tables[0]
+	res.Columns, res.Schema, res.Rows, res.table = first.Columns, first.Schema, first.Rows, first.Name
+	for _, b := range t.tables[1:] {
+		res.OtherTables = append(res.OtherTables, b.resultTable)
+	}
+	return res
 }
 
 // Implement TableRecordHandler interface
-func (t *tablePrinter) HandleInit(ctx context.Context, metadata types.TableMetadata) error {
+func (b *tableBuffer) HandleInit(ctx context.Context, metadata types.TableMetadata) error {
 	// Column names are initialized in AcceptTable method
 	return nil
 }
 
-func (t *tablePrinter) HandleRecord(ctx context.Context, r *types.Record) error {
-	var row []string
-	for _, d := range r.Data {
-		row = append(row, d.String())
+func (b *tableBuffer) HandleRecord(ctx context.Context, r *types.Record) error {
+	t := b.printer
+	row := t.cells.row(len(r.Data))
+	size := int64(rowOverhead)
+	for i, d := range r.Data {
+		v := formatDatum(d)
+		size += int64(len(v)) + cellOverhead
+		row[i] = v
+	}
+	t.bytes += size
+	total := t.bytes
+	if t.shared != nil {
+		total = t.shared.Add(size)
+	}
+	if t.maxBytes > 0 && total > t.maxBytes {
+		return fmt.Errorf("%w: rows exceed the memory budget of %d bytes, narrow the time range or add filters", errResultTooLarge, t.maxBytes)
+	}
+	b.Rows = append(b.Rows, row)
+	if t.streamed != nil {
+		t.streamed.Add(1)
 	}
-	t.rows = append(t.rows, row)
 	return nil
 }
 
-func (t *tablePrinter) HandleDone(ctx context.Context) error {
+func (b *tableBuffer) HandleDone(ctx context.Context) error {
 	return nil
 }
 
+// queryResult is the outcome of a script execution, in the JSON shape returned to callers
+type queryResult struct {
+	Columns []string            `json:"columns"`
+	Schema  []columnSchema      `json:"schema"`
+	Rows    [][]string          `json:"rows"`
+	Stats   *pxapi.ResultsStats `json:"stats"`
+
+	// table is the name of the Pixie output table
+	table string
+	// script and cluster describe where the result came from, for formats that show it
+	script, cluster string
+	// cells backs Rows; see release
+	cells *cellAllocator
+	// estimate is the projected cost the execution was admitted with, if any
+	estimate *costEstimate
+	// OtherTables holds the output tables after the first when the script displayed more
+	// than one; the result itself is the first
+	OtherTables []resultTable `json:"other_tables,omitempty"`
+	// archived lists the history entries holding the result, one per execution it came from
+	archived []archivedPart
+}
+
+// archivedPart is the archived result of an execution whose rows start at index start of Rows
+type archivedPart struct {
+	id    int64
+	start int
+}
+
+// resultTable is one output table of a script
+type resultTable struct {
+	Name    string         `json:"name"`
+	Columns []string       `json:"columns"`
+	Schema  []columnSchema `json:"schema"`
+	Rows    [][]string     `json:"rows"`
+}
+
+// split returns the result's output tables as separate results
+func (q *queryResult) split() []*queryResult {
+	if len(q.OtherTables) == 0 {
+		return []*queryResult{q}
+	}
+	parts := []*queryResult{q}
+	for _, t := range q.OtherTables {
+		parts = append(parts, &queryResult{Columns: t.Columns, Schema: t.Schema, Rows: t.Rows, Stats: q.Stats, table: t.Name, script: q.script, cluster: q.cluster})
+	}
+	return parts
+}
+
+// release recycles the row buffers of the result. Rows must no longer be used afterwards.
+func (q *queryResult) release() {
+	if q.cells != nil {
+		q.cells.release()
+		q.cells = nil
+	}
+	q.Rows, q.OtherTables = nil, nil
+}
+
+// scriptError is an execution failure along with the HTTP status it maps to
+type scriptError struct {
+	status int
+	msg    string
+	err    error
+}
+
+func (e *scriptError) Error() string {
+	return e.msg + ": " + e.err.Error()
+}
+
+// writeScriptError reports an execution failure to the caller
+func writeScriptError(w http.ResponseWriter, err error) {
+	var se *scriptError
+	if errors.As(err, &se) {
+		var le *limitError
+		if errors.As(se.err, &le) {
+			writeAPIError(w, apiError{Error: se.Error(), Status: se.status, Limit: le.limit, Size: le.size})
+			return
+		}
+		http.Error(w, se.Error(), se.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// execOptions tunes a single script execution
+type execOptions struct {
+	// Tenant the execution is metered against
+	Tenant string
+	// ClusterID of the Vizier to run on
+	ClusterID string
+	// Timeout bounds the whole execution, from client creation to the end of the stream
+	Timeout time.Duration
+	// Params are substituted for ${name} placeholders in the script
+	Params map[string]string
+	// Range, when set, is resolved at execution time and injected as the script's
+	// start_time/end_time arguments and ${start_time}/${end_time} parameters
+	Range timeRange
+	// Pretty renders durations, byte counts and percentages for humans. It only affects
+	// the encoded response, so runScript archives the raw values.
+	Pretty bool
+	// Downsample, when set, aggregates the result into time buckets before it is encoded
+	Downsample *downsampleSpec
+	// Format names the registered Formatter the result is encoded with (default json)
+	Format string
+	// Compression is the codec of formats that support a choice, e.g. zstd for parquet
+	Compression string
+	// CacheTTL overrides the configured cache ttl when set
+	CacheTTL string
+	// Name of the library script being executed, used as its metrics label
+	Name string
+	// Priority orders the execution in the queue when all slots are taken
+	Priority priority
+	// Shards, when set, splits Range into chunks executed as separate queries
+	Shards *shardSpec
+	// budget, when set, counts the row memory of all chunks of a sharded execution, so
+	// together they stay within max_result_bytes
+	budget *atomic.Int64
+}
+
+// execFailure wraps an execution error, mapping expired deadlines to 504 and cancelled
+// executions to 409
+func execFailure(ctx context.Context, status int, msg string, err error, timeout time.Duration) error {
+	if errors.Is(context.Cause(ctx), errQueryCancelled) {
+		return &scriptError{http.StatusConflict, msg, errQueryCancelled}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &scriptError{http.StatusGatewayTimeout, msg, fmt.Errorf("timed out after %v", timeout)}
+	}
+	return &scriptError{status, msg, err}
+}
+
+// prepareScript resolves the time range of opts and substitutes it and the parameters into
+// script, returning the PXL to execute along with the parameters it was given
+func prepareScript(script string, opts execOptions) (string, map[string]string, error) {
+	params := opts.Params
+	var start, end time.Time
+	if opts.Range != (timeRange{}) {
+		var err error
+		if start, end, err = opts.Range.resolve(time.Now()); err != nil {
+			return "", nil, &scriptError{http.StatusBadRequest, "Invalid time range", err}
+		}
+		params = make(map[string]string, len(opts.Params)+2)
+		for k, v := range opts.Params {
+			params[k] = v
+		}
+		params["start_time"] = strconv.FormatInt(start.UnixNano(), 10)
+		params["end_time"] = strconv.FormatInt(end.UnixNano(), 10)
+	}
+	pxl, err := substituteParams(script, params)
+	if err != nil {
+		return "", nil, err
+	}
+	if !start.IsZero() {
+		pxl = applyTimeRange(pxl, start, end)
+	}
+	return pxl, params, nil
+}
+
+// runScript executes a PXL script on the given cluster, metering it against the
+// caller's tenant and recording it in the query history
+func runScript(ctx context.Context, config *Config, script string, opts execOptions) (res *queryResult, err error) {
+	began := time.Now()
+	// Only executions that reached the cluster say something about its health
+	var contacted bool
+	defer func() {
+		elapsed := time.Since(began)
+		metrics.observe(opts.Name, script, elapsed, err)
+		datadog.observe(&config.Datadog, opts, script, elapsed, res, err)
+		// Cancelled executions say nothing about it either
+		if contacted && !errors.Is(context.Cause(ctx), errQueryCancelled) {
+			pool.observe(opts.ClusterID, err)
+		}
+	}()
+
+	pxl, params, err := prepareScript(script, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Results are withheld rather than served unmasked when the rules are broken
+	redact, err := config.redactor()
+	if err != nil {
+		return nil, &scriptError{http.StatusInternalServerError, "Invalid redaction rules", err}
+	}
+
+	costID := cmp.Or(opts.Name, scriptID(script))
+	footprint := tableSeconds(pxl, time.Now())
+	estimate, err := config.Cost.check(costID, footprint)
+	if err != nil {
+		return nil, err
+	}
+
+	tenant := opts.Tenant
+	// Enforce tenant quotas, holding a reservation so concurrent executions can't all slip
+	// under the limit
+	var estimatedBytes int64
+	if estimate != nil {
+		estimatedBytes = estimate.Bytes
+	}
+	reservation, err := usage.reserve(tenant, config.quotaFor(tenant), estimatedBytes)
+	if err != nil {
+		return nil, &scriptError{http.StatusTooManyRequests, "Quota exceeded", err}
+	}
+	defer reservation.release()
+
+	// The deadline covers waiting for an execution slot, client creation, connecting to
+	// Vizier and streaming the results
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ctx, live, done := queries.register(ctx, opts, script)
+	defer done()
+	release, err := queue.acquire(ctx, config.Queue, opts.Priority, tenant)
+	if err != nil {
+		return nil, execFailure(ctx, http.StatusServiceUnavailable, "No execution slot became available", err, timeout)
+	}
+	defer release()
+	live.running.Store(true)
+	contacted = true
+
+	// Execute script on a pooled Vizier client. If Vizier rejects the client's credentials,
+	// e.g. because its token expired mid-stream, the client is re-created and the script
+	// run once more before the error is surfaced.
+	entry := &historyEntry{StartedAt: time.Now(), Script: script, Params: params, Cluster: opts.ClusterID, Caller: tenant}
+	var tp *tablePrinter
+	var rs *pxapi.ScriptResults
+	var execErr, streamErr error
+	for attempt := 1; ; attempt++ {
+		vz, err := pool.get(ctx, config, opts.ClusterID)
+		if err != nil {
+			return nil, execFailure(ctx, http.StatusInternalServerError, "Failed to connect to cluster", err, timeout)
+		}
+		live.rows.Store(0)
+		tp = &tablePrinter{maxBytes: config.resultBudget(), streamed: &live.rows, shared: opts.budget}
+		rs, execErr = vz.ExecuteScript(ctx, pxl, tp)
+		if execErr == nil {
+			streamErr = rs.Stream()
+		}
+		authErr := isAuthError(cmp.Or(execErr, streamErr))
+		if attempt > 1 {
+			metrics.observeReauth(!authErr)
+		}
+		if attempt > 1 || !authErr || ctx.Err() != nil {
+			break
+		}
+		log.Printf("Vizier rejected the credentials for cluster %s, re-creating the client: %v\n", opts.ClusterID, cmp.Or(execErr, streamErr))
+		if rs != nil {
+			rs.Close()
+		}
+		tp.cells.release()
+		if opts.budget != nil {
+			opts.budget.Add(-tp.bytes)
+		}
+		pool.refresh(config, opts.ClusterID)
+	}
+	if execErr != nil {
+		entry.DurationMs, entry.Error = time.Since(entry.StartedAt).Milliseconds(), execErr.Error()
+		history.save(entry, nil)
+		if isAuthError(execErr) {
+			return nil, &scriptError{http.StatusUnauthorized, "Pixie rejected the service credentials", execErr}
+		}
+		return nil, execFailure(ctx, http.StatusBadRequest, "Script execution failed", execErr, timeout)
+	}
+	defer rs.Close()
+
+	reservation.settle(rs.Stats(), tp.rowCount())
+	if stats := rs.Stats(); stats != nil && streamErr == nil {
+		costs.observe(costID, footprint, stats.BytesProcessed)
+	}
+	entry.DurationMs, entry.RowCount = time.Since(entry.StartedAt).Milliseconds(), tp.rowCount()
+	if err := streamErr; err != nil {
+		entry.Error = err.Error()
+		history.save(entry, nil)
+		if errors.Is(err, errResultTooLarge) {
+			return nil, &scriptError{http.StatusRequestEntityTooLarge, "Query aborted", err}
+		}
+		if isAuthError(err) {
+			return nil, &scriptError{http.StatusUnauthorized, "Pixie rejected the service credentials", err}
+		}
+		return nil, execFailure(ctx, http.StatusInternalServerError, "Streaming failed", err, timeout)
+	}
+
+	res = tp.result()
+	res.Stats, res.estimate = rs.Stats(), estimate
+	// Masking before archiving keeps sensitive values out of the history as well
+	redact.apply(res)
+	if history != nil && history.cfg.StoreResults {
+		payload, _ := encodeJSON(res)
+		if id := history.save(entry, payload); id > 0 {
+			res.archived = []archivedPart{{id: id}}
+		}
+	} else {
+		history.save(entry, nil)
+	}
+	return res, nil
+}
+
 func pixieHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
@@ -125,10 +629,12 @@ func pixieHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request body
 	var req struct {
-		Script string `json:"script"`
+		Script  string        `json:"script"`
+		Params  requestParams `json:"params"`
+		Cluster string        `json:"cluster"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+	if err := decodeBody(r, &req, true); err != nil {
+		writeScriptError(w, err)
 		return
 	}
 	if req.Script == "" {
@@ -137,59 +643,151 @@ func pixieHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Load config
-	config, err := loadConfig("config.json")
+	config, err := requestConfig(r)
 	if err != nil {
 		log.Printf("ERROR: Failed to load config: %v\n", err)
 		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
 		return
 	}
+	if denyArbitraryScripts(w, config) {
+		return
+	}
+	if err := cmp.Or(config.checkScript(req.Script), config.checkParams(req.Params)); err != nil {
+		writeScriptError(w, err)
+		return
+	}
 
-	// Create Pixie client
-	ctx := context.Background()
-	client, err := pxapi.NewClient(
-		ctx,
-		pxapi.WithAPIKey(config.PXAPIKey),
-		pxapi.WithCloudAddr(config.CloudAddr),
-		pxapi.WithE2EEncryption(true),
-	)
+	opts, err := requestOptions(r, config)
 	if err != nil {
-		http.Error(w, "Failed to create Pixie API client: "+err.Error(), http.StatusInternalServerError)
+		writeScriptError(w, err)
 		return
 	}
+	opts.Params = req.Params
+	config.applyDefaults(req.Cluster, "", req.Script, nil, &opts)
 
-	// Connect to Vizier
-	vizCtx, vizCancel := context.WithTimeout(ctx, 30*time.Second)
-	defer vizCancel()
-	vz, err := client.NewVizierClient(vizCtx, config.PXClusterID)
+	res, err := executeCached(r, config, req.Cluster, req.Script, opts)
 	if err != nil {
-		http.Error(w, "Failed to connect to cluster: "+err.Error(), http.StatusInternalServerError)
+		writeScriptError(w, err)
 		return
 	}
+	if res.cache != "" {
+		w.Header().Set("X-Cache", res.cache)
+	}
+	setCostHeaders(w, res.estimate)
+	writeCachable(w, r, res.payload, res.etag, res.contentType)
+}
+
+// requestOptions reads the execution and rendering options shared by the query endpoints
+// from the query string and headers
+func requestOptions(r *http.Request, config *Config) (execOptions, error) {
+	opts := execOptions{Tenant: tenantFromRequest(r), Pretty: prettyRequested(r)}
+	var err error
+	if opts.Timeout, err = requestTimeout(r, config); err != nil {
+		return opts, err
+	}
+	if opts.Range, err = requestTimeRange(r); err != nil {
+		return opts, err
+	}
+	if opts.Downsample, err = requestDownsample(r); err != nil {
+		return opts, err
+	}
+	if opts.Format, err = negotiateFormat(r); err != nil {
+		return opts, err
+	}
+	opts.Compression = r.URL.Query().Get("compression")
+	if opts.Priority, err = parsePriority(r.URL.Query().Get("priority"), priorityInteractive); err != nil {
+		return opts, &scriptError{http.StatusBadRequest, "Invalid 'priority' parameter", err}
+	}
+	if opts.Shards, err = requestShards(r, config); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// encodedResult is a query result rendered by a Formatter
+type encodedResult struct {
+	payload     []byte
+	etag        string
+	contentType string
+	// cache is HIT or MISS when the result cache is enabled
+	cache string
+	// estimate is the projected cost of the execution; nil for cached results
+	estimate *costEstimate
+}
 
-	// Execute script
-	tp := &tablePrinter{}
-	execCtx, execCancel := context.WithTimeout(ctx, 30*time.Second)
-	defer execCancel()
-	rs, err := vz.ExecuteScript(execCtx, req.Script, tp)
+// executeCached runs a script on the named cluster and renders the result, serving it
+// from the result cache when enabled unless the caller asks for a fresh result
+func executeCached(r *http.Request, config *Config, cluster, script string, opts execOptions) (*encodedResult, error) {
+	ttlSpec := config.Cache.TTL
+	if opts.CacheTTL != "" {
+		ttlSpec = opts.CacheTTL
+	}
+	ttl, err := time.ParseDuration(cmp.Or(ttlSpec, "0s"))
 	if err != nil {
-		http.Error(w, "Script execution failed: "+err.Error(), http.StatusBadRequest)
-		return
+		return nil, fmt.Errorf("invalid cache ttl %q", ttlSpec)
+	}
+	clusterID, err := config.clusterID(cluster)
+	if err != nil {
+		return nil, err
+	}
+	opts.ClusterID = clusterID
+	if opts.Format == "" {
+		opts.Format = defaultFormat
+	}
+	formatter, ok := formatters[opts.Format]
+	if !ok {
+		return nil, &scriptError{http.StatusNotAcceptable, "Unknown format", fmt.Errorf("%q is not a registered format", opts.Format)}
+	}
+	codec, err := formatCodec(config, opts.Format, formatter, opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	// Relative ranges are keyed as given, so a cached result is reused for the TTL
+	key := cacheKey(clusterID, script, paramsKey(opts.Params), opts.Range.Start, opts.Range.End, strconv.FormatBool(opts.Pretty), opts.Downsample.key(), opts.Format, codec, config.Redaction.key(), opts.Shards.key())
+	if ttl > 0 && !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		if cached, ok := results.get(key); ok {
+			return &encodedResult{payload: cached.payload, etag: cached.etag, contentType: formatter.ContentType(), cache: "HIT"}, nil
+		}
 	}
-	defer rs.Close()
 
-	if err := rs.Stream(); err != nil {
-		http.Error(w, "Streaming failed: "+err.Error(), http.StatusInternalServerError)
-		return
+	res, err := runRange(r.Context(), config, script, opts)
+	if err != nil {
+		return nil, err
 	}
+	res.script = cmp.Or(opts.Name, preview(script))
+	res.cluster = cmp.Or(cluster, "default") + " (" + clusterID + ")"
 
-	// Return JSON
-	output := map[string]interface{}{
-		"columns": tp.cols,
-		"rows":    tp.rows,
-		"stats":   rs.Stats(),
+	estimate := res.estimate
+	if opts.Downsample != nil {
+		reduced, err := downsample(res, opts.Downsample)
+		res.release()
+		if err != nil {
+			return nil, &scriptError{http.StatusUnprocessableEntity, "Downsampling failed", err}
+		}
+		res = reduced
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(output)
+	if opts.Pretty {
+		res.prettify()
+	}
+	var payload []byte
+	if cf, ok := formatter.(codecFormatter); ok {
+		payload, err = cf.FormatCodec(res, codec)
+	} else {
+		payload, err = formatter.Format(res)
+	}
+	res.release()
+	if err != nil {
+		return nil, &scriptError{http.StatusInternalServerError, "Failed to encode result", err}
+	}
+	if err := config.checkResponse(payload); err != nil {
+		return nil, err
+	}
+	out := &encodedResult{payload: payload, etag: etagFor(payload), contentType: formatter.ContentType(), estimate: estimate}
+	if ttl > 0 {
+		results.put(key, &cachedResult{payload: payload, etag: out.etag, expires: time.Now().Add(ttl)}, config.Cache)
+		out.cache = "MISS"
+	}
+	return out, nil
 }
 
 // ServeOpenAPI serves the OpenAPI specification file
@@ -199,13 +797,103 @@ func ServeOpenAPI(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	http.HandleFunc("/pixie", pixieHandler)
-	http.HandleFunc("/openapi.json", ServeOpenAPI)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	// Startup settings; everything else is re-read from the config file on each request
+	startup, err := loadConfig("config.json")
+	if err != nil {
+		log.Printf("WARNING: Failed to load config at startup, query history and debug listener disabled: %v\n", err)
+		startup = &Config{}
+	}
+
+	// Open the query history archive if configured
+	if startup.History.Path != "" {
+		s, err := newSealer(startup.Encryption)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		h, err := openHistory(startup.History, s)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		history = h
+		go history.runCompaction()
+		if err := snapshots.persistTo(h); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		if err := usage.persistTo(h); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		if err := anomalies.persistTo(h); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		if s != nil {
+			log.Printf("Query history stored in %s, encrypted\n", startup.History.Path)
+		} else {
+			log.Printf("Query history stored in %s\n", startup.History.Path)
+		}
+	}
+
+	// Run scheduled exports; jobs are read from the config file as they come due
+	go exports.run(context.Background())
+
+	// Connect to the configured clusters ahead of the first requests, and keep idle
+	// connections warm if configured
+	if startup.PXClusterID != "" {
+		go warmUp(startup)
+	}
+	go keepalive.run(context.Background())
+
+	// Cross-cutting behaviour lives in middleware: global around every route, plus
+	// authentication and rate limiting on the query endpoints
+	rt := newRouter(withLogging, withConfig, withMetrics, withRecovery, withCORS, withCompression)
+	api := []middleware{withAuth, withRateLimit, withBodyLimit}
+	rt.handle("/pixie", pixieHandler, api...)
+	rt.handle("/pixie/batch", batchHandler, api...)
+	rt.handle("/pixie/diff", diffHandler, api...)
+	rt.handle("/pixie/snapshot", snapshotHandler, api...)
+	rt.handle("/snapshots/{token}", snapshotViewHandler)
+	rt.handle("/scripts", scriptsHandler, withAuth)
+	rt.handle("/scripts/{name}", scriptHandler, withAuth)
+	rt.handle("/scripts/{name}/run", runScriptHandler, api...)
+	rt.handle("/clusters/{name}/status", clusterStatusHandler, withAuth)
+	rt.handle("/exports", exportsHandler, withAuth)
+	rt.handle("/alerts", alertsHandler, withAuth)
+	rt.handle("/queries", queriesHandler, withAuth)
+	rt.handle("/queries/{id}", queryHandler, withAuth)
+	rt.handle("/usage", usageHandler, withAuth)
+	rt.handle("/history", historyHandler, withAuth)
+	rt.handle("/history/{id}/result", historyResultHandler, withAuth)
+	rt.handle("/metrics", metricsHandler)
+	rt.handle("/slo", sloHandler)
+	rt.handle("/admin/api-key", adminAPIKeyHandler, requireAdmin)
+	rt.handle("/admin/clusters", adminClustersHandler, requireAdmin)
+	rt.handle("/admin/clusters/{name}", adminClusterHandler, requireAdmin)
+	rt.handle("/admin/clients/invalidate", adminInvalidateHandler, requireAdmin)
+	rt.handle("/version", versionHandler)
+	rt.handle("/openapi.json", ServeOpenAPI)
+	rt.handle("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "index.html")
 	})
+
+	// Debug endpoints get their own listener if configured, otherwise they require admin auth
+	if startup.DebugAddr != "" {
+		debugRouter := newRouter(withRecovery)
+		registerDebug(debugRouter)
+		go func() {
+			log.Fatal(http.ListenAndServe(startup.DebugAddr, debugRouter))
+		}()
+		log.Printf("Debug endpoints available at http://%s/debug/\n", startup.DebugAddr)
+	} else {
+		registerDebug(rt, requireAdmin)
+	}
+
+	info := readBuildInfo()
+	log.Printf("pixie-data-service %s (git %s, %s), pxapi %s\n", info.Version, info.GitSHA, info.GoVersion, info.PxAPIVersion)
 	log.Println("Server running on :8080")
 	log.Println("OpenAPI specification available at http://localhost:8080/openapi.json")
 	log.Println("Swagger UI available at http://localhost:8080/")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(":8080", rt))
 }
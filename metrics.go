@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the query latency histogram
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// sloWindows are the rolling windows success rates are computed over
+var sloWindows = []struct {
+	name    string
+	minutes int
+}{{"5m", 5}, {"1h", 60}}
+
+const (
+	// windowMinutes is the length of the per-minute outcome ring, covering the longest window
+	windowMinutes     = 60
+	defaultSLOTarget  = 0.99
+	maxTrackedScripts = 500
+	// otherScripts collects scripts beyond maxTrackedScripts
+	otherScripts = "other"
+)
+
+// Query outcomes. Client errors (bad scripts, unknown clusters, quotas) don't count against
+// the SLO, since they say nothing about the health of the Pixie data path.
+const (
+	outcomeSuccess = iota
+	outcomeClientError
+	outcomeServerError
+)
+
+var outcomeNames = [...]string{"success", "client_error", "server_error"}
+
+// minuteBucket counts SLO-relevant outcomes within one minute
+type minuteBucket struct {
+	minute   int64
+	good     uint64
+	bad      uint64
+	observed bool
+}
+
+// scriptMetrics holds the latency histogram and outcomes of one script
+type scriptMetrics struct {
+	preview  string
+	buckets  []uint64
+	sum      float64
+	count    uint64
+	outcomes [len(outcomeNames)]uint64
+	window   [windowMinutes]minuteBucket
+}
+
+// routeMetrics counts the HTTP requests of one route and status code
+type routeMetrics struct {
+	count   uint64
+	seconds float64
+}
+
+type routeKey struct {
+	route string
+	code  int
+}
+
+// queryMetrics records per-script latency and error statistics, and per-route HTTP traffic
+type queryMetrics struct {
+	mu      sync.Mutex
+	scripts map[string]*scriptMetrics
+	routes  map[routeKey]*routeMetrics
+	// reauths counts Vizier client refreshes after rejected credentials, by whether the retry succeeded
+	reauths struct{ recovered, failed uint64 }
+}
+
+var metrics = &queryMetrics{scripts: make(map[string]*scriptMetrics), routes: make(map[routeKey]*routeMetrics)}
+
+// observeHTTP records one served request
+func (m *queryMetrics) observeHTTP(route string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := routeKey{route, code}
+	rm, ok := m.routes[key]
+	if !ok {
+		rm = &routeMetrics{}
+		m.routes[key] = rm
+	}
+	rm.count++
+	rm.seconds += d.Seconds()
+}
+
+// observeReauth records a Vizier client refresh and whether the retried query got past authentication
+func (m *queryMetrics) observeReauth(recovered bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if recovered {
+		m.reauths.recovered++
+	} else {
+		m.reauths.failed++
+	}
+}
+
+// scriptID identifies a script by the hash of its text, so parameterized executions share one series
+func scriptID(script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return hex.EncodeToString(sum[:6])
+}
+
+// outcomeOf classifies an execution error
+func outcomeOf(err error) int {
+	if err == nil {
+		return outcomeSuccess
+	}
+	var se *scriptError
+	if errors.As(err, &se) && se.status < http.StatusInternalServerError {
+		return outcomeClientError
+	}
+	return outcomeServerError
+}
+
+// observe records one script execution under the library name of the script, or the hash
+// of its text for ad-hoc scripts
+func (m *queryMetrics) observe(name, script string, d time.Duration, err error) {
+	id := name
+	if id == "" {
+		id = scriptID(script)
+	}
+	outcome := outcomeOf(err)
+	minute := time.Now().Unix() / 60
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.scripts[id]
+	if !ok {
+		if len(m.scripts) >= maxTrackedScripts {
+			id, script = otherScripts, ""
+			s = m.scripts[id]
+		}
+		if s == nil {
+			s = &scriptMetrics{preview: preview(script), buckets: make([]uint64, len(latencyBuckets))}
+			m.scripts[id] = s
+		}
+	}
+
+	seconds := d.Seconds()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			s.buckets[i]++
+		}
+	}
+	s.sum += seconds
+	s.count++
+	s.outcomes[outcome]++
+
+	if outcome == outcomeClientError {
+		return
+	}
+	b := &s.window[minute%windowMinutes]
+	if !b.observed || b.minute != minute {
+		*b = minuteBucket{minute: minute, observed: true}
+	}
+	if outcome == outcomeSuccess {
+		b.good++
+	} else {
+		b.bad++
+	}
+}
+
+// windowCounts sums the good and bad outcomes of the last n minutes. m.mu must be held.
+func (s *scriptMetrics) windowCounts(n int, now int64) (good, bad uint64) {
+	for _, b := range s.window {
+		if b.observed && b.minute > now-int64(n) && b.minute <= now {
+			good += b.good
+			bad += b.bad
+		}
+	}
+	return good, bad
+}
+
+// preview shortens a script to its first line for display
+func preview(script string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(script), "\n")
+	if len(line) > 80 {
+		line = line[:80] + "…"
+	}
+	return line
+}
+
+// sloWindow is the success rate of one rolling window
+type sloWindow struct {
+	Total       uint64   `json:"total"`
+	Errors      uint64   `json:"errors"`
+	SuccessRate *float64 `json:"success_rate"`
+	// BurnRate is how fast the error budget is being consumed; 1 uses it up exactly over
+	// the SLO period, values above 1 exhaust it early
+	BurnRate *float64 `json:"burn_rate"`
+}
+
+func newSLOWindow(good, bad uint64, target float64) sloWindow {
+	w := sloWindow{Total: good + bad, Errors: bad}
+	if w.Total > 0 {
+		rate := float64(good) / float64(w.Total)
+		burn := (1 - rate) / (1 - target)
+		w.SuccessRate, w.BurnRate = &rate, &burn
+	}
+	return w
+}
+
+// sloTarget returns the configured success-rate objective
+func (c *Config) sloTarget() float64 {
+	if c.SLOTarget <= 0 || c.SLOTarget >= 1 {
+		return defaultSLOTarget
+	}
+	return c.SLOTarget
+}
+
+// sloHandler reports rolling success rates and error budget burn, overall and per script
+func sloHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := defaultSLOTarget
+	if config, err := requestConfig(r); err == nil {
+		target = config.sloTarget()
+	}
+
+	type scriptSLO struct {
+		Script  string               `json:"script"`
+		Preview string               `json:"preview"`
+		Windows map[string]sloWindow `json:"windows"`
+	}
+	now := time.Now().Unix() / 60
+	overall := make(map[string][2]uint64)
+	var scripts []scriptSLO
+
+	metrics.mu.Lock()
+	for id, s := range metrics.scripts {
+		entry := scriptSLO{Script: id, Preview: s.preview, Windows: make(map[string]sloWindow)}
+		for _, win := range sloWindows {
+			good, bad := s.windowCounts(win.minutes, now)
+			entry.Windows[win.name] = newSLOWindow(good, bad, target)
+			sum := overall[win.name]
+			overall[win.name] = [2]uint64{sum[0] + good, sum[1] + bad}
+		}
+		scripts = append(scripts, entry)
+	}
+	metrics.mu.Unlock()
+
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].Script < scripts[j].Script })
+	windows := make(map[string]sloWindow)
+	for _, win := range sloWindows {
+		windows[win.name] = newSLOWindow(overall[win.name][0], overall[win.name][1], target)
+	}
+	writeJSON(w, map[string]interface{}{
+		"target":  target,
+		"windows": windows,
+		"scripts": scripts,
+	})
+}
+
+// metricsHandler serves the metrics in the Prometheus text exposition format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := defaultSLOTarget
+	if config, err := requestConfig(r); err == nil {
+		target = config.sloTarget()
+	}
+	now := time.Now().Unix() / 60
+
+	var b strings.Builder
+	metrics.mu.Lock()
+	ids := make([]string, 0, len(metrics.scripts))
+	for id := range metrics.scripts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	b.WriteString("# HELP pixie_query_duration_seconds Latency of script executions.\n")
+	b.WriteString("# TYPE pixie_query_duration_seconds histogram\n")
+	for _, id := range ids {
+		s := metrics.scripts[id]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(&b, "pixie_query_duration_seconds_bucket{script=%q,le=%q} %d\n", id, strconv.FormatFloat(le, 'g', -1, 64), s.buckets[i])
+		}
+		fmt.Fprintf(&b, "pixie_query_duration_seconds_bucket{script=%q,le=\"+Inf\"} %d\n", id, s.count)
+		fmt.Fprintf(&b, "pixie_query_duration_seconds_sum{script=%q} %g\n", id, s.sum)
+		fmt.Fprintf(&b, "pixie_query_duration_seconds_count{script=%q} %d\n", id, s.count)
+	}
+
+	b.WriteString("# HELP pixie_queries_total Script executions by outcome.\n")
+	b.WriteString("# TYPE pixie_queries_total counter\n")
+	for _, id := range ids {
+		for outcome, name := range outcomeNames {
+			fmt.Fprintf(&b, "pixie_queries_total{script=%q,outcome=%q} %d\n", id, name, metrics.scripts[id].outcomes[outcome])
+		}
+	}
+
+	b.WriteString("# HELP pixie_query_success_ratio Share of successful executions over a rolling window, excluding client errors.\n")
+	b.WriteString("# TYPE pixie_query_success_ratio gauge\n")
+	var burn strings.Builder
+	for _, id := range ids {
+		for _, win := range sloWindows {
+			good, bad := metrics.scripts[id].windowCounts(win.minutes, now)
+			if sw := newSLOWindow(good, bad, target); sw.SuccessRate != nil {
+				fmt.Fprintf(&b, "pixie_query_success_ratio{script=%q,window=%q} %g\n", id, win.name, *sw.SuccessRate)
+				fmt.Fprintf(&burn, "pixie_slo_burn_rate{script=%q,window=%q} %g\n", id, win.name, *sw.BurnRate)
+			}
+		}
+	}
+	routes := make([]routeKey, 0, len(metrics.routes))
+	for key := range metrics.routes {
+		routes = append(routes, key)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].code < routes[j].code
+	})
+	var httpMetrics strings.Builder
+	httpMetrics.WriteString("# HELP pixie_http_requests_total HTTP requests by route and status code.\n")
+	httpMetrics.WriteString("# TYPE pixie_http_requests_total counter\n")
+	for _, key := range routes {
+		fmt.Fprintf(&httpMetrics, "pixie_http_requests_total{route=%q,code=\"%d\"} %d\n", key.route, key.code, metrics.routes[key].count)
+	}
+	httpMetrics.WriteString("# HELP pixie_http_request_duration_seconds_total Time spent serving HTTP requests by route and status code.\n")
+	httpMetrics.WriteString("# TYPE pixie_http_request_duration_seconds_total counter\n")
+	for _, key := range routes {
+		fmt.Fprintf(&httpMetrics, "pixie_http_request_duration_seconds_total{route=%q,code=\"%d\"} %g\n", key.route, key.code, metrics.routes[key].seconds)
+	}
+	httpMetrics.WriteString("# HELP pixie_vizier_reauth_total Vizier clients re-created after rejected credentials, by outcome of the retry.\n")
+	httpMetrics.WriteString("# TYPE pixie_vizier_reauth_total counter\n")
+	fmt.Fprintf(&httpMetrics, "pixie_vizier_reauth_total{outcome=\"recovered\"} %d\n", metrics.reauths.recovered)
+	fmt.Fprintf(&httpMetrics, "pixie_vizier_reauth_total{outcome=\"failed\"} %d\n", metrics.reauths.failed)
+	metrics.mu.Unlock()
+
+	b.WriteString("# HELP pixie_slo_burn_rate Error budget burn rate over a rolling window.\n")
+	b.WriteString("# TYPE pixie_slo_burn_rate gauge\n")
+	b.WriteString(burn.String())
+	fmt.Fprintf(&b, "# HELP pixie_slo_target Configured success-rate objective.\n# TYPE pixie_slo_target gauge\npixie_slo_target %g\n", target)
+	fmt.Fprintf(&b, "# HELP pixie_active_queries Script executions in flight.\n# TYPE pixie_active_queries gauge\npixie_active_queries %d\n", queries.active())
+	queue.writeMetrics(&b)
+	keepalive.writeMetrics(&b)
+	b.WriteString(httpMetrics.String())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// middleware wraps a handler with cross-cutting behaviour
+type middleware func(http.Handler) http.Handler
+
+// chain applies middlewares to h so that the first one runs outermost
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// router registers routes on a ServeMux with per-route middleware, wrapping the whole mux
+// in a shared middleware stack
+type router struct {
+	mux     *http.ServeMux
+	handler http.Handler
+}
+
+func newRouter(global ...middleware) *router {
+	mux := http.NewServeMux()
+	return &router{mux: mux, handler: chain(mux, global...)}
+}
+
+// handle registers h for pattern behind the given route middleware
+func (rt *router) handle(pattern string, h http.HandlerFunc, mws ...middleware) {
+	rt.mux.Handle(pattern, chain(h, mws...))
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.handler.ServeHTTP(w, r)
+}
+
+// apiError is the JSON body of errors produced by middleware
+type apiError struct {
+	Error     string `json:"error"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
+	// Limit and Size are set when a configured limit was exceeded
+	Limit int64 `json:"limit,omitempty"`
+	Size  int64 `json:"size,omitempty"`
+}
+
+// writeErrorJSON reports an error as a structured JSON body
+func writeErrorJSON(w http.ResponseWriter, status int, msg string) {
+	writeAPIError(w, apiError{Error: msg, Status: status})
+}
+
+// writeAPIError writes e as the JSON error body, tagged with the request ID
+func writeAPIError(w http.ResponseWriter, e apiError) {
+	e.RequestID = w.Header().Get(requestIDHeader)
+	body, _ := encodeJSON(e)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	w.Write(body)
+}
+
+// statusRecorder captures the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID withLogging assigned to the request, if any
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withLogging assigns each request an ID and writes an access log line once it completes
+func withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 64 {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		began := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+		log.Printf("%s %s %d %dB %v id=%s\n", r.Method, r.URL.RequestURI(), rec.status, rec.bytes, time.Since(began).Round(time.Millisecond), id)
+	})
+}
+
+type configKey struct{}
+
+// loadedConfig is the configuration withConfig read for a request, or the error reading it
+type loadedConfig struct {
+	config *Config
+	err    error
+}
+
+// withConfig reads the configuration once per request so the middleware that follow share it
+func withConfig(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, err := loadConfig("config.json")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), configKey{}, &loadedConfig{config, err})))
+	})
+}
+
+// requestConfig returns the configuration withConfig loaded for r, reading it when r didn't
+// pass through withConfig
+func requestConfig(r *http.Request) (*Config, error) {
+	if c, ok := r.Context().Value(configKey{}).(*loadedConfig); ok {
+		return c.config, c.err
+	}
+	return loadConfig("config.json")
+}
+
+// withMetrics counts requests and their latency per route pattern and status code
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		began := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		// The mux sets r.Pattern on the same request when it routes it
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.observeHTTP(route, rec.status, time.Since(began))
+	})
+}
+
+// withRecovery turns a panicking handler into a structured 500 instead of a dropped connection
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("ERROR: panic serving %s %s (id=%s): %v\n%s", r.Method, r.URL.Path, w.Header().Get(requestIDHeader), err, debug.Stack())
+			writeErrorJSON(w, http.StatusInternalServerError, "Internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCORS allows browser clients from the configured origins, answering preflight requests
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		config, err := requestConfig(r)
+		if err != nil || !(slices.Contains(config.CORSOrigins, origin) || slices.Contains(config.CORSOrigins, "*")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Expose-Headers", "ETag, X-Cache, X-Estimated-Bytes, Warning, X-Request-ID")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-None-Match, Cache-Control, "+tenantHeader)
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var gzipPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// minGzipBytes keeps tiny responses uncompressed, where gzip would only add overhead
+const minGzipBytes = 1024
+
+// gzipWriter compresses the response once it knows the body is worth compressing
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	status      int
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	g.status = code
+	h := g.ResponseWriter.Header()
+	size, _ := strconv.Atoi(h.Get("Content-Length"))
+	if code != http.StatusNoContent && code != http.StatusNotModified && h.Get("Content-Encoding") == "" &&
+		(h.Get("Content-Length") == "" || size >= minGzipBytes) {
+		g.gz = gzipPool.Get().(*gzip.Writer)
+		g.gz.Reset(g.ResponseWriter)
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		h := g.ResponseWriter.Header()
+		if h.Get("Content-Length") == "" && len(p) < minGzipBytes {
+			h.Set("Content-Length", strconv.Itoa(len(p)))
+		}
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(p))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+func (g *gzipWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+		gzipPool.Put(g.gz)
+		g.gz = nil
+	}
+}
+
+// withCompression gzips responses for clients that accept it
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		g := &gzipWriter{ResponseWriter: w}
+		defer g.close()
+		next.ServeHTTP(g, r)
+	})
+}
+
+// RateLimit bounds the request rate of each caller with a token bucket
+type RateLimit struct {
+	// RequestsPerSecond is the sustained rate; rate limiting is disabled when 0
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	// Burst is the bucket size (default: one second worth of requests, at least 1)
+	Burst int `json:"burst,omitempty"`
+}
+
+// burst returns the bucket size
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return max(l.RequestsPerSecond, 1)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateSweepInterval is how often the limiter drops buckets that have refilled
+const rateSweepInterval = time.Minute
+
+// rateLimiter keeps a token bucket per caller
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow takes a token from the caller's bucket, returning how long to wait if it is empty
+func (l *rateLimiter) allow(key string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	burst := limit.burst()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= rateSweepInterval {
+		l.sweep(limit, now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.RequestsPerSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.RequestsPerSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets idle long enough to have refilled, which a new bucket would
+// start out as anyway
+func (l *rateLimiter) sweep(limit RateLimit, now time.Time) {
+	full := time.Duration(limit.burst() / limit.RequestsPerSecond * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// rateKey identifies the caller a request is rate limited as: the tenant of its token, or the
+// client address while the API is open and callers can't be told apart otherwise. Headers
+// such as X-Tenant-ID are up to the caller, so they would let it pick a fresh bucket.
+func rateKey(r *http.Request) string {
+	if id := identityFrom(r.Context()); id != nil {
+		return "tenant " + strconv.Quote(id.Tenant)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "client " + host
+}
+
+// withRateLimit rejects requests of callers exceeding the configured rate
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, err := requestConfig(r)
+		if err != nil || config.RateLimit.RequestsPerSecond <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := rateKey(r)
+		if ok, wait := limiter.allow(key, config.RateLimit, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			writeErrorJSON(w, http.StatusTooManyRequests, fmt.Sprintf("Rate limit of %g requests per second exceeded for %s", config.RateLimit.RequestsPerSecond, key))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	type call struct {
+		key      string
+		at       time.Duration
+		want     bool
+		wantWait time.Duration
+	}
+	tests := []struct {
+		name  string
+		limit RateLimit
+		calls []call
+	}{
+		{
+			name:  "burst then empty",
+			limit: RateLimit{RequestsPerSecond: 1, Burst: 2},
+			calls: []call{{"a", 0, true, 0}, {"a", 0, true, 0}, {"a", 0, false, time.Second}},
+		},
+		{
+			name:  "refills at the sustained rate",
+			limit: RateLimit{RequestsPerSecond: 2, Burst: 1},
+			calls: []call{{"a", 0, true, 0}, {"a", 250 * time.Millisecond, false, 250 * time.Millisecond}, {"a", 500 * time.Millisecond, true, 0}},
+		},
+		{
+			name:  "default burst is one second of requests",
+			limit: RateLimit{RequestsPerSecond: 3},
+			calls: []call{{"a", 0, true, 0}, {"a", 0, true, 0}, {"a", 0, true, 0}, {"a", 0, false, time.Second / 3}},
+		},
+		{
+			name:  "refill is capped at the burst",
+			limit: RateLimit{RequestsPerSecond: 1, Burst: 1},
+			calls: []call{{"a", 0, true, 0}, {"a", time.Hour, true, 0}, {"a", time.Hour, false, time.Second}},
+		},
+		{
+			name:  "callers have separate buckets",
+			limit: RateLimit{RequestsPerSecond: 1, Burst: 1},
+			calls: []call{{"a", 0, true, 0}, {"a", 0, false, time.Second}, {"b", 0, true, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+			for i, c := range tt.calls {
+				ok, wait := l.allow(c.key, tt.limit, start.Add(c.at))
+				if ok != c.want || (wait-c.wantWait).Abs() > time.Millisecond {
+					t.Errorf("call %d: allow = %v, %v; want %v, %v", i, ok, wait, c.want, c.wantWait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterSweepsIdleBuckets(t *testing.T) {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	limit := RateLimit{RequestsPerSecond: 1, Burst: 10}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.allow("idle", limit, start)
+	l.allow("busy", limit, start.Add(rateSweepInterval))
+	l.allow("busy", limit, start.Add(2*rateSweepInterval-5*time.Second))
+	l.allow("new", limit, start.Add(2*rateSweepInterval))
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("refilled bucket was not dropped")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("bucket still refilling was dropped")
+	}
+}
+
+func TestRateKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     *identity
+		header string
+		want   string
+	}{
+		{"open API uses client address", nil, "team-b", "client 192.0.2.1"},
+		{"token tenant", &identity{Tenant: "team-a"}, "team-b", `tenant "team-a"`},
+		{"service token naming another tenant", &identity{Tenant: "gw", Roles: []string{"service"}}, "team-b", `tenant "gw"`},
+		{"admin token naming another tenant", &identity{Tenant: "sre", Roles: []string{"admin"}}, "fresh-bucket", `tenant "sre"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/pixie", nil)
+			if tt.id != nil {
+				r = r.WithContext(context.WithValue(r.Context(), identityKey{}, tt.id))
+			}
+			r.Header.Set(tenantHeader, tt.header)
+			if got := rateKey(r); got != tt.want {
+				t.Errorf("rateKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlersUseRequestConfig(t *testing.T) {
+	// A handler must see the config the middleware saw, not re-read a file that may have
+	// changed since
+	config := &Config{PXClusterID: "from-request", Clusters: map[string]ClusterConfig{"staging": {ClusterID: "staging-id"}}}
+	r := httptest.NewRequest("GET", "/admin/clusters", nil)
+	r = r.WithContext(context.WithValue(r.Context(), configKey{}, &loadedConfig{config: config}))
+	w := httptest.NewRecorder()
+	adminClustersHandler(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "from-request") || !strings.Contains(body, "staging-id") {
+		t.Errorf("handler listed %s, want the clusters of the request's config", body)
+	}
+}
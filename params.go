@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// paramRef matches ${name} placeholders in a PXL script
+var paramRef = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// substituteParams replaces ${name} placeholders with the given values. Values are
+// spliced into the script verbatim, so ones that could break out of a string literal
+// are rejected.
+func substituteParams(script string, params map[string]string) (string, error) {
+	for name, value := range params {
+		if strings.ContainsAny(value, "'\"\\\n\r") {
+			return "", &scriptError{http.StatusBadRequest, "Invalid parameter", fmt.Errorf("value of %q must not contain quotes, backslashes or newlines", name)}
+		}
+	}
+	var missing []string
+	script = paramRef.ReplaceAllStringFunc(script, func(ref string) string {
+		name := paramRef.FindStringSubmatch(ref)[1]
+		value, ok := params[name]
+		if !ok {
+			missing = append(missing, name)
+			return ref
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", &scriptError{http.StatusBadRequest, "Missing parameter", fmt.Errorf("script references undefined parameters: %s", strings.Join(missing, ", "))}
+	}
+	return script, nil
+}
+
+// paramsKey flattens params into a stable string for cache keys
+func paramsKey(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(params[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// DefaultsConfig holds parameters merged into executions that don't set them, so callers
+// sharing scripts don't have to repeat them
+type DefaultsConfig struct {
+	// Clusters maps cluster names ("default" for px_cluster_id) to their defaults
+	Clusters map[string]map[string]string `json:"clusters,omitempty"`
+	// Scripts maps library script names to their defaults, which take precedence over the
+	// cluster's
+	Scripts map[string]map[string]string `json:"scripts,omitempty"`
+}
+
+// lastDefault is the defaults key giving the time range of executions without one, like ?last=
+const lastDefault = "last"
+
+// applyDefaults fills in the configured defaults of the cluster and library script name
+// that opts doesn't set. Only parameters the script uses are filled in: those its
+// manifest declares or, without a manifest, those it references.
+func (c *Config) applyDefaults(cluster, name, script string, m *scriptManifest, opts *execOptions) {
+	if cluster == "" {
+		cluster = "default"
+	}
+	var sources []map[string]string
+	if name != "" {
+		sources = append(sources, c.Defaults.Scripts[name])
+	}
+	sources = append(sources, c.Defaults.Clusters[cluster])
+
+	used := func(param string) bool {
+		if m != nil {
+			_, ok := m.Params[param]
+			return ok
+		}
+		return strings.Contains(script, "${"+param+"}")
+	}
+	var params map[string]string
+	for _, defaults := range sources {
+		for k, v := range defaults {
+			if k == lastDefault {
+				if opts.Range == (timeRange{}) {
+					opts.Range = timeRange{Start: "-" + v}
+				}
+				continue
+			}
+			if _, ok := opts.Params[k]; ok || !used(k) {
+				continue
+			}
+			if params == nil {
+				params = make(map[string]string, len(opts.Params)+len(defaults))
+				for pk, pv := range opts.Params {
+					params[pk] = pv
+				}
+			}
+			params[k] = v
+		}
+		if params != nil {
+			opts.Params = params
+		}
+	}
+}
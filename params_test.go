@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestSubstituteParams(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		params     map[string]string
+		want       string
+		wantStatus int
+	}{
+		{"no placeholders", "px.display(df)", nil, "px.display(df)", 0},
+		{"substitutes every reference", "df[df.ns == '${ns}']\npx.display(df, '${ns}')", map[string]string{"ns": "prod"}, "df[df.ns == 'prod']\npx.display(df, 'prod')", 0},
+		{"unused params are ignored", "df.head(${n})", map[string]string{"n": "10", "other": "x"}, "df.head(10)", 0},
+		{"empty value", "'${ns}'", map[string]string{"ns": ""}, "''", 0},
+		{"missing param", "df.head(${n})", nil, "", http.StatusBadRequest},
+		{"quote breaks out of a literal", "'${ns}'", map[string]string{"ns": "x' + px.now() + '"}, "", http.StatusBadRequest},
+		{"backslash", "'${ns}'", map[string]string{"ns": `x\`}, "", http.StatusBadRequest},
+		{"newline", "'${ns}'", map[string]string{"ns": "x\nimport os"}, "", http.StatusBadRequest},
+		{"values aren't expanded again", "'${a}'", map[string]string{"a": "${b}", "b": "x"}, "'${b}'", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := substituteParams(tt.script, tt.params)
+			if tt.wantStatus != 0 {
+				var se *scriptError
+				if !errors.As(err, &se) || se.status != tt.wantStatus {
+					t.Fatalf("error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("substituteParams() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLockdownRequiresValidatedParams(t *testing.T) {
+	locked := &Config{Lockdown: LockdownConfig{Enabled: true}}
+	tests := []struct {
+		name     string
+		config   *Config
+		source   string
+		manifest *scriptManifest
+		wantErr  bool
+	}{
+		{"no params without manifest", locked, "px.display(df)", nil, false},
+		{"params without manifest", locked, "df.head(${n})", nil, true},
+		{"undeclared param", locked, "df.head(${n})", &scriptManifest{Params: map[string]paramSpec{"m": {Pattern: `\d+`}}}, true},
+		{"param without pattern", locked, "df.head(${n})", &scriptManifest{Params: map[string]paramSpec{"n": {}}}, true},
+		{"declared and validated", locked, "df.head(${n})", &scriptManifest{Params: map[string]paramSpec{"n": {Pattern: `\d+`}}}, false},
+		{"not locked down", &Config{}, "df.head(${n})", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.verifyScript(&libraryScript{Name: "s", Source: tt.source, Manifest: tt.manifest})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyScript() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,537 @@
+// Package client wraps the HTTP API of pixie-data-service for Go programs.
+//
+//	c := client.New("http://pixie-data-service:8080", client.WithToken(os.Getenv("PIXIE_DS_TOKEN")))
+//	res, err := c.ExecuteScript(ctx, client.Request{Script: script, Last: "15m"})
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls a pixie-data-service instance. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+	tenant     string
+	retries    int
+	backoff    time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithToken authenticates requests with one of the service's api_tokens
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithTenant acts on behalf of a tenant; the service honors it for tokens with the admin or
+// service role
+func WithTenant(tenant string) Option {
+	return func(c *Client) { c.tenant = tenant }
+}
+
+// WithHTTPClient replaces http.DefaultClient, e.g. to set transport timeouts
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how often requests are retried after rate limiting, a full queue,
+// gateway errors and connection failures (default 3), and the initial backoff between
+// attempts, which doubles each time (default 500ms). Retry-After headers take precedence.
+// Executions (POST) are only retried after 429 and 503, which the service answers before
+// running the script; a failed connection or gateway error may hide one that ran.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = n, backoff }
+}
+
+// New returns a client for the service at baseURL, e.g. http://localhost:8080
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    3,
+		backoff:    500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is an error response of the service
+type Error struct {
+	Status    int    `json:"status"`
+	Message   string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+	// Limit and Size are set when a configured limit was exceeded
+	Limit int64 `json:"limit,omitempty"`
+	Size  int64 `json:"size,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pixie-data-service: %d %s", e.Status, e.Message)
+}
+
+// ErrNotFound is returned by JobStatus for unknown jobs
+var ErrNotFound = errors.New("pixie-data-service: not found")
+
+// Request is a script execution
+type Request struct {
+	Script string
+	// Params are substituted for ${name} placeholders in the script
+	Params map[string]string
+	// Cluster names a registered cluster; the service's default cluster when empty
+	Cluster string
+
+	// Start and End set the query window as RFC3339 timestamps or offsets like -1h;
+	// Last, e.g. 15m, is shorthand for a window ending now
+	Start, End, Last string
+	// Timeout overrides the service's execution deadline
+	Timeout time.Duration
+	// Priority is the queue priority class: interactive (default), scheduled or export
+	Priority string
+	// Shard splits the window into chunks of this length, e.g. 15m; ShardParallelism
+	// chunks are executed at once
+	Shard            string
+	ShardParallelism int
+	// NoCache asks for a fresh execution instead of a cached result
+	NoCache bool
+}
+
+// query encodes the request options as query parameters
+func (r *Request) query(format string) url.Values {
+	q := url.Values{}
+	set := func(k, v string) {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	set("format", format)
+	set("start", r.Start)
+	set("end", r.End)
+	set("last", r.Last)
+	if r.Timeout > 0 {
+		q.Set("timeout", r.Timeout.String())
+	}
+	set("priority", r.Priority)
+	set("shard", r.Shard)
+	if r.ShardParallelism > 0 {
+		q.Set("shard_parallelism", strconv.Itoa(r.ShardParallelism))
+	}
+	return q
+}
+
+// Column describes a result column
+type Column struct {
+	Name string `json:"name"`
+	// Type is the Pixie data type, e.g. int64 or time64ns
+	Type string `json:"type"`
+	// SemanticType is e.g. duration_ns or pod_name; empty when Pixie has none
+	SemanticType string `json:"semantic_type,omitempty"`
+}
+
+// Stats are the execution statistics reported by Pixie
+type Stats struct {
+	AcceptedBytes    int64         `json:"AcceptedBytes"`
+	TotalBytes       int64         `json:"TotalBytes"`
+	ExecutionTime    time.Duration `json:"ExecutionTime"`
+	CompilationTime  time.Duration `json:"CompilationTime"`
+	BytesProcessed   int64         `json:"BytesProcessed"`
+	RecordsProcessed int64         `json:"RecordsProcessed"`
+}
+
+// Table is an output table of a script
+type Table struct {
+	Name    string     `json:"name"`
+	Columns []string   `json:"columns"`
+	Schema  []Column   `json:"schema"`
+	Rows    [][]string `json:"rows"`
+}
+
+// Result is the outcome of a script execution. Cells are rendered as strings; Schema
+// gives their types.
+type Result struct {
+	Columns []string   `json:"columns"`
+	Schema  []Column   `json:"schema"`
+	Rows    [][]string `json:"rows"`
+	Stats   *Stats     `json:"stats"`
+	// OtherTables holds the output tables after the first when the script displayed more
+	// than one
+	OtherTables []Table `json:"other_tables,omitempty"`
+
+	// Cache is HIT or MISS when the service caches results
+	Cache string `json:"-"`
+	// EstimatedBytes is the projected cost the service admitted the query with, if any
+	EstimatedBytes int64 `json:"-"`
+}
+
+// ExecuteScript runs a PXL script and returns its result
+func (c *Client) ExecuteScript(ctx context.Context, req Request) (*Result, error) {
+	resp, err := c.post(ctx, "/pixie", req.query(""), executeBody(req, true), req.NoCache)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResult(resp)
+}
+
+// RunScript runs a script of the service's library by name. Only Params, Cluster and the
+// query options of req are used.
+func (c *Client) RunScript(ctx context.Context, name string, req Request) (*Result, error) {
+	resp, err := c.post(ctx, "/scripts/"+url.PathEscape(name)+"/run", req.query(""), executeBody(req, false), req.NoCache)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResult(resp)
+}
+
+// StreamScript runs a PXL script and calls fn with each row, keyed by column name, as it
+// is read from the response. Returning an error from fn stops the stream.
+func (c *Client) StreamScript(ctx context.Context, req Request, fn func(row map[string]string) error) error {
+	resp, err := c.post(ctx, "/pixie", req.query("ndjson"), executeBody(req, true), req.NoCache)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		row := make(map[string]string)
+		if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+			return fmt.Errorf("pixie-data-service: malformed row: %w", err)
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// Param describes a parameter accepted by a library script
+type Param struct {
+	Description string `json:"description,omitempty"`
+	Default     string `json:"default,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	Pattern     string `json:"pattern,omitempty"`
+}
+
+// Manifest holds the guardrails of a library script
+type Manifest struct {
+	Description  string           `json:"description,omitempty"`
+	Params       map[string]Param `json:"params,omitempty"`
+	DefaultRange string           `json:"default_range,omitempty"`
+	MaxRange     string           `json:"max_range,omitempty"`
+	Timeout      string           `json:"timeout,omitempty"`
+	MaxTimeout   string           `json:"max_timeout,omitempty"`
+	Clusters     []string         `json:"clusters,omitempty"`
+	Role         string           `json:"role,omitempty"`
+}
+
+// Script is a script of the service's library
+type Script struct {
+	Name     string    `json:"name"`
+	Manifest *Manifest `json:"manifest,omitempty"`
+}
+
+// ListScripts returns the scripts of the service's library
+func (c *Client) ListScripts(ctx context.Context) ([]Script, error) {
+	var out struct {
+		Scripts []Script `json:"scripts"`
+	}
+	if err := c.getJSON(ctx, "/scripts", &out); err != nil {
+		return nil, err
+	}
+	return out.Scripts, nil
+}
+
+// Job is a scheduled export job and the state of its runs
+type Job struct {
+	Name        string `json:"name"`
+	Script      string `json:"script"`
+	Cluster     string `json:"cluster"`
+	Interval    string `json:"interval"`
+	Destination string `json:"destination"`
+
+	Running     bool       `json:"running"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// WindowEnd is the end of the last exported window, where the next run starts
+	WindowEnd *time.Time `json:"window_end,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	LastRows  int        `json:"last_rows"`
+	Runs      uint64     `json:"runs"`
+	Failures  uint64     `json:"failures"`
+}
+
+// Jobs returns the scheduled export jobs
+func (c *Client) Jobs(ctx context.Context) ([]Job, error) {
+	var out struct {
+		Exports []Job `json:"exports"`
+	}
+	if err := c.getJSON(ctx, "/exports", &out); err != nil {
+		return nil, err
+	}
+	return out.Exports, nil
+}
+
+// JobStatus returns the state of one scheduled export job, or ErrNotFound
+func (c *Client) JobStatus(ctx context.Context, name string) (*Job, error) {
+	jobs, err := c.Jobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		if jobs[i].Name == name {
+			return &jobs[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Query is a script execution in flight
+type Query struct {
+	ID        string `json:"id"`
+	RequestID string `json:"request_id,omitempty"`
+	Caller    string `json:"caller"`
+	Script    string `json:"script"`
+	Cluster   string `json:"cluster"`
+	// State is "queued", "running" or "cancelling"
+	State          string    `json:"state"`
+	StartedAt      time.Time `json:"started_at"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	RowsStreamed   int64     `json:"rows_streamed"`
+}
+
+// Queries returns the executions in flight visible to the caller, oldest first
+func (c *Client) Queries(ctx context.Context) ([]Query, error) {
+	var out struct {
+		Queries []Query `json:"queries"`
+	}
+	if err := c.getJSON(ctx, "/queries", &out); err != nil {
+		return nil, err
+	}
+	return out.Queries, nil
+}
+
+// CancelQuery cancels an execution in flight by its ID
+func (c *Client) CancelQuery(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.baseURL+"/queries/"+url.PathEscape(id), nil, false)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Snapshot is a result stored by the service under a shareable link
+type Snapshot struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	Script    string    `json:"script"`
+	Cluster   string    `json:"cluster"`
+	Caller    string    `json:"caller"`
+	Rows      int       `json:"rows"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateSnapshot runs a PXL script and stores its result for ttl, or the service's
+// default lifetime when ttl is 0
+func (c *Client) CreateSnapshot(ctx context.Context, req Request, ttl time.Duration) (*Snapshot, error) {
+	return c.snapshot(ctx, req.query(""), snapshotBody(executeBody(req, true), ttl))
+}
+
+// SnapshotFromHistory stores the archived result of a query for ttl, or the service's
+// default lifetime when ttl is 0
+func (c *Client) SnapshotFromHistory(ctx context.Context, historyID int64, ttl time.Duration) (*Snapshot, error) {
+	body, _ := json.Marshal(map[string]int64{"history_id": historyID})
+	return c.snapshot(ctx, nil, snapshotBody(body, ttl))
+}
+
+// GetSnapshot returns the result stored under a snapshot token
+func (c *Client) GetSnapshot(ctx context.Context, token string) (*Result, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.baseURL+"/snapshots/"+url.PathEscape(token), nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResult(resp)
+}
+
+func (c *Client) snapshot(ctx context.Context, q url.Values, body []byte) (*Snapshot, error) {
+	resp, err := c.post(ctx, "/pixie/snapshot", q, body, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var snap Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("pixie-data-service: malformed response: %w", err)
+	}
+	// Without a configured base URL the service returns links relative to itself
+	if strings.HasPrefix(snap.URL, "/") {
+		snap.URL = c.baseURL + snap.URL
+	}
+	return &snap, nil
+}
+
+// snapshotBody adds the ttl field to a JSON request body
+func snapshotBody(body []byte, ttl time.Duration) []byte {
+	if ttl <= 0 {
+		return body
+	}
+	var fields map[string]interface{}
+	json.Unmarshal(body, &fields)
+	fields["ttl"] = ttl.String()
+	data, _ := json.Marshal(fields)
+	return data
+}
+
+// executeBody encodes the JSON body of an execution
+func executeBody(req Request, withScript bool) []byte {
+	body := map[string]interface{}{}
+	if withScript {
+		body["script"] = req.Script
+	}
+	if len(req.Params) > 0 {
+		body["params"] = req.Params
+	}
+	if req.Cluster != "" {
+		body["cluster"] = req.Cluster
+	}
+	data, _ := json.Marshal(body)
+	return data
+}
+
+// decodeResult reads a JSON result along with the headers describing it
+func decodeResult(resp *http.Response) (*Result, error) {
+	defer resp.Body.Close()
+	var res Result
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("pixie-data-service: malformed result: %w", err)
+	}
+	res.Cache = resp.Header.Get("X-Cache")
+	if v := resp.Header.Get("X-Estimated-Bytes"); v != "" {
+		res.EstimatedBytes, _ = strconv.ParseInt(v, 10, 64)
+	}
+	return &res, nil
+}
+
+func (c *Client) post(ctx context.Context, path string, q url.Values, body []byte, noCache bool) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return c.do(ctx, http.MethodPost, u, body, noCache)
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, out interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, c.baseURL+path, nil, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("pixie-data-service: malformed response: %w", err)
+	}
+	return nil
+}
+
+// idempotent reports whether a request can be sent again without side effects even if the
+// first attempt reached the service
+func idempotent(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// retryable reports whether a response status is worth another attempt. Requests that
+// aren't idempotent are only retried when the status proves they weren't carried out.
+func retryable(method string, status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent(method)
+	}
+	return false
+}
+
+// do sends a request, retrying transient failures. Non-2xx responses are returned as *Error.
+func (c *Client) do(ctx context.Context, method, u string, body []byte, noCache bool) (*http.Response, error) {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if c.tenant != "" {
+			req.Header.Set("X-Tenant-ID", c.tenant)
+		}
+		if noCache {
+			req.Header.Set("Cache-Control", "no-cache")
+		}
+
+		resp, err := c.httpClient.Do(req)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || !idempotent(method) || attempt >= c.retries {
+				return nil, err
+			}
+		case resp.StatusCode < 300:
+			return resp, nil
+		default:
+			apiErr := readError(resp)
+			if !retryable(method, resp.StatusCode) || attempt >= c.retries {
+				return nil, apiErr
+			}
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+				wait = time.Duration(s) * time.Second
+			}
+		}
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// readError turns an error response into an *Error. The service answers with JSON or,
+// on some endpoints, plain text.
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	e := &Error{Status: resp.StatusCode}
+	if json.Unmarshal(data, e) != nil || e.Message == "" {
+		e.Message = strings.TrimSpace(string(data))
+	}
+	e.Status = resp.StatusCode
+	if e.RequestID == "" {
+		e.RequestID = resp.Header.Get("X-Request-ID")
+	}
+	return e
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status int
+		want   int32
+	}{
+		{"execution rate limited", http.MethodPost, http.StatusTooManyRequests, 3},
+		{"execution with a full queue", http.MethodPost, http.StatusServiceUnavailable, 3},
+		{"execution behind a gateway error", http.MethodPost, http.StatusBadGateway, 1},
+		{"execution timed out at the gateway", http.MethodPost, http.StatusGatewayTimeout, 1},
+		{"read behind a gateway error", http.MethodGet, http.StatusBadGateway, 3},
+		{"bad request", http.MethodGet, http.StatusBadRequest, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				http.Error(w, "nope", tt.status)
+			}))
+			defer srv.Close()
+			c := New(srv.URL, WithRetries(2, time.Millisecond))
+			if _, err := c.do(context.Background(), tt.method, srv.URL+"/pixie", nil, false); err == nil {
+				t.Fatal("request succeeded")
+			}
+			if got := attempts.Load(); got != tt.want {
+				t.Errorf("%d attempts, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoRetryOfExecutionsAfterConnectionFailure(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		// The script may have run by the time the connection drops
+		hj, _ := w.(http.Hijacker)
+		conn, _, _ := hj.Hijack()
+		conn.Close()
+	}))
+	defer srv.Close()
+	c := New(srv.URL, WithRetries(2, time.Millisecond))
+
+	if _, err := c.do(context.Background(), http.MethodPost, srv.URL+"/pixie", []byte(`{}`), false); err == nil {
+		t.Fatal("request succeeded")
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("POST sent %d times, want once", got)
+	}
+	attempts.Store(0)
+	if _, err := c.do(context.Background(), http.MethodGet, srv.URL+"/history", nil, false); err == nil {
+		t.Fatal("request succeeded")
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("GET sent %d times, want 3", got)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"px.dev/pxapi"
+)
+
+// vizierPool caches Pixie cloud clients per credentials and Vizier clients per cluster,
+// so requests don't pay for a new cloud connection each time. pxapi offers no way to close a
+// client, so dropped clients are only unreferenced: with no calls left, gRPC takes their
+// connections idle after its default idle timeout of 30 minutes.
+type vizierPool struct {
+	mu      sync.Mutex
+	clients map[string]*pxapi.Client
+	viziers map[string]*pxapi.VizierClient
+	// health records the outcome of recent queries per cluster ID
+	health map[string]*clusterHealth
+	// gen is bumped whenever cloud clients are dropped, so a client whose creation raced
+	// the drop isn't pooled
+	gen uint64
+	// flights creates each client once, outside mu, however many requests ask for it
+	flights singleflight.Group
+}
+
+var pool = &vizierPool{
+	clients: make(map[string]*pxapi.Client),
+	viziers: make(map[string]*pxapi.VizierClient),
+	health:  make(map[string]*clusterHealth),
+}
+
+// clusterHealth is what the pool has observed of queries against one cluster
+type clusterHealth struct {
+	LastSuccess time.Time
+	LastError   time.Time
+	Error       string
+}
+
+// newCloudClient connects to the Pixie cloud with the config's credentials
+func newCloudClient(ctx context.Context, config *Config) (*pxapi.Client, error) {
+	client, err := pxapi.NewClient(
+		ctx,
+		pxapi.WithAPIKey(config.PXAPIKey),
+		pxapi.WithCloudAddr(config.CloudAddr),
+		pxapi.WithE2EEncryption(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Pixie API client: %w", err)
+	}
+	return client, nil
+}
+
+// cloudClient returns the cached cloud client for the config's credentials, creating it if
+// needed
+func (p *vizierPool) cloudClient(ctx context.Context, config *Config) (*pxapi.Client, error) {
+	key := config.PXAPIKey + "\x00" + config.CloudAddr
+	p.mu.Lock()
+	if client, ok := p.clients[key]; ok {
+		p.mu.Unlock()
+		return client, nil
+	}
+	gen := p.gen
+	p.mu.Unlock()
+
+	v, err, _ := p.flights.Do("cloud\x00"+key, func() (interface{}, error) {
+		client, err := newCloudClient(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// Dropped while it was being created: serve this request without pooling it
+		if p.gen == gen {
+			p.clients[key] = client
+		}
+		return client, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*pxapi.Client), nil
+}
+
+// get returns a Vizier client for the cluster, creating and caching it if needed. Creation
+// happens outside the pool's lock, so a slow cluster doesn't hold up the others.
+func (p *vizierPool) get(ctx context.Context, config *Config, clusterID string) (*pxapi.VizierClient, error) {
+	key := config.PXAPIKey + "\x00" + config.CloudAddr + "\x00" + clusterID
+	p.mu.Lock()
+	if vz, ok := p.viziers[key]; ok {
+		p.mu.Unlock()
+		return vz, nil
+	}
+	gen := p.gen
+	p.mu.Unlock()
+
+	v, err, _ := p.flights.Do(key, func() (interface{}, error) {
+		client, err := p.cloudClient(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		vz, err := client.NewVizierClient(ctx, clusterID)
+		if err != nil {
+			return nil, fmt.Errorf("could not create Vizier client: %w", err)
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.gen == gen {
+			p.viziers[key] = vz
+		}
+		return vz, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*pxapi.VizierClient), nil
+}
+
+// vizierInfo asks the Pixie cloud about a cluster using the config's credentials
+func (p *vizierPool) vizierInfo(ctx context.Context, config *Config, clusterID string) (*pxapi.VizierInfo, error) {
+	client, err := p.cloudClient(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetVizierInfo(ctx, clusterID)
+}
+
+// checkCredentials asks the Pixie cloud about a cluster with a client that isn't pooled,
+// for credentials that may well be rejected
+func checkCredentials(ctx context.Context, config *Config, clusterID string) (*pxapi.VizierInfo, error) {
+	client, err := newCloudClient(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetVizierInfo(ctx, clusterID)
+}
+
+// invalidate drops cached clients for a cluster, or all of them if clusterID is empty
+func (p *vizierPool) invalidate(clusterID string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	if clusterID == "" {
+		n = len(p.viziers)
+		p.gen++
+		p.clients = make(map[string]*pxapi.Client)
+		p.viziers = make(map[string]*pxapi.VizierClient)
+		return n
+	}
+	for key := range p.viziers {
+		if strings.HasSuffix(key, "\x00"+clusterID) {
+			delete(p.viziers, key)
+			n++
+		}
+	}
+	return n
+}
+
+// refresh drops the cloud client a cluster's Vizier client was created from, along with
+// every Vizier client sharing its connection, so the next get authenticates from scratch
+func (p *vizierPool) refresh(config *Config, clusterID string) {
+	key := config.PXAPIKey + "\x00" + config.CloudAddr
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for vkey := range p.viziers {
+		if strings.HasPrefix(vkey, key+"\x00") {
+			delete(p.viziers, vkey)
+		}
+	}
+	delete(p.clients, key)
+	p.gen++
+}
+
+// isAuthError reports whether Pixie rejected a client's credentials
+func isAuthError(err error) bool {
+	return err != nil && status.Code(err) == codes.Unauthenticated
+}
+
+// observe records the outcome of a query against a cluster. Client errors such as invalid
+// scripts say nothing about the cluster and are ignored.
+func (p *vizierPool) observe(clusterID string, err error) {
+	outcome := outcomeOf(err)
+	if outcome == outcomeClientError {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.health[clusterID]
+	if !ok {
+		h = &clusterHealth{}
+		p.health[clusterID] = h
+	}
+	if outcome == outcomeSuccess {
+		h.LastSuccess = time.Now()
+		return
+	}
+	h.LastError, h.Error = time.Now(), err.Error()
+}
+
+// clusterState reports the observed health of a cluster and whether a Vizier client for it
+// is pooled
+func (p *vizierPool) clusterState(clusterID string) (health clusterHealth, pooled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok := p.health[clusterID]; ok {
+		health = *h
+	}
+	for key := range p.viziers {
+		if strings.HasSuffix(key, "\x00"+clusterID) {
+			pooled = true
+			break
+		}
+	}
+	return health, pooled
+}
+
+// size reports the number of cached cloud and Vizier clients
+func (p *vizierPool) size() (clients, viziers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.clients), len(p.viziers)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"px.dev/pxapi"
+)
+
+func newTestPool() *vizierPool {
+	return &vizierPool{
+		clients: make(map[string]*pxapi.Client),
+		viziers: make(map[string]*pxapi.VizierClient),
+		health:  make(map[string]*clusterHealth),
+	}
+}
+
+var testPoolConfig = &Config{PXAPIKey: "px-api-test", CloudAddr: "127.0.0.1:1", PXClusterID: "40f0f023-d641-429a-b22a-7895147da800"}
+
+func TestPoolGetSharesClients(t *testing.T) {
+	p := newTestPool()
+	var wg sync.WaitGroup
+	viziers := make([]*pxapi.VizierClient, 8)
+	for i := range viziers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vz, err := p.get(context.Background(), testPoolConfig, "cluster-a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			viziers[i] = vz
+		}()
+	}
+	wg.Wait()
+	for _, vz := range viziers[1:] {
+		if vz != viziers[0] {
+			t.Fatal("concurrent gets created more than one Vizier client")
+		}
+	}
+	if clients, vzs := p.size(); clients != 1 || vzs != 1 {
+		t.Errorf("pool holds %d cloud and %d Vizier clients, want 1 and 1", clients, vzs)
+	}
+}
+
+func TestPoolRefreshDropsSharedClients(t *testing.T) {
+	p := newTestPool()
+	a, err := p.get(context.Background(), testPoolConfig, "cluster-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.get(context.Background(), testPoolConfig, "cluster-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both Vizier clients share the rejected cloud client's connection
+	p.refresh(testPoolConfig, "cluster-a")
+	if clients, vzs := p.size(); clients != 0 || vzs != 0 {
+		t.Fatalf("pool holds %d cloud and %d Vizier clients after refresh, want none", clients, vzs)
+	}
+
+	// The next get authenticates from scratch
+	again, err := p.get(context.Background(), testPoolConfig, "cluster-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == a {
+		t.Error("refresh kept the rejected Vizier client")
+	}
+	if clients, vzs := p.size(); clients != 1 || vzs != 1 {
+		t.Errorf("pool holds %d cloud and %d Vizier clients, want new ones", clients, vzs)
+	}
+}
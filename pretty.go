@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"px.dev/pxapi/proto/vizierpb"
+	"px.dev/pxapi/types"
+)
+
+// columnSchema describes a result column, including the semantic type Pixie assigns to it
+type columnSchema struct {
+	Name string `json:"name"`
+	// Type is the Pixie data type, e.g. int64 or time64ns
+	Type string `json:"type"`
+	// SemanticType is e.g. duration_ns, bytes, percent or pod_name; empty when Pixie has none
+	SemanticType string `json:"semantic_type,omitempty"`
+
+	semantic vizierpb.SemanticType
+}
+
+// newColumnSchema converts Pixie column metadata
+func newColumnSchema(col types.ColSchema) columnSchema {
+	s := columnSchema{Name: col.Name, Type: strings.ToLower(col.Type.String()), semantic: col.SemanticType}
+	if col.SemanticType != vizierpb.ST_UNSPECIFIED && col.SemanticType != vizierpb.ST_NONE {
+		s.SemanticType = strings.ToLower(strings.TrimPrefix(col.SemanticType.String(), "ST_"))
+	}
+	return s
+}
+
+// UnmarshalJSON restores the semantic type of columns decoded from archived results and
+// snapshots, which only carry its name
+func (s *columnSchema) UnmarshalJSON(data []byte) error {
+	type plain columnSchema
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+	s.semantic = vizierpb.SemanticType(vizierpb.SemanticType_value["ST_"+strings.ToUpper(s.SemanticType)])
+	return nil
+}
+
+// prettify rewrites cells of columns with a numeric semantic type into human-readable form,
+// e.g. 12.3ms, 4.2MiB or 42.0%. Cells that don't parse are left as they are.
+func (q *queryResult) prettify() {
+	for c, col := range q.Schema {
+		format := prettyFormatter(col.semantic)
+		if format == nil {
+			continue
+		}
+		for _, row := range q.Rows {
+			if c < len(row) {
+				if v, ok := format(row[c]); ok {
+					row[c] = v
+				}
+			}
+		}
+	}
+}
+
+// prettyFormatter returns the renderer for a semantic type, or nil if it has none
+func prettyFormatter(st vizierpb.SemanticType) func(string) (string, bool) {
+	switch st {
+	case vizierpb.ST_DURATION_NS:
+		return numeric(formatDuration)
+	case vizierpb.ST_BYTES:
+		return numeric(formatBytes)
+	case vizierpb.ST_PERCENT:
+		return numeric(func(v float64) string { return strconv.FormatFloat(v*100, 'f', 1, 64) + "%" })
+	case vizierpb.ST_THROUGHPUT_PER_NS:
+		return numeric(func(v float64) string { return formatSI(v*1e9) + "/s" })
+	case vizierpb.ST_THROUGHPUT_BYTES_PER_NS:
+		return numeric(func(v float64) string { return formatBytes(v*1e9) + "/s" })
+	case vizierpb.ST_DURATION_NS_QUANTILES:
+		return formatQuantiles
+	}
+	return nil
+}
+
+// numeric adapts a float renderer to string cells
+func numeric(format func(float64) string) func(string) (string, bool) {
+	return func(cell string) (string, bool) {
+		v, err := strconv.ParseFloat(cell, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return format(v), true
+	}
+}
+
+// formatDuration renders nanoseconds with one decimal in the largest fitting unit
+func formatDuration(ns float64) string {
+	abs := math.Abs(ns)
+	switch {
+	case abs < 1e3:
+		return strconv.FormatFloat(ns, 'f', 0, 64) + "ns"
+	case abs < 1e6:
+		return strconv.FormatFloat(ns/1e3, 'f', 1, 64) + "µs"
+	case abs < 1e9:
+		return strconv.FormatFloat(ns/1e6, 'f', 1, 64) + "ms"
+	case abs < 60e9:
+		return strconv.FormatFloat(ns/1e9, 'f', 1, 64) + "s"
+	}
+	return time.Duration(ns).Round(time.Second).String()
+}
+
+// formatBytes renders a byte count with binary prefixes
+func formatBytes(b float64) string {
+	const units = "KMGTPE"
+	if math.Abs(b) < 1024 {
+		return strconv.FormatFloat(b, 'f', 0, 64) + "B"
+	}
+	i := -1
+	for math.Abs(b) >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	return strconv.FormatFloat(b, 'f', 1, 64) + string(units[i]) + "iB"
+}
+
+// formatSI renders a count with decimal prefixes
+func formatSI(v float64) string {
+	const units = "kMGTPE"
+	if math.Abs(v) < 1000 {
+		return strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	i := -1
+	for math.Abs(v) >= 1000 && i < len(units)-1 {
+		v /= 1000
+		i++
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + string(units[i])
+}
+
+// formatQuantiles renders a JSON quantile object such as {"p50": 1200000, "p99": 3400000}
+// as "p50=1.2ms p99=3.4ms"
+func formatQuantiles(cell string) (string, bool) {
+	var quantiles map[string]float64
+	if err := json.Unmarshal([]byte(cell), &quantiles); err != nil || len(quantiles) == 0 {
+		return "", false
+	}
+	keys := make([]string, 0, len(quantiles))
+	for k := range quantiles {
+		keys = append(keys, k)
+	}
+	// Order p1, p10, p50, p90, p99 numerically
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := strconv.ParseFloat(strings.TrimPrefix(keys[i], "p"), 64)
+		b, _ := strconv.ParseFloat(strings.TrimPrefix(keys[j], "p"), 64)
+		return a < b
+	})
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%s", k, formatDuration(quantiles[k]))
+	}
+	return strings.Join(parts, " "), true
+}
+
+// prettyRequested reports whether the caller asked for ?pretty=true
+func prettyRequested(r *http.Request) bool {
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	return pretty
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errQueryCancelled is the cause of executions cancelled through DELETE /queries/{id}
+var errQueryCancelled = errors.New("query cancelled")
+
+// liveQuery is a script execution that is queued or running
+type liveQuery struct {
+	id, requestID   string
+	caller          string
+	script, cluster string
+	startedAt       time.Time
+	cancel          context.CancelCauseFunc
+	running         atomic.Bool
+	cancelled       atomic.Bool
+	// rows counts the rows streamed so far by the current attempt
+	rows atomic.Int64
+}
+
+// queryRegistry tracks the executions in flight so they can be listed and cancelled
+type queryRegistry struct {
+	mu      sync.Mutex
+	queries map[string]*liveQuery
+}
+
+var queries = &queryRegistry{queries: make(map[string]*liveQuery)}
+
+// register tracks an execution until the returned function is called. The returned
+// context is cancelled with errQueryCancelled when the execution is cancelled.
+func (g *queryRegistry) register(ctx context.Context, opts execOptions, script string) (context.Context, *liveQuery, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	b := make([]byte, 8)
+	rand.Read(b)
+	q := &liveQuery{
+		id:        hex.EncodeToString(b),
+		requestID: requestIDFrom(ctx),
+		caller:    opts.Tenant,
+		script:    cmp.Or(opts.Name, scriptID(script)),
+		cluster:   opts.ClusterID,
+		startedAt: time.Now(),
+		cancel:    cancel,
+	}
+	g.mu.Lock()
+	g.queries[q.id] = q
+	g.mu.Unlock()
+	return ctx, q, func() {
+		g.mu.Lock()
+		delete(g.queries, q.id)
+		g.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// active counts the executions past the queue
+func (g *queryRegistry) active() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for _, q := range g.queries {
+		if q.running.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+// visible reports whether the caller may see and cancel q: callers authenticated with an
+// API token only see their own tenant's executions
+func (q *liveQuery) visible(caller *identity) bool {
+	return caller == nil || caller.Tenant == q.caller
+}
+
+// queryInfo is the listing of a liveQuery
+type queryInfo struct {
+	ID             string    `json:"id"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Caller         string    `json:"caller"`
+	Script         string    `json:"script"`
+	Cluster        string    `json:"cluster"`
+	State          string    `json:"state"`
+	StartedAt      time.Time `json:"started_at"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	RowsStreamed   int64     `json:"rows_streamed"`
+}
+
+// queriesHandler lists the executions in flight, oldest first
+func queriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	caller := identityFrom(r.Context())
+	now := time.Now()
+	list := []queryInfo{}
+	queries.mu.Lock()
+	for _, q := range queries.queries {
+		if !q.visible(caller) {
+			continue
+		}
+		state := "queued"
+		if q.cancelled.Load() {
+			state = "cancelling"
+		} else if q.running.Load() {
+			state = "running"
+		}
+		list = append(list, queryInfo{
+			ID: q.id, RequestID: q.requestID, Caller: q.caller, Script: q.script, Cluster: q.cluster,
+			State: state, StartedAt: q.startedAt, ElapsedSeconds: now.Sub(q.startedAt).Seconds(), RowsStreamed: q.rows.Load(),
+		})
+	}
+	queries.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	writeJSON(w, map[string]interface{}{"queries": list})
+}
+
+// queryHandler cancels an execution in flight. Its caller gets a 409.
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Only DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	queries.mu.Lock()
+	q, ok := queries.queries[r.PathValue("id")]
+	queries.mu.Unlock()
+	if !ok || !q.visible(identityFrom(r.Context())) {
+		http.Error(w, "Unknown query", http.StatusNotFound)
+		return
+	}
+	if q.cancelled.Swap(true) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	q.cancel(errQueryCancelled)
+	log.Printf("Query %s (%s on %s, caller %s) cancelled via API\n", q.id, q.script, q.cluster, q.caller)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueueConfig bounds how many scripts execute at once. Executions beyond the limit wait
+// in a priority queue instead of piling onto the clusters.
+type QueueConfig struct {
+	// MaxConcurrent is the number of executions running at once; queueing is disabled when 0
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// MaxDepth bounds the executions waiting for a slot (default 100); further ones are
+	// rejected with 503
+	MaxDepth int `json:"max_depth,omitempty"`
+}
+
+const defaultQueueDepth = 100
+
+func (c QueueConfig) maxDepth() int {
+	if c.MaxDepth <= 0 {
+		return defaultQueueDepth
+	}
+	return c.MaxDepth
+}
+
+// priority orders waiting executions; lower values are started first
+type priority int
+
+const (
+	priorityInteractive priority = iota
+	priorityScheduled
+	priorityExport
+)
+
+var priorityNames = [...]string{"interactive", "scheduled", "export"}
+
+// parsePriority resolves a priority class by name, defaulting to def when empty
+func parsePriority(name string, def priority) (priority, error) {
+	if name == "" {
+		return def, nil
+	}
+	for p, n := range priorityNames {
+		if n == name {
+			return priority(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q, expected one of %s", name, strings.Join(priorityNames[:], ", "))
+}
+
+// queueWaiter is an execution waiting for a slot
+type queueWaiter struct {
+	tenant  string
+	ready   chan struct{}
+	granted bool
+}
+
+// queueStats are the queue metrics of one priority class
+type queueStats struct {
+	waitBuckets []uint64
+	waitSum     float64
+	waitCount   uint64
+	full        uint64
+	timeouts    uint64
+}
+
+// queryQueue hands out execution slots. Higher priority classes always go first; within
+// a class the tenant with the fewest running executions does, taking turns on ties, so
+// one tenant flooding the service can't starve the others.
+type queryQueue struct {
+	mu       sync.Mutex
+	max      int
+	running  int
+	byTenant map[string]int
+	// granted is the sequence number of each active tenant's latest slot, for taking turns
+	granted map[string]uint64
+	seq     uint64
+	waiting [len(priorityNames)][]*queueWaiter
+	stats   [len(priorityNames)]queueStats
+}
+
+var queue = newQueryQueue()
+
+func newQueryQueue() *queryQueue {
+	q := &queryQueue{byTenant: make(map[string]int), granted: make(map[string]uint64)}
+	for i := range q.stats {
+		q.stats[i].waitBuckets = make([]uint64, len(latencyBuckets))
+	}
+	return q
+}
+
+// acquire waits for an execution slot until ctx is done. The returned function gives the
+// slot back.
+func (q *queryQueue) acquire(ctx context.Context, cfg QueueConfig, p priority, tenant string) (func(), error) {
+	enqueued := time.Now()
+	q.mu.Lock()
+	// The limit follows the config seen by the latest execution
+	q.max = cfg.MaxConcurrent
+	if q.depth() == 0 && (q.max <= 0 || q.running < q.max) {
+		q.start(tenant)
+		q.observeWait(p, 0)
+		q.mu.Unlock()
+		return q.releaser(tenant), nil
+	}
+	if n := q.depth(); n >= cfg.maxDepth() {
+		q.stats[p].full++
+		q.mu.Unlock()
+		return nil, &scriptError{http.StatusServiceUnavailable, "Query queue is full", fmt.Errorf("%d executions are already waiting for one of %d slots", n, cfg.MaxConcurrent)}
+	}
+	w := &queueWaiter{tenant: tenant, ready: make(chan struct{})}
+	q.waiting[p] = append(q.waiting[p], w)
+	// A raised limit may have freed slots no release has handed out yet
+	q.dispatch()
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		q.mu.Lock()
+		if !w.granted {
+			q.remove(p, w)
+			q.stats[p].timeouts++
+			q.mu.Unlock()
+			return nil, ctx.Err()
+		}
+		// The slot was granted while giving up, so it's used after all
+		q.mu.Unlock()
+	}
+	q.mu.Lock()
+	q.observeWait(p, time.Since(enqueued))
+	q.mu.Unlock()
+	return q.releaser(tenant), nil
+}
+
+// depth is the number of waiting executions. q.mu must be held.
+func (q *queryQueue) depth() int {
+	n := 0
+	for _, ws := range q.waiting {
+		n += len(ws)
+	}
+	return n
+}
+
+// start counts a running execution of tenant. q.mu must be held.
+func (q *queryQueue) start(tenant string) {
+	q.running++
+	q.byTenant[tenant]++
+	q.seq++
+	q.granted[tenant] = q.seq
+}
+
+func (q *queryQueue) releaser(tenant string) func() {
+	var once sync.Once
+	return func() { once.Do(func() { q.release(tenant) }) }
+}
+
+// release frees a slot of tenant
+func (q *queryQueue) release(tenant string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	if q.byTenant[tenant]--; q.byTenant[tenant] <= 0 {
+		delete(q.byTenant, tenant)
+		if !q.isWaiting(tenant) {
+			delete(q.granted, tenant)
+		}
+	}
+	q.dispatch()
+}
+
+// dispatch grants free slots to waiting executions. q.mu must be held.
+func (q *queryQueue) dispatch() {
+	for q.max <= 0 || q.running < q.max {
+		w := q.next()
+		if w == nil {
+			return
+		}
+		w.granted = true
+		q.start(w.tenant)
+		close(w.ready)
+	}
+}
+
+// isWaiting reports whether tenant has an execution in the queue. q.mu must be held.
+func (q *queryQueue) isWaiting(tenant string) bool {
+	for _, ws := range q.waiting {
+		for _, w := range ws {
+			if w.tenant == tenant {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// next dequeues the waiter of the highest priority class whose tenant has the fewest
+// running executions, then the one granted a slot least recently, then the longest
+// waiting. q.mu must be held.
+func (q *queryQueue) next() *queueWaiter {
+	for p, ws := range q.waiting {
+		if len(ws) == 0 {
+			continue
+		}
+		best := 0
+		for i, w := range ws {
+			n, m := q.byTenant[w.tenant], q.byTenant[ws[best].tenant]
+			if n < m || (n == m && q.granted[w.tenant] < q.granted[ws[best].tenant]) {
+				best = i
+			}
+		}
+		w := ws[best]
+		q.remove(priority(p), w)
+		return w
+	}
+	return nil
+}
+
+// remove drops a waiter from its class. q.mu must be held.
+func (q *queryQueue) remove(p priority, w *queueWaiter) {
+	ws := q.waiting[p]
+	for i := range ws {
+		if ws[i] == w {
+			q.waiting[p] = append(ws[:i:i], ws[i+1:]...)
+			return
+		}
+	}
+}
+
+// observeWait records how long an execution waited for its slot. q.mu must be held.
+func (q *queryQueue) observeWait(p priority, d time.Duration) {
+	s := &q.stats[p]
+	seconds := d.Seconds()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			s.waitBuckets[i]++
+		}
+	}
+	s.waitSum += seconds
+	s.waitCount++
+}
+
+// state summarizes the queue for /debug/state
+func (q *queryQueue) state() map[string]interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting := make(map[string]int, len(priorityNames))
+	for p, ws := range q.waiting {
+		waiting[priorityNames[p]] = len(ws)
+	}
+	return map[string]interface{}{
+		"max_concurrent": q.max,
+		"running":        q.running,
+		"waiting":        waiting,
+	}
+}
+
+// writeMetrics appends the queue metrics in the Prometheus text exposition format
+func (q *queryQueue) writeMetrics(b *strings.Builder) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b.WriteString("# HELP pixie_queue_wait_seconds Time executions waited for a slot, by priority class.\n")
+	b.WriteString("# TYPE pixie_queue_wait_seconds histogram\n")
+	for p, name := range priorityNames {
+		s := &q.stats[p]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(b, "pixie_queue_wait_seconds_bucket{priority=%q,le=%q} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), s.waitBuckets[i])
+		}
+		fmt.Fprintf(b, "pixie_queue_wait_seconds_bucket{priority=%q,le=\"+Inf\"} %d\n", name, s.waitCount)
+		fmt.Fprintf(b, "pixie_queue_wait_seconds_sum{priority=%q} %g\n", name, s.waitSum)
+		fmt.Fprintf(b, "pixie_queue_wait_seconds_count{priority=%q} %d\n", name, s.waitCount)
+	}
+	b.WriteString("# HELP pixie_queue_depth Executions waiting for a slot, by priority class.\n")
+	b.WriteString("# TYPE pixie_queue_depth gauge\n")
+	for p, name := range priorityNames {
+		fmt.Fprintf(b, "pixie_queue_depth{priority=%q} %d\n", name, len(q.waiting[p]))
+	}
+	b.WriteString("# HELP pixie_queue_rejected_total Executions that never got a slot, by priority class and reason.\n")
+	b.WriteString("# TYPE pixie_queue_rejected_total counter\n")
+	for p, name := range priorityNames {
+		fmt.Fprintf(b, "pixie_queue_rejected_total{priority=%q,reason=\"full\"} %d\n", name, q.stats[p].full)
+		fmt.Fprintf(b, "pixie_queue_rejected_total{priority=%q,reason=\"timeout\"} %d\n", name, q.stats[p].timeouts)
+	}
+}
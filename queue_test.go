@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueueDispatchOrder(t *testing.T) {
+	type waiter struct {
+		p    priority
+		name string
+	}
+	tests := []struct {
+		name    string
+		running map[string]int
+		granted map[string]uint64
+		waiters []waiter
+		want    []string
+	}{
+		{
+			name:    "higher priority classes first",
+			waiters: []waiter{{priorityExport, "a/export"}, {priorityInteractive, "b/interactive"}, {priorityScheduled, "c/scheduled"}},
+			want:    []string{"b/interactive", "c/scheduled", "a/export"},
+		},
+		{
+			name:    "tenant with fewest running executions first",
+			running: map[string]int{"a": 2},
+			waiters: []waiter{{priorityInteractive, "a/1"}, {priorityInteractive, "b/1"}},
+			want:    []string{"b/1", "a/1"},
+		},
+		{
+			name:    "tenants take turns",
+			waiters: []waiter{{priorityInteractive, "a/1"}, {priorityInteractive, "a/2"}, {priorityInteractive, "a/3"}, {priorityInteractive, "b/1"}},
+			want:    []string{"a/1", "b/1", "a/2", "a/3"},
+		},
+		{
+			name:    "ties go to the tenant served least recently",
+			granted: map[string]uint64{"a": 5, "b": 3},
+			waiters: []waiter{{priorityInteractive, "a/1"}, {priorityInteractive, "b/1"}},
+			want:    []string{"b/1", "a/1"},
+		},
+		{
+			name:    "priority beats fairness",
+			running: map[string]int{"a": 3},
+			waiters: []waiter{{priorityExport, "b/1"}, {priorityInteractive, "a/1"}},
+			want:    []string{"a/1", "b/1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQueryQueue()
+			for tenant, n := range tt.running {
+				q.byTenant[tenant] = n
+				q.running += n
+			}
+			for tenant, seq := range tt.granted {
+				q.granted[tenant] = seq
+				q.seq = max(q.seq, seq)
+			}
+			names := make(map[*queueWaiter]string)
+			for _, w := range tt.waiters {
+				qw := &queueWaiter{tenant: w.name[:1], ready: make(chan struct{})}
+				names[qw] = w.name
+				q.waiting[w.p] = append(q.waiting[w.p], qw)
+			}
+			var got []string
+			for range tt.waiters {
+				// Free one slot at a time to see who gets it
+				q.max = q.running + 1
+				q.dispatch()
+				for qw, name := range names {
+					if qw.granted {
+						got = append(got, name)
+						delete(names, qw)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("grant order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueAcquire(t *testing.T) {
+	q := newQueryQueue()
+	cfg := QueueConfig{MaxConcurrent: 1, MaxDepth: 1}
+	release, err := q.acquire(context.Background(), cfg, priorityInteractive, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A waiter that gives up leaves the queue
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.acquire(ctx, cfg, priorityInteractive, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire with expiring context = %v, want deadline exceeded", err)
+	}
+	if d := q.depth(); d != 0 || q.stats[priorityInteractive].timeouts != 1 {
+		t.Fatalf("depth %d and %d timeouts after giving up, want 0 and 1", d, q.stats[priorityInteractive].timeouts)
+	}
+
+	granted := make(chan func())
+	go func() {
+		release, err := q.acquire(context.Background(), cfg, priorityExport, "b")
+		if err != nil {
+			t.Error(err)
+		}
+		granted <- release
+	}()
+	for waiting := false; !waiting; {
+		q.mu.Lock()
+		waiting = q.depth() == 1
+		q.mu.Unlock()
+	}
+	// The queue is full now
+	var se *scriptError
+	if _, err := q.acquire(context.Background(), cfg, priorityInteractive, "c"); !errors.As(err, &se) || se.status != http.StatusServiceUnavailable {
+		t.Fatalf("acquire on a full queue = %v, want 503", err)
+	}
+
+	release()
+	release() // releasing twice frees one slot
+	select {
+	case r := <-granted:
+		r()
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not granted the released slot")
+	}
+	if q.running != 0 || len(q.byTenant) != 0 || len(q.granted) != 0 {
+		t.Errorf("queue still tracks %d running executions of %v, turns %v", q.running, q.byTenant, q.granted)
+	}
+}
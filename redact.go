@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"px.dev/pxapi/proto/vizierpb"
+)
+
+// RedactionConfig masks sensitive columns before results leave the service
+type RedactionConfig struct {
+	Rules []RedactionRule `json:"rules,omitempty"`
+	// HashKey keys the hash of "hash" rules. Without it, hashes of guessable values such as
+	// IP addresses can be reversed by trying them all.
+	HashKey string `json:"hash_key,omitempty"`
+}
+
+// RedactionRule masks the columns matching its name pattern or semantic type
+type RedactionRule struct {
+	// Column is a regular expression matched against column names, e.g. "(?i)^req_(headers|body)$"
+	Column string `json:"column,omitempty"`
+	// SemanticType matches columns Pixie assigns a semantic type to, e.g. "ip_address"
+	SemanticType string `json:"semantic_type,omitempty"`
+	// Action is "redact" (default), replacing values, or "hash", replacing them with a keyed
+	// hash so equal values can still be grouped and joined
+	Action string `json:"action,omitempty"`
+}
+
+const (
+	redactedValue = "[REDACTED]"
+	// redactedHashLen is the number of hex digits kept of a hashed value
+	redactedHashLen = 16
+)
+
+// redactor applies the rules of a RedactionConfig to query results
+type redactor struct {
+	rules   []redactionMatcher
+	hashKey []byte
+}
+
+// redactionMatcher is a compiled RedactionRule
+type redactionMatcher struct {
+	column   *regexp.Regexp
+	semantic string
+	hash     bool
+}
+
+// key identifies the rules in cache keys, so results cached before a rule change aren't
+// served unmasked
+func (c RedactionConfig) key() string {
+	if len(c.Rules) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(c)
+	return string(data)
+}
+
+// redactor compiles the configured rules, returning nil when there are none
+func (c *Config) redactor() (*redactor, error) {
+	if len(c.Redaction.Rules) == 0 {
+		return nil, nil
+	}
+	r := &redactor{hashKey: []byte(c.Redaction.HashKey)}
+	for i, rule := range c.Redaction.Rules {
+		var rr redactionMatcher
+		if rule.Column == "" && rule.SemanticType == "" {
+			return nil, fmt.Errorf("redaction rule %d matches no column", i)
+		}
+		if rule.Column != "" {
+			re, err := regexp.Compile(rule.Column)
+			if err != nil {
+				return nil, fmt.Errorf("redaction rule %d: %w", i, err)
+			}
+			rr.column = re
+		}
+		rr.semantic = strings.ToLower(strings.TrimPrefix(strings.ToUpper(rule.SemanticType), "ST_"))
+		switch rule.Action {
+		case "", "redact":
+		case "hash":
+			rr.hash = true
+		default:
+			return nil, fmt.Errorf("redaction rule %d: unknown action %q", i, rule.Action)
+		}
+		r.rules = append(r.rules, rr)
+	}
+	return r, nil
+}
+
+// match returns the first rule matching col, or nil
+func (r *redactor) match(col columnSchema) *redactionMatcher {
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if (rule.column == nil || rule.column.MatchString(col.Name)) &&
+			(rule.semantic == "" || rule.semantic == col.SemanticType) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// apply masks the cells of matching columns in place, in every output table of the
+// result. Masked columns become strings without a semantic type, so no format renders
+// them as their original type.
+func (r *redactor) apply(q *queryResult) {
+	if r == nil {
+		return
+	}
+	r.applyTable(q.Schema, q.Rows)
+	for _, t := range q.OtherTables {
+		r.applyTable(t.Schema, t.Rows)
+	}
+}
+
+// applyTable masks the rows of one table by the columns of its own schema
+func (r *redactor) applyTable(schema []columnSchema, rows [][]string) {
+	for c, col := range schema {
+		rule := r.match(col)
+		if rule == nil {
+			continue
+		}
+		for _, row := range rows {
+			if c >= len(row) || row[c] == "" {
+				continue
+			}
+			if rule.hash {
+				row[c] = r.hashValue(row[c])
+			} else {
+				row[c] = redactedValue
+			}
+		}
+		schema[c] = columnSchema{Name: col.Name, Type: "string", semantic: vizierpb.ST_NONE}
+	}
+}
+
+// hashValue returns a short keyed hash of v
+func (r *redactor) hashValue(v string) string {
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(v))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))[:redactedHashLen]
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustRedactor(t *testing.T, cfg RedactionConfig) *redactor {
+	t.Helper()
+	r, err := (&Config{Redaction: cfg}).redactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRedactorRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []RedactionRule
+		wantNil bool
+		wantErr bool
+	}{
+		{"no rules", nil, true, false},
+		{"column pattern", []RedactionRule{{Column: "(?i)^req_body$"}}, false, false},
+		{"semantic type with prefix", []RedactionRule{{SemanticType: "ST_IP_ADDRESS", Action: "hash"}}, false, false},
+		{"rule matching nothing", []RedactionRule{{Action: "hash"}}, false, true},
+		{"invalid pattern", []RedactionRule{{Column: "("}}, false, true},
+		{"unknown action", []RedactionRule{{Column: "a", Action: "drop"}}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := (&Config{Redaction: RedactionConfig{Rules: tt.rules}}).redactor()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("redactor() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && (r == nil) != tt.wantNil {
+				t.Errorf("redactor() = %v, want nil: %v", r, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestRedactSingleTable(t *testing.T) {
+	r := mustRedactor(t, RedactionConfig{
+		Rules: []RedactionRule{
+			{Column: "^req_body$"},
+			{SemanticType: "ip_address", Action: "hash"},
+		},
+		HashKey: "k",
+	})
+	res := &queryResult{
+		Columns: []string{"req_body", "remote_addr", "latency"},
+		Schema: []columnSchema{
+			{Name: "req_body", Type: "string"},
+			{Name: "remote_addr", Type: "string", SemanticType: "ip_address"},
+			{Name: "latency", Type: "int64", SemanticType: "duration_ns"},
+		},
+		Rows: [][]string{{"secret", "10.0.0.1", "5"}, {"", "10.0.0.1", "7"}, {"other", "10.0.0.2"}},
+	}
+	r.apply(res)
+
+	if res.Rows[0][0] != redactedValue || res.Rows[2][0] != redactedValue {
+		t.Errorf("req_body not redacted: %v", res.Rows)
+	}
+	if res.Rows[1][0] != "" {
+		t.Errorf("empty cell became %q", res.Rows[1][0])
+	}
+	a, b, c := res.Rows[0][1], res.Rows[1][1], res.Rows[2][1]
+	if !strings.HasPrefix(a, "sha256:") || len(a) != len("sha256:")+redactedHashLen || a != b || a == c {
+		t.Errorf("hashed addresses %q %q %q aren't stable per value", a, b, c)
+	}
+	if other := mustRedactor(t, RedactionConfig{Rules: []RedactionRule{{SemanticType: "ip_address", Action: "hash"}}, HashKey: "other"}); other.hashValue("10.0.0.1") == a {
+		t.Error("hash doesn't depend on the key")
+	}
+	if res.Rows[0][2] != "5" || res.Schema[2].SemanticType != "duration_ns" {
+		t.Errorf("unmatched column changed: %v %+v", res.Rows[0], res.Schema[2])
+	}
+	for _, c := range res.Schema[:2] {
+		if c.Type != "string" || c.SemanticType != "" {
+			t.Errorf("masked column %q keeps type %s/%s", c.Name, c.Type, c.SemanticType)
+		}
+	}
+}
+
+func TestRedactMultipleTables(t *testing.T) {
+	r := mustRedactor(t, RedactionConfig{Rules: []RedactionRule{{Column: "^token$"}}})
+	// The sensitive column sits at a different position in each table
+	res := &queryResult{
+		Columns: []string{"pod", "count"},
+		Schema:  []columnSchema{{Name: "pod", Type: "string"}, {Name: "count", Type: "int64"}},
+		Rows:    [][]string{{"a", "1"}},
+		OtherTables: []resultTable{
+			{
+				Name:    "sessions",
+				Columns: []string{"user", "token"},
+				Schema:  []columnSchema{{Name: "user", Type: "string"}, {Name: "token", Type: "string"}},
+				Rows:    [][]string{{"alice", "s3cr3t"}, {"bob", "hunter2"}},
+			},
+			{
+				Name:    "keys",
+				Columns: []string{"token"},
+				Schema:  []columnSchema{{Name: "token", Type: "string"}},
+				Rows:    [][]string{{"abc"}},
+			},
+		},
+	}
+	r.apply(res)
+
+	if want := [][]string{{"a", "1"}}; !reflect.DeepEqual(res.Rows, want) {
+		t.Errorf("first table = %v, want it unchanged", res.Rows)
+	}
+	if want := [][]string{{"alice", redactedValue}, {"bob", redactedValue}}; !reflect.DeepEqual(res.OtherTables[0].Rows, want) {
+		t.Errorf("sessions = %v, want %v", res.OtherTables[0].Rows, want)
+	}
+	if want := [][]string{{redactedValue}}; !reflect.DeepEqual(res.OtherTables[1].Rows, want) {
+		t.Errorf("keys = %v, want %v", res.OtherTables[1].Rows, want)
+	}
+}
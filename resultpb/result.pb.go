@@ -0,0 +1,517 @@
+// Binary encoding of query results, served for Accept: application/x-protobuf.
+// Regenerate result.pb.go from the repository root with:
+//   protoc --go_out=. --go_opt=paths=source_relative resultpb/result.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        v5.28.3
+// source: resultpb/result.proto
+
+package resultpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Result is the outcome of a script execution
+type Result struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Name of the Pixie output table
+	Table         string    `protobuf:"bytes,1,opt,name=table,proto3" json:"table,omitempty"`
+	Columns       []*Column `protobuf:"bytes,2,rep,name=columns,proto3" json:"columns,omitempty"`
+	Rows          []*Row    `protobuf:"bytes,3,rep,name=rows,proto3" json:"rows,omitempty"`
+	Stats         *Stats    `protobuf:"bytes,4,opt,name=stats,proto3" json:"stats,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Result) Reset() {
+	*x = Result{}
+	mi := &file_resultpb_result_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Result) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Result) ProtoMessage() {}
+
+func (x *Result) ProtoReflect() protoreflect.Message {
+	mi := &file_resultpb_result_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Result.ProtoReflect.Descriptor instead.
+func (*Result) Descriptor() ([]byte, []int) {
+	return file_resultpb_result_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Result) GetTable() string {
+	if x != nil {
+		return x.Table
+	}
+	return ""
+}
+
+func (x *Result) GetColumns() []*Column {
+	if x != nil {
+		return x.Columns
+	}
+	return nil
+}
+
+func (x *Result) GetRows() []*Row {
+	if x != nil {
+		return x.Rows
+	}
+	return nil
+}
+
+func (x *Result) GetStats() *Stats {
+	if x != nil {
+		return x.Stats
+	}
+	return nil
+}
+
+// Column describes a column, including the semantic type Pixie assigns to it
+type Column struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// Pixie data type, e.g. int64 or time64ns
+	Type string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	// e.g. duration_ns, bytes or pod_name; empty when Pixie has none
+	SemanticType  string `protobuf:"bytes,3,opt,name=semantic_type,json=semanticType,proto3" json:"semantic_type,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Column) Reset() {
+	*x = Column{}
+	mi := &file_resultpb_result_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Column) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Column) ProtoMessage() {}
+
+func (x *Column) ProtoReflect() protoreflect.Message {
+	mi := &file_resultpb_result_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Column.ProtoReflect.Descriptor instead.
+func (*Column) Descriptor() ([]byte, []int) {
+	return file_resultpb_result_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Column) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Column) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Column) GetSemanticType() string {
+	if x != nil {
+		return x.SemanticType
+	}
+	return ""
+}
+
+type Row struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Values        []*Value               `protobuf:"bytes,1,rep,name=values,proto3" json:"values,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Row) Reset() {
+	*x = Row{}
+	mi := &file_resultpb_result_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Row) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Row) ProtoMessage() {}
+
+func (x *Row) ProtoReflect() protoreflect.Message {
+	mi := &file_resultpb_result_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Row.ProtoReflect.Descriptor instead.
+func (*Row) Descriptor() ([]byte, []int) {
+	return file_resultpb_result_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Row) GetValues() []*Value {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+// Value is one typed cell. Cells that don't parse as their column type, e.g. in
+// pretty mode, are sent as strings; unset means null.
+type Value struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Kind:
+	//
+	//	*Value_StringValue
+	//	*Value_Int64Value
+	//	*Value_Float64Value
+	//	*Value_BoolValue
+	//	*Value_TimeNs
+	Kind          isValue_Kind `protobuf_oneof:"kind"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Value) Reset() {
+	*x = Value{}
+	mi := &file_resultpb_result_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Value) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Value) ProtoMessage() {}
+
+func (x *Value) ProtoReflect() protoreflect.Message {
+	mi := &file_resultpb_result_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Value.ProtoReflect.Descriptor instead.
+func (*Value) Descriptor() ([]byte, []int) {
+	return file_resultpb_result_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Value) GetKind() isValue_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return nil
+}
+
+func (x *Value) GetStringValue() string {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_StringValue); ok {
+			return x.StringValue
+		}
+	}
+	return ""
+}
+
+func (x *Value) GetInt64Value() int64 {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_Int64Value); ok {
+			return x.Int64Value
+		}
+	}
+	return 0
+}
+
+func (x *Value) GetFloat64Value() float64 {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_Float64Value); ok {
+			return x.Float64Value
+		}
+	}
+	return 0
+}
+
+func (x *Value) GetBoolValue() bool {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_BoolValue); ok {
+			return x.BoolValue
+		}
+	}
+	return false
+}
+
+func (x *Value) GetTimeNs() int64 {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_TimeNs); ok {
+			return x.TimeNs
+		}
+	}
+	return 0
+}
+
+type isValue_Kind interface {
+	isValue_Kind()
+}
+
+type Value_StringValue struct {
+	StringValue string `protobuf:"bytes,1,opt,name=string_value,json=stringValue,proto3,oneof"`
+}
+
+type Value_Int64Value struct {
+	Int64Value int64 `protobuf:"varint,2,opt,name=int64_value,json=int64Value,proto3,oneof"`
+}
+
+type Value_Float64Value struct {
+	Float64Value float64 `protobuf:"fixed64,3,opt,name=float64_value,json=float64Value,proto3,oneof"`
+}
+
+type Value_BoolValue struct {
+	BoolValue bool `protobuf:"varint,4,opt,name=bool_value,json=boolValue,proto3,oneof"`
+}
+
+type Value_TimeNs struct {
+	// Nanoseconds since the Unix epoch
+	TimeNs int64 `protobuf:"varint,5,opt,name=time_ns,json=timeNs,proto3,oneof"`
+}
+
+func (*Value_StringValue) isValue_Kind() {}
+
+func (*Value_Int64Value) isValue_Kind() {}
+
+func (*Value_Float64Value) isValue_Kind() {}
+
+func (*Value_BoolValue) isValue_Kind() {}
+
+func (*Value_TimeNs) isValue_Kind() {}
+
+type Stats struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	AcceptedBytes     int64                  `protobuf:"varint,1,opt,name=accepted_bytes,json=acceptedBytes,proto3" json:"accepted_bytes,omitempty"`
+	TotalBytes        int64                  `protobuf:"varint,2,opt,name=total_bytes,json=totalBytes,proto3" json:"total_bytes,omitempty"`
+	ExecutionTimeNs   int64                  `protobuf:"varint,3,opt,name=execution_time_ns,json=executionTimeNs,proto3" json:"execution_time_ns,omitempty"`
+	CompilationTimeNs int64                  `protobuf:"varint,4,opt,name=compilation_time_ns,json=compilationTimeNs,proto3" json:"compilation_time_ns,omitempty"`
+	BytesProcessed    int64                  `protobuf:"varint,5,opt,name=bytes_processed,json=bytesProcessed,proto3" json:"bytes_processed,omitempty"`
+	RecordsProcessed  int64                  `protobuf:"varint,6,opt,name=records_processed,json=recordsProcessed,proto3" json:"records_processed,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *Stats) Reset() {
+	*x = Stats{}
+	mi := &file_resultpb_result_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Stats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Stats) ProtoMessage() {}
+
+func (x *Stats) ProtoReflect() protoreflect.Message {
+	mi := &file_resultpb_result_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Stats.ProtoReflect.Descriptor instead.
+func (*Stats) Descriptor() ([]byte, []int) {
+	return file_resultpb_result_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Stats) GetAcceptedBytes() int64 {
+	if x != nil {
+		return x.AcceptedBytes
+	}
+	return 0
+}
+
+func (x *Stats) GetTotalBytes() int64 {
+	if x != nil {
+		return x.TotalBytes
+	}
+	return 0
+}
+
+func (x *Stats) GetExecutionTimeNs() int64 {
+	if x != nil {
+		return x.ExecutionTimeNs
+	}
+	return 0
+}
+
+func (x *Stats) GetCompilationTimeNs() int64 {
+	if x != nil {
+		return x.CompilationTimeNs
+	}
+	return 0
+}
+
+func (x *Stats) GetBytesProcessed() int64 {
+	if x != nil {
+		return x.BytesProcessed
+	}
+	return 0
+}
+
+func (x *Stats) GetRecordsProcessed() int64 {
+	if x != nil {
+		return x.RecordsProcessed
+	}
+	return 0
+}
+
+var File_resultpb_result_proto protoreflect.FileDescriptor
+
+const file_resultpb_result_proto_rawDesc = "" +
+	"\n" +
+	"\x15resultpb/result.proto\x12\x14pixie.dataservice.v1\"\xb8\x01\n" +
+	"\x06Result\x12\x14\n" +
+	"\x05table\x18\x01 \x01(\tR\x05table\x126\n" +
+	"\acolumns\x18\x02 \x03(\v2\x1c.pixie.dataservice.v1.ColumnR\acolumns\x12-\n" +
+	"\x04rows\x18\x03 \x03(\v2\x19.pixie.dataservice.v1.RowR\x04rows\x121\n" +
+	"\x05stats\x18\x04 \x01(\v2\x1b.pixie.dataservice.v1.StatsR\x05stats\"U\n" +
+	"\x06Column\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12#\n" +
+	"\rsemantic_type\x18\x03 \x01(\tR\fsemanticType\":\n" +
+	"\x03Row\x123\n" +
+	"\x06values\x18\x01 \x03(\v2\x1b.pixie.dataservice.v1.ValueR\x06values\"\xba\x01\n" +
+	"\x05Value\x12#\n" +
+	"\fstring_value\x18\x01 \x01(\tH\x00R\vstringValue\x12!\n" +
+	"\vint64_value\x18\x02 \x01(\x03H\x00R\n" +
+	"int64Value\x12%\n" +
+	"\rfloat64_value\x18\x03 \x01(\x01H\x00R\ffloat64Value\x12\x1f\n" +
+	"\n" +
+	"bool_value\x18\x04 \x01(\bH\x00R\tboolValue\x12\x19\n" +
+	"\atime_ns\x18\x05 \x01(\x03H\x00R\x06timeNsB\x06\n" +
+	"\x04kind\"\x81\x02\n" +
+	"\x05Stats\x12%\n" +
+	"\x0eaccepted_bytes\x18\x01 \x01(\x03R\racceptedBytes\x12\x1f\n" +
+	"\vtotal_bytes\x18\x02 \x01(\x03R\n" +
+	"totalBytes\x12*\n" +
+	"\x11execution_time_ns\x18\x03 \x01(\x03R\x0fexecutionTimeNs\x12.\n" +
+	"\x13compilation_time_ns\x18\x04 \x01(\x03R\x11compilationTimeNs\x12'\n" +
+	"\x0fbytes_processed\x18\x05 \x01(\x03R\x0ebytesProcessed\x12+\n" +
+	"\x11records_processed\x18\x06 \x01(\x03R\x10recordsProcessedB\x1dZ\x1bpixie-data-service/resultpbb\x06proto3"
+
+var (
+	file_resultpb_result_proto_rawDescOnce sync.Once
+	file_resultpb_result_proto_rawDescData []byte
+)
+
+func file_resultpb_result_proto_rawDescGZIP() []byte {
+	file_resultpb_result_proto_rawDescOnce.Do(func() {
+		file_resultpb_result_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_resultpb_result_proto_rawDesc), len(file_resultpb_result_proto_rawDesc)))
+	})
+	return file_resultpb_result_proto_rawDescData
+}
+
+var file_resultpb_result_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_resultpb_result_proto_goTypes = []any{
+	(*Result)(nil), // 0: pixie.dataservice.v1.Result
+	(*Column)(nil), // 1: pixie.dataservice.v1.Column
+	(*Row)(nil),    // 2: pixie.dataservice.v1.Row
+	(*Value)(nil),  // 3: pixie.dataservice.v1.Value
+	(*Stats)(nil),  // 4: pixie.dataservice.v1.Stats
+}
+var file_resultpb_result_proto_depIdxs = []int32{
+	1, // 0: pixie.dataservice.v1.Result.columns:type_name -> pixie.dataservice.v1.Column
+	2, // 1: pixie.dataservice.v1.Result.rows:type_name -> pixie.dataservice.v1.Row
+	4, // 2: pixie.dataservice.v1.Result.stats:type_name -> pixie.dataservice.v1.Stats
+	3, // 3: pixie.dataservice.v1.Row.values:type_name -> pixie.dataservice.v1.Value
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_resultpb_result_proto_init() }
+func file_resultpb_result_proto_init() {
+	if File_resultpb_result_proto != nil {
+		return
+	}
+	file_resultpb_result_proto_msgTypes[3].OneofWrappers = []any{
+		(*Value_StringValue)(nil),
+		(*Value_Int64Value)(nil),
+		(*Value_Float64Value)(nil),
+		(*Value_BoolValue)(nil),
+		(*Value_TimeNs)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_resultpb_result_proto_rawDesc), len(file_resultpb_result_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_resultpb_result_proto_goTypes,
+		DependencyIndexes: file_resultpb_result_proto_depIdxs,
+		MessageInfos:      file_resultpb_result_proto_msgTypes,
+	}.Build()
+	File_resultpb_result_proto = out.File
+	file_resultpb_result_proto_goTypes = nil
+	file_resultpb_result_proto_depIdxs = nil
+}
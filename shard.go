@@ -0,0 +1,238 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"px.dev/pxapi"
+)
+
+const (
+	// maxShards bounds the number of chunks one execution is split into
+	maxShards                  = 1000
+	defaultMaxShardParallelism = 4
+)
+
+// shardSpec splits the time range of an execution into chunks run as separate queries
+type shardSpec struct {
+	// Chunk is the length of each time range chunk
+	Chunk time.Duration
+	// Parallelism is the number of chunks executed at once (default 1, sequential)
+	Parallelism int
+}
+
+// key identifies the spec in cache keys. Sharded results hold the same rows, but may
+// differ in their stats.
+func (s *shardSpec) key() string {
+	if s == nil {
+		return ""
+	}
+	return s.Chunk.String() + "/" + strconv.Itoa(s.Parallelism)
+}
+
+// newShardSpec validates a chunk length and parallelism, bounded by max_shard_parallelism
+func newShardSpec(config *Config, chunk string, parallelism int) (*shardSpec, error) {
+	if chunk == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(chunk)
+	if err != nil || d <= 0 {
+		return nil, &scriptError{http.StatusBadRequest, "Invalid shard size", fmt.Errorf("%q is not a positive duration", chunk)}
+	}
+	limit := config.MaxShardParallelism
+	if limit <= 0 {
+		limit = defaultMaxShardParallelism
+	}
+	if parallelism < 0 || parallelism > limit {
+		return nil, &scriptError{http.StatusBadRequest, "Invalid shard parallelism", fmt.Errorf("%d is not between 1 and %d", parallelism, limit)}
+	}
+	return &shardSpec{Chunk: d, Parallelism: max(parallelism, 1)}, nil
+}
+
+// requestShards reads the ?shard= and ?shard_parallelism= query parameters
+func requestShards(r *http.Request, config *Config) (*shardSpec, error) {
+	q := r.URL.Query()
+	parallelism := 0
+	if v := q.Get("shard_parallelism"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, &scriptError{http.StatusBadRequest, "Invalid shard parallelism", fmt.Errorf("%q is not a number", v)}
+		}
+		parallelism = n
+	}
+	return newShardSpec(config, q.Get("shard"), parallelism)
+}
+
+// runRange executes a script, splitting its time range into chunks when opts.Shards is set
+func runRange(ctx context.Context, config *Config, script string, opts execOptions) (*queryResult, error) {
+	if opts.Shards == nil {
+		return runScript(ctx, config, script, opts)
+	}
+	if opts.Range == (timeRange{}) {
+		return nil, &scriptError{http.StatusBadRequest, "Invalid time range", errors.New("sharded execution requires a time range")}
+	}
+	// Without a start_time to rewrite every chunk would query the whole range
+	if !usesTimeRange(script) {
+		return nil, &scriptError{http.StatusUnprocessableEntity, "Script can't be sharded", errors.New("it has no start_time argument or ${start_time} parameter to apply the chunks to")}
+	}
+	start, end, err := opts.Range.resolve(time.Now())
+	if err != nil {
+		return nil, &scriptError{http.StatusBadRequest, "Invalid time range", err}
+	}
+	// The chunks are checked one by one as they run, but together they cost as much as the
+	// whole range, which must not slip under max_bytes by being split
+	pxl, _, err := prepareScript(script, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := config.Cost.check(cmp.Or(opts.Name, scriptID(script)), tableSeconds(pxl, time.Now())); err != nil {
+		return nil, err
+	}
+	chunks, err := splitRange(start, end, opts.Shards.Chunk)
+	if err != nil {
+		return nil, err
+	}
+	// The stitched result holds the rows of all chunks, so they share one memory budget
+	opts.budget = new(atomic.Int64)
+
+	// The first failure cancels the chunks still running; their errors are not reported
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	parts := make([]*queryResult, len(chunks))
+	var mu sync.Mutex
+	var failure error
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(opts.Shards.Parallelism, len(chunks)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				chunk := opts
+				chunk.Range, chunk.Shards = chunks[i], nil
+				res, err := runScript(ctx, config, script, chunk)
+				mu.Lock()
+				if err != nil && failure == nil {
+					failure = shardError(err, i, len(chunks), chunks[i])
+					cancel()
+				}
+				parts[i] = res
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range chunks {
+		if ctx.Err() != nil {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	if failure == nil {
+		failure = ctx.Err()
+	}
+	if failure != nil {
+		for _, p := range parts {
+			if p != nil {
+				p.release()
+			}
+		}
+		return nil, failure
+	}
+	return stitch(parts)
+}
+
+// splitRange cuts the window from start to end into chunks of the given length, the last
+// one possibly shorter
+func splitRange(start, end time.Time, chunk time.Duration) ([]timeRange, error) {
+	var chunks []timeRange
+	for from := start; from.Before(end); from = from.Add(chunk) {
+		if len(chunks) == maxShards {
+			return nil, &scriptError{http.StatusBadRequest, "Too many shards",
+				fmt.Errorf("%v split into %v chunks exceeds %d shards", end.Sub(start), chunk, maxShards)}
+		}
+		to := from.Add(chunk)
+		if to.After(end) {
+			to = end
+		}
+		chunks = append(chunks, timeRange{Start: from.Format(time.RFC3339Nano), End: to.Format(time.RFC3339Nano)})
+	}
+	return chunks, nil
+}
+
+// shardError attributes an execution failure to its chunk, keeping its status
+func shardError(err error, i, n int, tr timeRange) error {
+	log.Printf("ERROR: Shard %d of %d (%s to %s) failed: %v\n", i+1, n, tr.Start, tr.End, err)
+	var se *scriptError
+	if errors.As(err, &se) {
+		return &scriptError{se.status, se.msg, fmt.Errorf("shard %d of %d (%s to %s): %w", i+1, n, tr.Start, tr.End, se.err)}
+	}
+	return fmt.Errorf("shard %d of %d (%s to %s): %w", i+1, n, tr.Start, tr.End, err)
+}
+
+// stitch concatenates the rows of chunk results in order and sums their stats. The parts
+// must not be used afterwards.
+func stitch(parts []*queryResult) (*queryResult, error) {
+	res := &queryResult{Stats: &pxapi.ResultsStats{}, cells: &cellAllocator{}}
+	fail := func(err error) (*queryResult, error) {
+		res.release()
+		for _, q := range parts {
+			q.release()
+		}
+		return nil, &scriptError{http.StatusInternalServerError, "Failed to stitch shards", err}
+	}
+	for _, p := range parts {
+		if len(p.Columns) > 0 {
+			if res.Columns == nil {
+				res.Columns, res.Schema, res.table = p.Columns, p.Schema, p.table
+			} else if !slices.Equal(res.Columns, p.Columns) {
+				return fail(fmt.Errorf("shards returned different columns: %v and %v", res.Columns, p.Columns))
+			}
+		}
+		for i, t := range p.OtherTables {
+			if i == len(res.OtherTables) {
+				res.OtherTables = append(res.OtherTables, resultTable{Name: t.Name, Columns: t.Columns, Schema: t.Schema})
+			} else if o := res.OtherTables[i]; o.Name != t.Name || !slices.Equal(o.Columns, t.Columns) {
+				return fail(fmt.Errorf("shards returned different tables: %s %v and %s %v", o.Name, o.Columns, t.Name, t.Columns))
+			}
+			res.OtherTables[i].Rows = append(res.OtherTables[i].Rows, t.Rows...)
+		}
+		for _, a := range p.archived {
+			a.start += len(res.Rows)
+			res.archived = append(res.archived, a)
+		}
+		res.Rows = append(res.Rows, p.Rows...)
+		if s := p.Stats; s != nil {
+			res.Stats.AcceptedBytes += s.AcceptedBytes
+			res.Stats.TotalBytes += s.TotalBytes
+			res.Stats.ExecutionTime += s.ExecutionTime
+			res.Stats.CompilationTime += s.CompilationTime
+			res.Stats.BytesProcessed += s.BytesProcessed
+			res.Stats.RecordsProcessed += s.RecordsProcessed
+		}
+		if p.estimate != nil {
+			if res.estimate == nil {
+				res.estimate = &costEstimate{Basis: p.estimate.Basis}
+			}
+			res.estimate.Bytes += p.estimate.Bytes
+			res.estimate.Warning = cmp.Or(res.estimate.Warning, p.estimate.Warning)
+		}
+		// The stitched rows live on in the chunks' slabs
+		if p.cells != nil {
+			res.cells.adopt(p.cells)
+			p.cells = nil
+		}
+	}
+	return res, nil
+}
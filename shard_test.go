@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"px.dev/pxapi"
+)
+
+func TestSplitRange(t *testing.T) {
+	start := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		length  time.Duration
+		chunk   time.Duration
+		want    []timeRange
+		wantErr bool
+	}{
+		{
+			name: "even chunks", length: time.Hour, chunk: 30 * time.Minute,
+			want: []timeRange{{"2026-03-01T10:00:00Z", "2026-03-01T10:30:00Z"}, {"2026-03-01T10:30:00Z", "2026-03-01T11:00:00Z"}},
+		},
+		{
+			name: "shorter last chunk", length: 50 * time.Minute, chunk: 20 * time.Minute,
+			want: []timeRange{{"2026-03-01T10:00:00Z", "2026-03-01T10:20:00Z"}, {"2026-03-01T10:20:00Z", "2026-03-01T10:40:00Z"}, {"2026-03-01T10:40:00Z", "2026-03-01T10:50:00Z"}},
+		},
+		{
+			name: "chunk longer than the range", length: 5 * time.Minute, chunk: time.Hour,
+			want: []timeRange{{"2026-03-01T10:00:00Z", "2026-03-01T10:05:00Z"}},
+		},
+		{name: "too many shards", length: maxShards*time.Minute + time.Second, chunk: time.Minute, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitRange(start, start.Add(tt.length), tt.chunk)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitRange() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitRange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStitch(t *testing.T) {
+	cols := []string{"pod", "reqs"}
+	tests := []struct {
+		name      string
+		parts     []*queryResult
+		wantRows  [][]string
+		wantStats pxapi.ResultsStats
+		wantBytes int64
+		wantErr   bool
+	}{
+		{
+			name: "rows in chunk order with summed stats",
+			parts: []*queryResult{
+				{Columns: cols, Rows: [][]string{{"a", "1"}}, Stats: &pxapi.ResultsStats{BytesProcessed: 10, RecordsProcessed: 1}, estimate: &costEstimate{Bytes: 100, Basis: "script"}},
+				{Columns: cols, Rows: [][]string{{"b", "2"}, {"c", "3"}}, Stats: &pxapi.ResultsStats{BytesProcessed: 20, RecordsProcessed: 2}, estimate: &costEstimate{Bytes: 50, Basis: "script"}},
+			},
+			wantRows:  [][]string{{"a", "1"}, {"b", "2"}, {"c", "3"}},
+			wantStats: pxapi.ResultsStats{BytesProcessed: 30, RecordsProcessed: 3},
+			wantBytes: 150,
+		},
+		{
+			name: "empty chunks without columns",
+			parts: []*queryResult{
+				{},
+				{Columns: cols, Rows: [][]string{{"a", "1"}}},
+				{},
+			},
+			wantRows: [][]string{{"a", "1"}},
+		},
+		{
+			name: "chunks disagreeing on columns",
+			parts: []*queryResult{
+				{Columns: cols, Rows: [][]string{{"a", "1"}}},
+				{Columns: []string{"pod"}, Rows: [][]string{{"b"}}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := stitch(tt.parts)
+			if tt.wantErr {
+				var se *scriptError
+				if !errors.As(err, &se) || se.status != http.StatusInternalServerError {
+					t.Fatalf("stitch() error = %v, want 500", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res.Columns, cols) || !reflect.DeepEqual(res.Rows, tt.wantRows) {
+				t.Errorf("stitch() = %v %v, want %v %v", res.Columns, res.Rows, cols, tt.wantRows)
+			}
+			if *res.Stats != tt.wantStats {
+				t.Errorf("stats = %+v, want %+v", *res.Stats, tt.wantStats)
+			}
+			if tt.wantBytes != 0 && (res.estimate == nil || res.estimate.Bytes != tt.wantBytes) {
+				t.Errorf("estimate = %+v, want %d bytes", res.estimate, tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestRunRangeRejects(t *testing.T) {
+	const id = "shard-test"
+	costs.mu.Lock()
+	costs.scripts[id] = &costRate{rate: 1000, samples: defaultCostSamples}
+	costs.mu.Unlock()
+	defer func() {
+		costs.mu.Lock()
+		delete(costs.scripts, id)
+		costs.mu.Unlock()
+	}()
+	config := &Config{Cost: CostConfig{MaxBytes: 1 << 20}}
+	shards := &shardSpec{Chunk: 10 * time.Minute, Parallelism: 1}
+
+	tests := []struct {
+		name   string
+		script string
+		last   time.Duration
+		want   int
+	}{
+		// Each chunk would run the same query, returning every row once per chunk
+		{"script without start_time", "df = px.DataFrame(table='http_events')\npx.display(df)", time.Hour, http.StatusUnprocessableEntity},
+		// An hour of one table at 1000 bytes per second is 3.6MB, over max_bytes in total but
+		// not in any one chunk
+		{"whole range over the cost limit", "df = px.DataFrame(table='http_events', start_time='-5m')\npx.display(df)", time.Hour, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := execOptions{Name: id, Range: timeRange{Start: "-" + tt.last.String()}, Shards: shards}
+			_, err := runRange(context.Background(), config, tt.script, opts)
+			var se *scriptError
+			if !errors.As(err, &se) || se.status != tt.want {
+				t.Fatalf("runRange() error = %v, want status %d", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTablePrinterSharedBudget(t *testing.T) {
+	rec := benchRecord()
+	var shared atomic.Int64
+	first := &tablePrinter{maxBytes: 1000, shared: &shared}
+	second := &tablePrinter{maxBytes: 1000, shared: &shared}
+	// Each row takes a bit over 100 bytes, so the two chunks fill the budget together
+	h := benchTable(first)
+	for i := 0; i < 5; i++ {
+		if err := h.HandleRecord(context.Background(), rec); err != nil {
+			t.Fatalf("first chunk row %d: %v", i, err)
+		}
+	}
+	h = benchTable(second)
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		err = h.HandleRecord(context.Background(), rec)
+	}
+	if !errors.Is(err, errResultTooLarge) {
+		t.Fatalf("chunks together exceeded the budget without an error, got %v", err)
+	}
+	if first.bytes > first.maxBytes || second.bytes > second.maxBytes {
+		t.Errorf("each chunk alone is within budget: %d and %d bytes", first.bytes, second.bytes)
+	}
+}
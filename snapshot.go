@@ -0,0 +1,357 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SnapshotConfig controls result snapshots shared through /snapshots/{token} links
+type SnapshotConfig struct {
+	// TTL is how long a snapshot is served unless its request asks otherwise (default 24h)
+	TTL string `json:"ttl,omitempty"`
+	// MaxTTL bounds the ttl callers may request (default 168h)
+	MaxTTL string `json:"max_ttl,omitempty"`
+	// BaseURL prefixes the returned links, e.g. https://pixie-data.example.com; without it
+	// links are relative to the service
+	BaseURL string `json:"base_url,omitempty"`
+	// TrustProxy builds links without a BaseURL from the X-Forwarded-Proto and
+	// X-Forwarded-Host headers. Only enable it behind a reverse proxy that sets them.
+	TrustProxy bool `json:"trust_proxy,omitempty"`
+}
+
+const (
+	defaultSnapshotTTL    = 24 * time.Hour
+	defaultSnapshotMaxTTL = 7 * 24 * time.Hour
+)
+
+// snapshot is a result set frozen under a token
+type snapshot struct {
+	Token     string    `json:"token"`
+	Script    string    `json:"script"`
+	Cluster   string    `json:"cluster"`
+	Caller    string    `json:"caller"`
+	Rows      int       `json:"rows"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// result is the JSON-encoded queryResult
+	result []byte
+}
+
+// snapshotStore keeps snapshots in the history database when it is enabled, so links
+// survive restarts, and in memory otherwise
+type snapshotStore struct {
+	db     *sql.DB
+	sealer *sealer
+
+	mu      sync.Mutex
+	entries map[string]*snapshot
+}
+
+var snapshots = &snapshotStore{entries: make(map[string]*snapshot)}
+
+const snapshotSchema = `
+CREATE TABLE IF NOT EXISTS snapshots (
+	token      TEXT    PRIMARY KEY,
+	script     TEXT    NOT NULL,
+	cluster    TEXT    NOT NULL,
+	caller     TEXT    NOT NULL,
+	row_count  INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	result     BLOB    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS snapshots_expires_at ON snapshots(expires_at);
+`
+
+// persistTo moves snapshot storage into the history database
+func (s *snapshotStore) persistTo(h *historyStore) error {
+	if _, err := h.db.Exec(snapshotSchema); err != nil {
+		return fmt.Errorf("could not initialize snapshot table: %w", err)
+	}
+	s.db, s.sealer = h.db, h.sealer
+	return nil
+}
+
+// errNoSnapshot is returned for unknown and expired tokens
+var errNoSnapshot = errors.New("no such snapshot")
+
+// put stores a snapshot, dropping expired ones
+func (s *snapshotStore) put(snap *snapshot) error {
+	now := time.Now()
+	if s.db == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for token, e := range s.entries {
+			if now.After(e.ExpiresAt) {
+				delete(s.entries, token)
+			}
+		}
+		s.entries[snap.Token] = snap
+		return nil
+	}
+	if _, err := s.db.Exec(`DELETE FROM snapshots WHERE expires_at < ?`, now.UnixMilli()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(
+		`INSERT INTO snapshots (token, script, cluster, caller, row_count, created_at, expires_at, result)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		snap.Token, s.sealer.sealString(snap.Script, "snapshot script"), snap.Cluster, snap.Caller, snap.Rows,
+		snap.CreatedAt.UnixMilli(), snap.ExpiresAt.UnixMilli(), s.sealer.seal(snap.result, "snapshot result"))
+	return err
+}
+
+// get returns a live snapshot
+func (s *snapshotStore) get(token string) (*snapshot, error) {
+	now := time.Now()
+	if s.db == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		snap, ok := s.entries[token]
+		if !ok || now.After(snap.ExpiresAt) {
+			return nil, errNoSnapshot
+		}
+		return snap, nil
+	}
+	snap := &snapshot{Token: token}
+	var createdAt, expiresAt int64
+	err := s.db.QueryRow(`SELECT script, cluster, caller, row_count, created_at, expires_at, result FROM snapshots WHERE token = ?`, token).
+		Scan(&snap.Script, &snap.Cluster, &snap.Caller, &snap.Rows, &createdAt, &expiresAt, &snap.result)
+	if err == sql.ErrNoRows {
+		return nil, errNoSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+	snap.CreatedAt, snap.ExpiresAt = time.UnixMilli(createdAt).UTC(), time.UnixMilli(expiresAt).UTC()
+	if now.After(snap.ExpiresAt) {
+		return nil, errNoSnapshot
+	}
+	if snap.Script, err = s.sealer.openString(snap.Script, "snapshot script"); err != nil {
+		return nil, err
+	}
+	if snap.result, err = s.sealer.open(snap.result, "snapshot result"); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// snapshotTTL resolves the lifetime of a new snapshot from the request and configuration.
+// Only a bad requested ttl is a scriptError; other errors are in the configuration.
+func (c *Config) snapshotTTL(requested string) (time.Duration, error) {
+	ttl, err := configDuration("snapshots.ttl", c.Snapshots.TTL, defaultSnapshotTTL)
+	if err != nil {
+		return 0, err
+	}
+	maxTTL, err := configDuration("snapshots.max_ttl", c.Snapshots.MaxTTL, defaultSnapshotMaxTTL)
+	if err != nil {
+		return 0, err
+	}
+	if ttl > maxTTL {
+		return 0, fmt.Errorf("snapshots.ttl %v exceeds snapshots.max_ttl %v in config file", ttl, maxTTL)
+	}
+	if requested == "" {
+		return ttl, nil
+	}
+	if ttl, err = time.ParseDuration(requested); err != nil || ttl <= 0 {
+		return 0, &scriptError{http.StatusBadRequest, "Invalid 'ttl' field", fmt.Errorf("%q is not a positive duration such as \"24h\"", requested)}
+	}
+	if ttl > maxTTL {
+		return 0, &scriptError{http.StatusBadRequest, "Invalid 'ttl' field", fmt.Errorf("%v exceeds the maximum of %v", ttl, maxTTL)}
+	}
+	return ttl, nil
+}
+
+// snapshotURL is the shareable link of a snapshot. The request's headers are up to the
+// caller, so they are only used to build it when a trusted proxy sets them.
+func snapshotURL(r *http.Request, config *Config, token string) string {
+	base := config.Snapshots.BaseURL
+	if base == "" && config.Snapshots.TrustProxy {
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			base = cmp.Or(r.Header.Get("X-Forwarded-Proto"), scheme) + "://" + host
+		}
+	}
+	return strings.TrimSuffix(base, "/") + "/snapshots/" + token
+}
+
+// snapshotHandler runs a script, or loads an archived result, and stores the result set
+// under a new token
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Script    string        `json:"script"`
+		Params    requestParams `json:"params"`
+		Cluster   string        `json:"cluster"`
+		HistoryID int64         `json:"history_id"`
+		TTL       string        `json:"ttl"`
+	}
+	if err := decodeBody(r, &req, false); err != nil {
+		writeScriptError(w, err)
+		return
+	}
+
+	config, err := requestConfig(r)
+	if err != nil {
+		log.Printf("ERROR: Failed to load config: %v\n", err)
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+	ttl, err := config.snapshotTTL(req.TTL)
+	if err != nil {
+		var se *scriptError
+		if !errors.As(err, &se) {
+			log.Printf("ERROR: Invalid snapshot configuration: %v\n", err)
+		}
+		writeScriptError(w, err)
+		return
+	}
+
+	snap := &snapshot{Caller: tenantFromRequest(r), CreatedAt: time.Now().UTC()}
+	var res *queryResult
+	switch {
+	case req.HistoryID != 0:
+		if req.Script != "" {
+			http.Error(w, "Only one of 'script' and 'history_id' may be given", http.StatusBadRequest)
+			return
+		}
+		if res, err = archivedResult(req.HistoryID, historyScope(r)); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		snap.Script, snap.Cluster = fmt.Sprintf("query %d", req.HistoryID), "archive"
+	case req.Script != "":
+		if denyArbitraryScripts(w, config) {
+			return
+		}
+		if err := cmp.Or(config.checkScript(req.Script), config.checkParams(req.Params)); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		opts, err := requestOptions(r, config)
+		if err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		opts.Params = req.Params
+		config.applyDefaults(req.Cluster, "", req.Script, nil, &opts)
+		if opts.ClusterID, err = config.clusterID(req.Cluster); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		if res, err = runRange(r.Context(), config, req.Script, opts); err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		defer res.release()
+		if opts.Downsample != nil {
+			reduced, err := downsample(res, opts.Downsample)
+			if err != nil {
+				writeScriptError(w, &scriptError{http.StatusUnprocessableEntity, "Downsampling failed", err})
+				return
+			}
+			res = reduced
+		}
+		snap.Script, snap.Cluster = preview(req.Script), cmp.Or(req.Cluster, "default")+" ("+opts.ClusterID+")"
+	default:
+		http.Error(w, "Either 'script' or 'history_id' is required", http.StatusBadRequest)
+		return
+	}
+
+	// Results are stored as archived by runScript: raw values, with redaction applied
+	if snap.result, err = encodeJSON(res); err != nil {
+		writeScriptError(w, &scriptError{http.StatusInternalServerError, "Failed to encode result", err})
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	snap.Token = hex.EncodeToString(b)
+	snap.Rows = len(res.Rows)
+	snap.ExpiresAt = snap.CreatedAt.Add(ttl)
+	if err := snapshots.put(snap); err != nil {
+		log.Printf("ERROR: Failed to store snapshot: %v\n", err)
+		http.Error(w, "Failed to store snapshot", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Snapshot %s of %s (%d rows) created by %s, expires %s\n", snap.Token[:8], snap.Script, snap.Rows, cmp.Or(snap.Caller, "anonymous"), snap.ExpiresAt.Format(time.RFC3339))
+
+	writeJSON(w, struct {
+		*snapshot
+		URL string `json:"url"`
+	}{snap, snapshotURL(r, config, snap.Token)})
+}
+
+// snapshotViewHandler serves a snapshot read-only, in any registered format. The token
+// is the credential, so links can be opened by anyone they were shared with.
+func snapshotViewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snap, err := snapshots.get(r.PathValue("token"))
+	if errors.Is(err, errNoSnapshot) {
+		http.Error(w, "Snapshot not found or expired", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to read snapshot: %v\n", err)
+		http.Error(w, "Failed to read snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	format, err := negotiateFormat(r)
+	if err != nil {
+		writeScriptError(w, err)
+		return
+	}
+	formatter := formatters[format]
+	var res queryResult
+	if err := json.Unmarshal(snap.result, &res); err != nil {
+		writeScriptError(w, &scriptError{http.StatusInternalServerError, "Cannot decode snapshot", err})
+		return
+	}
+	res.script, res.cluster = snap.Script, snap.Cluster
+	if prettyRequested(r) {
+		res.prettify()
+	}
+	var payload []byte
+	if cf, ok := formatter.(codecFormatter); ok {
+		config, err := requestConfig(r)
+		if err != nil {
+			log.Printf("ERROR: Failed to load config: %v\n", err)
+			http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+			return
+		}
+		codec, err := formatCodec(config, format, formatter, r.URL.Query().Get("compression"))
+		if err != nil {
+			writeScriptError(w, err)
+			return
+		}
+		payload, err = cf.FormatCodec(&res, codec)
+	} else {
+		payload, err = formatter.Format(&res)
+	}
+	if err != nil {
+		writeScriptError(w, &scriptError{http.StatusInternalServerError, "Failed to encode result", err})
+		return
+	}
+	w.Header().Set("X-Snapshot-Created", snap.CreatedAt.Format(time.RFC3339))
+	w.Header().Set("X-Snapshot-Expires", snap.ExpiresAt.Format(time.RFC3339))
+	writeCachable(w, r, payload, etagFor(payload), formatter.ContentType())
+}
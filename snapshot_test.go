@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"px.dev/pxapi/proto/vizierpb"
+	"px.dev/pxapi/types"
+)
+
+func TestSnapshotURL(t *testing.T) {
+	forwarded := http.Header{"X-Forwarded-Host": {"pixie-data.example.com"}, "X-Forwarded-Proto": {"https"}}
+	tests := []struct {
+		name   string
+		config SnapshotConfig
+		header http.Header
+		want   string
+	}{
+		{"base URL", SnapshotConfig{BaseURL: "https://pixie.example.com/"}, forwarded, "https://pixie.example.com/snapshots/t"},
+		{"untrusted forwarded headers", SnapshotConfig{}, forwarded, "/snapshots/t"},
+		{"trusted proxy", SnapshotConfig{TrustProxy: true}, forwarded, "https://pixie-data.example.com/snapshots/t"},
+		{"trusted proxy without forwarded host", SnapshotConfig{TrustProxy: true}, http.Header{"X-Forwarded-Proto": {"https"}}, "/snapshots/t"},
+		{"base URL behind a trusted proxy", SnapshotConfig{BaseURL: "https://pixie.example.com", TrustProxy: true}, forwarded, "https://pixie.example.com/snapshots/t"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://attacker.example.com/pixie/snapshot", nil)
+			r.Header = tt.header
+			if got := snapshotURL(r, &Config{Snapshots: tt.config}, "t"); got != tt.want {
+				t.Errorf("snapshotURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotPretty(t *testing.T) {
+	res := &queryResult{
+		Columns: []string{"pod", "latency"},
+		Schema: []columnSchema{
+			{Name: "pod", Type: "string"},
+			newColumnSchema(types.ColSchema{Name: "latency", Type: vizierpb.INT64, SemanticType: vizierpb.ST_DURATION_NS}),
+		},
+		Rows: [][]string{{"a", "12300000"}},
+	}
+	payload, err := encodeJSON(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Snapshots and archived results are stored as JSON
+	var decoded queryResult
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Schema, res.Schema) {
+		t.Fatalf("decoded schema %+v, want %+v", decoded.Schema, res.Schema)
+	}
+	decoded.prettify()
+	if got := decoded.Rows[0]; got[0] != "a" || got[1] == "12300000" {
+		t.Errorf("prettify() left %v", got)
+	}
+}
+
+func TestSnapshotOfOtherTenantsHistory(t *testing.T) {
+	h, err := openHistory(HistoryConfig{Path: filepath.Join(t.TempDir(), "history.db"), StoreResults: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.db.Close()
+	saved := history
+	history = h
+	defer func() { history = saved }()
+	id := h.save(&historyEntry{StartedAt: time.Now(), Script: "a", Caller: "team-a"}, []byte(`{"columns":["pod"],"rows":[["a"]]}`))
+
+	tests := []struct {
+		name   string
+		caller *identity
+		want   int
+	}{
+		{"owner", &identity{Tenant: "team-a"}, http.StatusOK},
+		{"admin", &identity{Tenant: "sre", Roles: []string{"admin"}}, http.StatusOK},
+		{"other tenant", &identity{Tenant: "team-b"}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]int64{"history_id": id})
+			r := httptest.NewRequest(http.MethodPost, "/pixie/snapshot", strings.NewReader(string(body)))
+			r = r.WithContext(context.WithValue(r.Context(), identityKey{}, tt.caller))
+			w := httptest.NewRecorder()
+			snapshotHandler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestSnapshotTTL(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     SnapshotConfig
+		requested  string
+		want       time.Duration
+		wantStatus int
+	}{
+		{"default", SnapshotConfig{}, "", defaultSnapshotTTL, 0},
+		{"configured", SnapshotConfig{TTL: "1h"}, "", time.Hour, 0},
+		{"requested", SnapshotConfig{MaxTTL: "48h"}, "36h", 36 * time.Hour, 0},
+		{"requested over the maximum", SnapshotConfig{MaxTTL: "48h"}, "72h", 0, http.StatusBadRequest},
+		{"requested not a duration", SnapshotConfig{}, "tomorrow", 0, http.StatusBadRequest},
+		// A configured ttl over max_ttl is the operator's mistake, not the caller's
+		{"configured over the maximum", SnapshotConfig{TTL: "72h", MaxTTL: "48h"}, "", 0, http.StatusInternalServerError},
+		{"configured over the maximum with a valid request", SnapshotConfig{TTL: "72h", MaxTTL: "48h"}, "1h", 0, http.StatusInternalServerError},
+		{"invalid max_ttl", SnapshotConfig{MaxTTL: "soon"}, "", 0, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&Config{Snapshots: tt.config}).snapshotTTL(tt.requested)
+			if tt.wantStatus == 0 {
+				if err != nil || got != tt.want {
+					t.Errorf("snapshotTTL() = %v, %v, want %v", got, err, tt.want)
+				}
+				return
+			}
+			w := httptest.NewRecorder()
+			writeScriptError(w, err)
+			if err == nil || w.Code != tt.wantStatus {
+				t.Errorf("snapshotTTL() error = %v, responded %d, want %d", err, w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
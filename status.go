@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"px.dev/pxapi"
+)
+
+// clusterStatusTimeout bounds the Pixie cloud lookup of a status request
+const clusterStatusTimeout = 10 * time.Second
+
+// clusterStatus is the data-source health of one cluster
+type clusterStatus struct {
+	Name      string `json:"name"`
+	ClusterID string `json:"cluster_id"`
+	// State summarizes the cloud-reported status and recent queries: connected, degraded,
+	// disconnected, unreachable or unknown
+	State string `json:"state"`
+	// Mode is how queries reach Vizier; pxapi only supports proxying through the cloud
+	Mode          string     `json:"mode"`
+	VizierName    string     `json:"vizier_name,omitempty"`
+	VizierStatus  string     `json:"vizier_status,omitempty"`
+	VizierVersion string     `json:"vizier_version,omitempty"`
+	CloudError    string     `json:"cloud_error,omitempty"`
+	Pooled        bool       `json:"pooled"`
+	LastSuccess   *time.Time `json:"last_success,omitempty"`
+	LastError     *time.Time `json:"last_error,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// clusterStatusHandler reports the connection state of a cluster from the Pixie cloud and
+// the queries the pool has seen. "default" names px_cluster_id unless a cluster is
+// registered under that name.
+func clusterStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	config, err := requestConfig(r)
+	if err != nil {
+		log.Printf("ERROR: Failed to load config: %v\n", err)
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+	name := r.PathValue("name")
+	lookup := name
+	if _, ok := config.Clusters[name]; !ok && name == "default" {
+		lookup = ""
+	}
+	clusterID, err := config.clusterID(lookup)
+	if err != nil {
+		writeScriptError(w, err)
+		return
+	}
+
+	st := clusterStatus{Name: name, ClusterID: clusterID, Mode: "passthrough"}
+	health, pooled := pool.clusterState(clusterID)
+	st.Pooled = pooled
+	if !health.LastSuccess.IsZero() {
+		st.LastSuccess = &health.LastSuccess
+	}
+	if !health.LastError.IsZero() {
+		st.LastError, st.Error = &health.LastError, health.Error
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), clusterStatusTimeout)
+	defer cancel()
+	info, err := pool.vizierInfo(ctx, config, clusterID)
+	if err != nil {
+		st.State, st.CloudError = "unreachable", err.Error()
+		writeJSON(w, st)
+		return
+	}
+	st.VizierName, st.VizierStatus, st.VizierVersion = info.Name, string(info.Status), info.Version
+	switch info.Status {
+	case pxapi.VizierStatusHealthy:
+		st.State = "connected"
+		if health.LastError.After(health.LastSuccess) {
+			st.State = "degraded"
+		}
+	case pxapi.VizierStatusUnhealthy, pxapi.VizierStatusDegraded:
+		st.State = "degraded"
+	case pxapi.VizierStatusDisconnected:
+		st.State = "disconnected"
+	default:
+		st.State = "unknown"
+	}
+	writeJSON(w, st)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeRange is a query window as provided by callers. Start and End accept RFC3339
+// timestamps, relative offsets such as "-15m", or "now".
+type timeRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// parseTimeSpec resolves an RFC3339 timestamp, a relative offset or "now" against now
+func parseTimeSpec(spec string, now time.Time) (time.Time, error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case spec == "" || spec == "now":
+		return now, nil
+	case strings.HasPrefix(spec, "-"):
+		d, err := time.ParseDuration(spec[1:])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid relative time %q", spec)
+		}
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, spec)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected RFC3339, a relative offset like -15m, or now", spec)
+	}
+	return t, nil
+}
+
+// resolve turns the range into absolute start and end times
+func (tr timeRange) resolve(now time.Time) (time.Time, time.Time, error) {
+	if tr.Start == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("missing start time")
+	}
+	start, err := parseTimeSpec(tr.Start, now)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := parseTimeSpec(tr.End, now)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("start time %s is not before end time %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	return start, end, nil
+}
+
+var (
+	startTimeArg = regexp.MustCompile(`\bstart_time(\s*=\s*)('[^']*'|"[^"]*"|-?\w+)`)
+	endTimeArg   = regexp.MustCompile(`\bend_time(\s*=\s*)('[^']*'|"[^"]*"|-?\w+)`)
+)
+
+// hasStartTime reports whether a script sets a start_time argument applyTimeRange can rewrite
+func hasStartTime(script string) bool {
+	return startTimeArg.MatchString(script)
+}
+
+// usesTimeRange reports whether a time range reaches the query of a script, through a
+// start_time argument or a ${start_time} parameter
+func usesTimeRange(script string) bool {
+	return hasStartTime(script) || strings.Contains(script, "${start_time}")
+}
+
+// applyTimeRange rewrites the start_time/end_time arguments of a PXL script to absolute
+// nanosecond timestamps. Scripts that do not set start_time are returned unchanged.
+func applyTimeRange(script string, start, end time.Time) string {
+	startNs := strconv.FormatInt(start.UnixNano(), 10)
+	endNs := strconv.FormatInt(end.UnixNano(), 10)
+	if endTimeArg.MatchString(script) {
+		script = endTimeArg.ReplaceAllString(script, "end_time${1}"+endNs)
+		return startTimeArg.ReplaceAllString(script, "start_time${1}"+startNs)
+	}
+	return startTimeArg.ReplaceAllString(script, "start_time${1}"+startNs+", end_time="+endNs)
+}
+
+// requestTimeRange reads the ?start=, ?end= and ?last= query parameters. last=15m is
+// shorthand for start=-15m and cannot be combined with start. The zero range means none
+// was given.
+func requestTimeRange(r *http.Request) (timeRange, error) {
+	q := r.URL.Query()
+	tr := timeRange{Start: q.Get("start"), End: q.Get("end")}
+	if last := q.Get("last"); last != "" {
+		if tr.Start != "" {
+			return timeRange{}, &scriptError{http.StatusBadRequest, "Invalid time range", fmt.Errorf("last and start are mutually exclusive")}
+		}
+		if d, err := time.ParseDuration(last); err != nil || d <= 0 {
+			return timeRange{}, &scriptError{http.StatusBadRequest, "Invalid time range", fmt.Errorf("invalid duration %q for last", last)}
+		}
+		tr.Start = "-" + last
+	}
+	if tr == (timeRange{}) {
+		return tr, nil
+	}
+	// Validate now so bad ranges fail before anything is executed
+	if _, _, err := tr.resolve(time.Now()); err != nil {
+		return timeRange{}, &scriptError{http.StatusBadRequest, "Invalid time range", err}
+	}
+	return tr, nil
+}
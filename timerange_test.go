@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyTimeRange(t *testing.T) {
+	start := time.Unix(0, 1000)
+	end := time.Unix(0, 2000)
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{
+			name:   "adds end_time after start_time",
+			script: "px.DataFrame(table='http_events', start_time='-5m')",
+			want:   "px.DataFrame(table='http_events', start_time=1000, end_time=2000)",
+		},
+		{
+			name:   "rewrites both bounds",
+			script: `px.DataFrame(table='http_events', start_time="-5m", end_time="-1m")`,
+			want:   "px.DataFrame(table='http_events', start_time=1000, end_time=2000)",
+		},
+		{
+			name:   "keeps the spacing around =",
+			script: "px.DataFrame('conn_stats', start_time = '-5m')",
+			want:   "px.DataFrame('conn_stats', start_time = 1000, end_time=2000)",
+		},
+		{
+			name:   "variables and negative numbers",
+			script: "px.DataFrame('conn_stats', start_time=-300000000000, end_time=window_end)",
+			want:   "px.DataFrame('conn_stats', start_time=1000, end_time=2000)",
+		},
+		{
+			name:   "every DataFrame",
+			script: "a = px.DataFrame('x', start_time='-5m')\nb = px.DataFrame('y', start_time='-1h')",
+			want:   "a = px.DataFrame('x', start_time=1000, end_time=2000)\nb = px.DataFrame('y', start_time=1000, end_time=2000)",
+		},
+		{
+			name:   "without start_time",
+			script: "px.DataFrame(table='http_events')",
+			want:   "px.DataFrame(table='http_events')",
+		},
+		{
+			name:   "longer names are left alone",
+			script: "px.DataFrame('x', start_time='-5m')\nmy_start_time='-5m'",
+			want:   "px.DataFrame('x', start_time=1000, end_time=2000)\nmy_start_time='-5m'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applyTimeRange(tt.script, start, end); got != tt.want {
+				t.Errorf("applyTimeRange() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeRangeResolve(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		tr         timeRange
+		start, end time.Time
+		wantErr    bool
+	}{
+		{"relative start until now", timeRange{Start: "-15m"}, now.Add(-15 * time.Minute), now, false},
+		{"absolute bounds", timeRange{Start: "2026-03-01T10:00:00Z", End: "2026-03-01T11:00:00Z"}, now.Add(-2 * time.Hour), now.Add(-time.Hour), false},
+		{"missing start", timeRange{End: "now"}, time.Time{}, time.Time{}, true},
+		{"start after end", timeRange{Start: "-1h", End: "-2h"}, time.Time{}, time.Time{}, true},
+		{"bad offset", timeRange{Start: "-5x"}, time.Time{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := tt.tr.resolve(now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolve() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if !start.Equal(tt.start) || !end.Equal(tt.end) {
+				t.Errorf("resolve() = %v, %v; want %v, %v", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
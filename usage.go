@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"px.dev/pxapi"
+)
+
+// tenantHeader names the request header used to attribute queries to a tenant
+const tenantHeader = "X-Tenant-ID"
+
+// defaultTenant is used when a request does not identify its tenant
+const defaultTenant = "default"
+
+// QuotaLimits caps usage within a single period. Zero means unlimited.
+type QuotaLimits struct {
+	BytesProcessed  int64 `json:"bytes_processed,omitempty"`
+	RecordsReturned int64 `json:"records_returned,omitempty"`
+	Queries         int64 `json:"queries,omitempty"`
+}
+
+// TenantQuota holds the daily and monthly limits of a tenant
+type TenantQuota struct {
+	Daily   QuotaLimits `json:"daily,omitzero"`
+	Monthly QuotaLimits `json:"monthly,omitzero"`
+}
+
+// usageCounters accumulates metered values
+type usageCounters struct {
+	BytesProcessed  int64 `json:"bytes_processed"`
+	RecordsReturned int64 `json:"records_returned"`
+	Queries         int64 `json:"queries"`
+}
+
+func (c *usageCounters) add(o usageCounters) {
+	c.BytesProcessed += o.BytesProcessed
+	c.RecordsReturned += o.RecordsReturned
+	c.Queries += o.Queries
+}
+
+func (c usageCounters) plus(o usageCounters) usageCounters {
+	c.add(o)
+	return c
+}
+
+func (c *usageCounters) sub(o usageCounters) {
+	c.BytesProcessed -= o.BytesProcessed
+	c.RecordsReturned -= o.RecordsReturned
+	c.Queries -= o.Queries
+}
+
+// exceeds returns a description of the first limit already reached, or "" if none is
+func (c usageCounters) exceeds(l QuotaLimits) string {
+	switch {
+	case l.Queries > 0 && c.Queries >= l.Queries:
+		return fmt.Sprintf("queries (%d/%d)", c.Queries, l.Queries)
+	case l.BytesProcessed > 0 && c.BytesProcessed >= l.BytesProcessed:
+		return fmt.Sprintf("bytes processed (%d/%d)", c.BytesProcessed, l.BytesProcessed)
+	case l.RecordsReturned > 0 && c.RecordsReturned >= l.RecordsReturned:
+		return fmt.Sprintf("records returned (%d/%d)", c.RecordsReturned, l.RecordsReturned)
+	}
+	return ""
+}
+
+// tenantUsage tracks a tenant's usage for the current day and month
+type tenantUsage struct {
+	Day     string        `json:"day"`
+	Month   string        `json:"month"`
+	Daily   usageCounters `json:"daily"`
+	Monthly usageCounters `json:"monthly"`
+	Total   usageCounters `json:"total"`
+	// Reserved is held by executions in flight until they are metered
+	Reserved usageCounters `json:"reserved"`
+}
+
+// roll resets the period counters once the day or month has changed
+func (u *tenantUsage) roll(now time.Time) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if u.Day != day {
+		u.Day = day
+		u.Daily = usageCounters{}
+	}
+	if u.Month != month {
+		u.Month = month
+		u.Monthly = usageCounters{}
+	}
+}
+
+// usageMeter keeps usage per tenant, persisted to the history database when it is enabled
+type usageMeter struct {
+	mu      sync.Mutex
+	tenants map[string]*tenantUsage
+	db      *sql.DB
+}
+
+var usage = &usageMeter{tenants: make(map[string]*tenantUsage)}
+
+const usageSchema = `
+CREATE TABLE IF NOT EXISTS usage (
+	tenant   TEXT PRIMARY KEY,
+	counters TEXT NOT NULL
+);
+`
+
+// persistTo loads the counters saved in the history database and saves them there from now on
+func (m *usageMeter) persistTo(h *historyStore) error {
+	if _, err := h.db.Exec(usageSchema); err != nil {
+		return fmt.Errorf("could not initialize usage table: %w", err)
+	}
+	rows, err := h.db.Query(`SELECT tenant, counters FROM usage`)
+	if err != nil {
+		return fmt.Errorf("could not load usage: %w", err)
+	}
+	defer rows.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for rows.Next() {
+		var tenant, counters string
+		if err := rows.Scan(&tenant, &counters); err != nil {
+			return fmt.Errorf("could not load usage: %w", err)
+		}
+		u := &tenantUsage{}
+		if err := json.Unmarshal([]byte(counters), u); err != nil {
+			return fmt.Errorf("could not load usage of tenant %q: %w", tenant, err)
+		}
+		// Reservations of executions cut short by the restart are void
+		u.Reserved = usageCounters{}
+		m.tenants[tenant] = u
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not load usage: %w", err)
+	}
+	m.db = h.db
+	return nil
+}
+
+// save persists a tenant's counters; m.mu must be held so saves of a tenant don't reorder
+func (m *usageMeter) save(tenant string, u *tenantUsage) {
+	if m.db == nil {
+		return
+	}
+	counters, _ := json.Marshal(u)
+	if _, err := m.db.Exec(`INSERT INTO usage (tenant, counters) VALUES (?, ?)
+		ON CONFLICT(tenant) DO UPDATE SET counters = excluded.counters`, tenant, string(counters)); err != nil {
+		log.Printf("ERROR: Failed to save usage of tenant %q: %v\n", tenant, err)
+	}
+}
+
+func (m *usageMeter) get(tenant string) *tenantUsage {
+	u, ok := m.tenants[tenant]
+	if !ok {
+		u = &tenantUsage{}
+		m.tenants[tenant] = u
+	}
+	u.roll(time.Now().UTC())
+	return u
+}
+
+// usageReservation is the usage an execution holds against its tenant's quota while it runs
+type usageReservation struct {
+	m       *usageMeter
+	tenant  string
+	held    usageCounters
+	settled bool
+}
+
+// reserve returns an error if the tenant has already used up one of its quotas, counting
+// the reservations of executions in flight, and otherwise reserves one query and its
+// estimated bytes. The reservation must be settled or released.
+func (m *usageMeter) reserve(tenant string, quota TenantQuota, estimatedBytes int64) (*usageReservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.get(tenant)
+	if what := u.Daily.plus(u.Reserved).exceeds(quota.Daily); what != "" {
+		return nil, fmt.Errorf("daily quota exceeded for tenant %q: %s", tenant, what)
+	}
+	if what := u.Monthly.plus(u.Reserved).exceeds(quota.Monthly); what != "" {
+		return nil, fmt.Errorf("monthly quota exceeded for tenant %q: %s", tenant, what)
+	}
+	held := usageCounters{Queries: 1, BytesProcessed: estimatedBytes}
+	u.Reserved.add(held)
+	return &usageReservation{m: m, tenant: tenant, held: held}, nil
+}
+
+// settle replaces the reservation with the metered usage of the executed query
+func (r *usageReservation) settle(stats *pxapi.ResultsStats, records int) {
+	c := usageCounters{RecordsReturned: int64(records), Queries: 1}
+	if stats != nil {
+		c.BytesProcessed = stats.BytesProcessed
+	}
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	u := r.m.get(r.tenant)
+	u.Reserved.sub(r.held)
+	r.settled = true
+	u.Daily.add(c)
+	u.Monthly.add(c)
+	u.Total.add(c)
+	r.m.save(r.tenant, u)
+}
+
+// release returns the reservation of an execution that failed before it was metered; it
+// is a no-op once settled
+func (r *usageReservation) release() {
+	if r.settled {
+		return
+	}
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	r.m.get(r.tenant).Reserved.sub(r.held)
+	r.settled = true
+}
+
+// snapshot copies the usage of all tenants
+func (m *usageMeter) snapshot() map[string]tenantUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]tenantUsage, len(m.tenants))
+	for name := range m.tenants {
+		out[name] = *m.get(name)
+	}
+	return out
+}
+
+// tenantFromRequest returns the tenant a request is attributed to. X-Tenant-ID is only
+// honored from callers holding the admin or service role, which act on behalf of tenants;
+// everyone else is metered against their own token's tenant, or the default tenant when
+// API tokens are disabled.
+func tenantFromRequest(r *http.Request) string {
+	id := identityFrom(r.Context())
+	if id == nil {
+		return defaultTenant
+	}
+	if t := r.Header.Get(tenantHeader); t != "" && (id.hasRole("admin") || id.hasRole("service")) {
+		return t
+	}
+	return id.Tenant
+}
+
+// quotaFor returns the configured quota of a tenant, falling back to the "*" entry
+func (c *Config) quotaFor(tenant string) TenantQuota {
+	if q, ok := c.Quotas[tenant]; ok {
+		return q
+	}
+	return c.Quotas["*"]
+}
+
+// usageHandler reports per-tenant usage for chargeback
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config, err := requestConfig(r)
+	if err != nil {
+		http.Error(w, "Failed to load configuration", http.StatusInternalServerError)
+		return
+	}
+
+	type tenantReport struct {
+		Tenant string `json:"tenant"`
+		tenantUsage
+		Quota TenantQuota `json:"quota"`
+	}
+	filter := r.URL.Query().Get("tenant")
+	// Token holders only see their own tenant unless they hold the admin role
+	if id := identityFrom(r.Context()); id != nil && !id.hasRole("admin") {
+		if filter != "" && filter != id.Tenant {
+			http.Error(w, "Usage of other tenants requires the admin role", http.StatusForbidden)
+			return
+		}
+		filter = id.Tenant
+	}
+	all := usage.snapshot()
+	reports := []tenantReport{}
+	for name, u := range all {
+		if filter != "" && filter != name {
+			continue
+		}
+		reports = append(reports, tenantReport{Tenant: name, tenantUsage: u, Quota: config.quotaFor(name)})
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Tenant < reports[j].Tenant })
+
+	writeJSON(w, map[string]interface{}{"tenants": reports})
+}
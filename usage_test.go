@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"px.dev/pxapi"
+)
+
+func TestUsageReserve(t *testing.T) {
+	m := &usageMeter{tenants: make(map[string]*tenantUsage)}
+	quota := TenantQuota{Daily: QuotaLimits{Queries: 2}}
+
+	first, err := m.reserve("team-a", quota, 0)
+	if err != nil {
+		t.Fatalf("first reserve: %v", err)
+	}
+	second, err := m.reserve("team-a", quota, 0)
+	if err != nil {
+		t.Fatalf("second reserve: %v", err)
+	}
+	// Both executions are in flight, so a third must not slip under the limit
+	if _, err := m.reserve("team-a", quota, 0); err == nil {
+		t.Fatal("third reserve succeeded while two executions hold the quota")
+	}
+
+	first.settle(&pxapi.ResultsStats{BytesProcessed: 100}, 3)
+	second.release()
+	second.release()
+	u := m.tenants["team-a"]
+	if u.Reserved != (usageCounters{}) {
+		t.Errorf("reserved = %+v after settle and release, want zero", u.Reserved)
+	}
+	if want := (usageCounters{BytesProcessed: 100, RecordsReturned: 3, Queries: 1}); u.Daily != want {
+		t.Errorf("daily = %+v, want %+v", u.Daily, want)
+	}
+	if _, err := m.reserve("team-a", quota, 0); err != nil {
+		t.Errorf("reserve after release: %v", err)
+	}
+}
+
+func TestTenantFromRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     *identity
+		header string
+		want   string
+	}{
+		{"no tokens ignores header", nil, "team-b", defaultTenant},
+		{"token tenant", &identity{Tenant: "team-a"}, "", "team-a"},
+		{"plain token ignores header", &identity{Tenant: "team-a"}, "team-b", "team-a"},
+		{"service token acts for tenant", &identity{Tenant: "gw", Roles: []string{"service"}}, "team-b", "team-b"},
+		{"admin token acts for tenant", &identity{Tenant: "sre", Roles: []string{"admin"}}, "team-b", "team-b"},
+		{"service token without header", &identity{Tenant: "gw", Roles: []string{"service"}}, "", "gw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/pixie", nil)
+			if tt.id != nil {
+				r = r.WithContext(context.WithValue(r.Context(), identityKey{}, tt.id))
+			}
+			if tt.header != "" {
+				r.Header.Set(tenantHeader, tt.header)
+			}
+			if got := tenantFromRequest(r); got != tt.want {
+				t.Errorf("tenantFromRequest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsagePersists(t *testing.T) {
+	h, err := openHistory(HistoryConfig{Path: filepath.Join(t.TempDir(), "history.db")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.db.Close()
+
+	m := &usageMeter{tenants: make(map[string]*tenantUsage)}
+	if err := m.persistTo(h); err != nil {
+		t.Fatal(err)
+	}
+	r, err := m.reserve("team-a", TenantQuota{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.settle(&pxapi.ResultsStats{BytesProcessed: 42}, 7)
+	if _, err := m.reserve("team-a", TenantQuota{}, 500); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted service picks up the metered usage but not the abandoned reservation
+	restarted := &usageMeter{tenants: make(map[string]*tenantUsage)}
+	if err := restarted.persistTo(h); err != nil {
+		t.Fatal(err)
+	}
+	u := restarted.tenants["team-a"]
+	if u == nil {
+		t.Fatal("usage of team-a was not persisted")
+	}
+	if want := (usageCounters{BytesProcessed: 42, RecordsReturned: 7, Queries: 1}); u.Monthly != want || u.Reserved != (usageCounters{}) {
+		t.Errorf("monthly = %+v, reserved = %+v; want %+v and none reserved", u.Monthly, u.Reserved, want)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"px.dev/pxapi"
+)
+
+// clusterIDPattern matches the UUIDs Pixie identifies clusters by
+var clusterIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// configError lists every problem found in a config file
+type configError struct {
+	problems []string
+}
+
+func (e *configError) Error() string {
+	if len(e.problems) == 1 {
+		return e.problems[0]
+	}
+	return fmt.Sprintf("%d problems in config file: %s", len(e.problems), strings.Join(e.problems, "; "))
+}
+
+// decodeConfig parses a config file, rejecting unknown fields so typos don't silently
+// disable a setting. Errors name the line they occurred on.
+func decodeConfig(data []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var config Config
+	if err := dec.Decode(&config); err != nil {
+		offset := dec.InputOffset()
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			offset = syntaxErr.Offset
+		case errors.As(err, &typeErr):
+			offset = typeErr.Offset
+			err = fmt.Errorf("%s must be %s, not %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind().String()), typeErr.Value)
+		}
+		line := 1 + bytes.Count(data[:min(int(offset), len(data))], []byte("\n"))
+		return nil, fmt.Errorf("line %d: %w", line, err)
+	}
+	return &config, nil
+}
+
+// jsonTypeName describes a Go kind in JSON terms
+func jsonTypeName(kind string) string {
+	switch {
+	case kind == "string":
+		return "a string"
+	case kind == "bool":
+		return "a boolean"
+	case kind == "map", kind == "struct", kind == "ptr":
+		return "an object"
+	case kind == "slice", kind == "array":
+		return "an array"
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "a number"
+	}
+	return kind
+}
+
+// checkHostPort reports whether addr is a host:port address
+func checkHostPort(addr string) error {
+	if strings.Contains(addr, "://") {
+		return errors.New("must be host:port without a scheme")
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		return errors.New("must be host:port")
+	}
+	return nil
+}
+
+// validate checks the settings a typo or copy-paste error would otherwise only surface
+// when a request or scheduled job uses them
+func (c *Config) validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	duration := func(name, value string) {
+		if value == "" {
+			return
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			add("%s %q is not a positive duration such as \"30s\"", name, value)
+		}
+	}
+
+	if c.PXAPIKey == "" {
+		add("PX_API_KEY is not set in config file")
+	}
+	if c.PXClusterID == "" {
+		add("PX_CLUSTER_ID is not set in config file")
+	} else if !clusterIDPattern.MatchString(c.PXClusterID) {
+		add("px_cluster_id %q is not a cluster ID, which looks like 40f0f023-d641-429a-b22a-7895147da800", c.PXClusterID)
+	}
+	if c.CloudAddr == "" {
+		add("CLOUD_ADDR is not set in config file")
+	} else if err := checkHostPort(c.CloudAddr); err != nil {
+		add("cloud_addr %q %v, e.g. withpixie.ai:443", c.CloudAddr, err)
+	}
+	for name, cluster := range c.Clusters {
+		if name == "" {
+			add("clusters: cluster names must not be empty")
+		}
+		if !clusterIDPattern.MatchString(cluster.ClusterID) {
+			add("clusters.%s: cluster_id %q is not a cluster ID", name, cluster.ClusterID)
+		}
+	}
+	if c.DebugAddr != "" {
+		if err := checkHostPort(c.DebugAddr); err != nil {
+			add("debug_addr %q %v, e.g. 127.0.0.1:6060", c.DebugAddr, err)
+		}
+	}
+	if c.Datadog.Addr != "" {
+		if err := checkHostPort(c.Datadog.Addr); err != nil {
+			add("datadog.addr %q %v, e.g. 127.0.0.1:8125", c.Datadog.Addr, err)
+		}
+	}
+	for _, origin := range c.CORSOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			add("cors_origins: %q is not an origin such as https://app.example.com", origin)
+		}
+	}
+	if c.SLOTarget < 0 || c.SLOTarget >= 1 {
+		add("slo_target %v must be between 0 and 1", c.SLOTarget)
+	}
+
+	duration("exec_timeout", c.ExecTimeout)
+	duration("max_exec_timeout", c.MaxExecTimeout)
+	duration("history.compaction_interval", c.History.CompactionInterval)
+	duration("keepalive.interval", c.Keepalive.Interval)
+	duration("snapshots.ttl", c.Snapshots.TTL)
+	duration("snapshots.max_ttl", c.Snapshots.MaxTTL)
+	if ttl, err := configDuration("snapshots.ttl", c.Snapshots.TTL, defaultSnapshotTTL); err == nil {
+		if max, err := configDuration("snapshots.max_ttl", c.Snapshots.MaxTTL, defaultSnapshotMaxTTL); err == nil && ttl > max {
+			add("snapshots.ttl %v exceeds snapshots.max_ttl %v", ttl, max)
+		}
+	}
+	if u, err := url.Parse(c.Snapshots.BaseURL); c.Snapshots.BaseURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		add("snapshots.base_url %q is not an http(s) URL such as https://pixie-data.example.com", c.Snapshots.BaseURL)
+	}
+	if c.Cache.TTL != "" {
+		if d, err := time.ParseDuration(c.Cache.TTL); err != nil || d < 0 {
+			add("cache.ttl %q is not a duration such as \"30s\"", c.Cache.TTL)
+		}
+	}
+	if _, err := c.redactor(); err != nil {
+		add("redaction: %v", err)
+	}
+	for format, codec := range c.Compression {
+		cf, ok := formatters[format].(codecFormatter)
+		if !ok {
+			add("compression: format %q has no compression codecs", format)
+		} else if !slices.Contains(cf.Codecs(), codec) {
+			add("compression.%s: unknown codec %q, expected one of %s", format, codec, strings.Join(cf.Codecs(), ", "))
+		}
+	}
+
+	for cluster, defaults := range c.Defaults.Clusters {
+		if _, ok := c.Clusters[cluster]; !ok && cluster != "default" {
+			add("defaults.clusters: %v", errUnknownCluster(cluster))
+		}
+		duration("defaults.clusters."+cluster+"."+lastDefault, defaults[lastDefault])
+	}
+	for script, defaults := range c.Defaults.Scripts {
+		duration("defaults.scripts."+script+"."+lastDefault, defaults[lastDefault])
+	}
+
+	for name, job := range c.Exports {
+		if job.Script == "" {
+			add("exports.%s: script is not set", name)
+		}
+		if job.Interval == "" {
+			add("exports.%s: interval is not set", name)
+		}
+		duration("exports."+name+".interval", job.Interval)
+		if job.Cluster != "" {
+			if _, ok := c.Clusters[job.Cluster]; !ok {
+				add("exports.%s: %v", name, errUnknownCluster(job.Cluster))
+			}
+		}
+		if _, err := parsePriority(job.Priority, priorityExport); err != nil {
+			add("exports.%s: %v", name, err)
+		}
+		if _, err := newShardSpec(c, job.Shard, job.ShardParallelism); err != nil {
+			add("exports.%s: %v", name, err)
+		}
+		destinations := 0
+		checkEndpoint := func(dest, endpoint string) {
+			if u, err := url.Parse(endpoint); endpoint != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+				add("exports.%s.%s: endpoint %q is not an http(s) URL", name, dest, endpoint)
+			}
+		}
+		checkObjects := func(dest string, o *ObjectDestination) {
+			if o.Bucket == "" {
+				add("exports.%s.%s: bucket must be set", name, dest)
+			}
+			if _, _, _, err := o.format(c); err != nil {
+				add("exports.%s.%s: %v", name, dest, err)
+			}
+			checkEndpoint(dest, o.Endpoint)
+		}
+		if bq := job.BigQuery; bq != nil {
+			destinations++
+			if bq.Project == "" || bq.Dataset == "" || bq.Table == "" {
+				add("exports.%s.bigquery: project, dataset and table must be set", name)
+			}
+			checkEndpoint("bigquery", bq.Endpoint)
+		}
+		if s3 := job.S3; s3 != nil {
+			destinations++
+			checkObjects("s3", &s3.ObjectDestination)
+			if s3.Region == "" {
+				add("exports.%s.s3: region must be set", name)
+			}
+			if (s3.AccessKeyID == "") != (s3.SecretAccessKey == "") {
+				add("exports.%s.s3: access_key_id and secret_access_key must be set together", name)
+			}
+		}
+		if gcs := job.GCS; gcs != nil {
+			destinations++
+			checkObjects("gcs", &gcs.ObjectDestination)
+		}
+		switch {
+		case destinations == 0:
+			add("exports.%s: no destination is set", name)
+		case destinations > 1:
+			add("exports.%s: only one of bigquery, s3 and gcs may be set", name)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	slices.Sort(problems)
+	return &configError{problems}
+}
+
+// runCommand runs a command given on the command line instead of the server and returns
+// its exit code
+func runCommand(args []string) int {
+	if len(args) >= 2 && args[0] == "config" && args[1] == "check" && len(args) <= 3 {
+		filename := "config.json"
+		if len(args) == 3 {
+			filename = args[2]
+		}
+		return configCheck(filename)
+	}
+	fmt.Fprintln(os.Stderr, "usage: server [config check [file]]")
+	return 2
+}
+
+// configCheck validates a config file and connects to the Pixie cloud and each cluster
+// with its credentials, so broken settings are caught before deployment
+func configCheck(filename string) int {
+	config, err := loadConfig(filename)
+	var ce *configError
+	if errors.As(err, &ce) {
+		for _, p := range ce.problems {
+			fmt.Printf("FAIL %s: %s\n", filename, p)
+		}
+		return 1
+	}
+	if err != nil {
+		fmt.Printf("FAIL %s: %v\n", filename, err)
+		return 1
+	}
+	fmt.Printf("ok   %s is valid\n", filename)
+	failed := false
+	fail := func(format string, args ...interface{}) {
+		fmt.Printf("FAIL "+format+"\n", args...)
+		failed = true
+	}
+
+	if _, err := newSealer(config.Encryption); err != nil {
+		fail("encryption: %v", err)
+	}
+
+	clusters := configuredClusters(config)
+	names := make([]string, 0, len(clusters))
+	for name := range clusters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		id := clusters[name]
+		ctx, cancel := context.WithTimeout(context.Background(), clusterStatusTimeout)
+		info, err := pool.vizierInfo(ctx, config, id)
+		if err == nil {
+			_, err = pool.get(ctx, config, id)
+		}
+		cancel()
+		switch {
+		case isAuthError(err):
+			fail("cluster %s (%s): Pixie rejected the API key: %v", name, id, err)
+		case err != nil:
+			fail("cluster %s (%s): %v", name, id, err)
+		case info.Status != pxapi.VizierStatusHealthy:
+			fail("cluster %s (%s): Vizier %s is %s", name, id, info.Name, info.Status)
+		default:
+			fmt.Printf("ok   cluster %s (%s): Vizier %s %s is healthy\n", name, id, info.Name, info.Version)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, e.g. go build -ldflags "-X main.version=1.2.0 -X main.gitSHA=$(git rev-parse HEAD)"
+var (
+	version   = "dev"
+	gitSHA    = ""
+	buildTime = ""
+)
+
+// buildInfo describes the running binary
+type buildInfo struct {
+	Version      string `json:"version"`
+	GitSHA       string `json:"git_sha"`
+	BuildTime    string `json:"build_time"`
+	GoVersion    string `json:"go_version"`
+	PxAPIVersion string `json:"pxapi_version"`
+}
+
+// readBuildInfo combines link-time variables with the module and VCS info embedded by the Go toolchain
+func readBuildInfo() buildInfo {
+	info := buildInfo{Version: version, GitSHA: gitSHA, BuildTime: buildTime, GoVersion: runtime.Version(), PxAPIVersion: "unknown"}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == "px.dev/pxapi" {
+			info.PxAPIVersion = dep.Version
+			if dep.Replace != nil {
+				info.PxAPIVersion = dep.Replace.Version
+			}
+		}
+	}
+	for _, s := range bi.Settings {
+		switch {
+		case s.Key == "vcs.revision" && info.GitSHA == "":
+			info.GitSHA = s.Value
+		case s.Key == "vcs.time" && info.BuildTime == "":
+			info.BuildTime = s.Value
+		}
+	}
+	return info
+}
+
+// versionHandler reports the service and library versions
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, readBuildInfo())
+}